@@ -71,6 +71,7 @@ Web site: https://norouter.io`, "@BACKQUOTE@", "`")
 		agentCommand,
 		showExampleCommand,
 		showInstallerCommand,
+		routeCommand,
 	}
 	app.Action = managerAction
 	return app
@@ -182,6 +182,11 @@ func runManager(manifestPath string) error {
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err := m.Close(); err != nil {
+			logrus.WithError(err).Warn("failed to close the manager")
+		}
+	}()
 	errCh := make(chan error)
 	go func() {
 		errCh <- m.Run()
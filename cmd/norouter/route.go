@@ -0,0 +1,232 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/norouter/norouter/pkg/agent/hostnamemap"
+	"github.com/norouter/norouter/pkg/agent/resolver"
+	"github.com/norouter/norouter/pkg/manager"
+	"github.com/norouter/norouter/pkg/router"
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+
+	"github.com/urfave/cli/v2"
+)
+
+var routeCommand = &cli.Command{
+	Name:  "route",
+	Usage: "inspect routes",
+	Subcommands: []*cli.Command{
+		routeExplainCommand,
+	},
+}
+
+var routeExplainCommand = &cli.Command{
+	Name:      "explain",
+	Usage:     "explain why a packet or a hostname takes a path",
+	ArgsUsage: "FILE IP|HOSTNAME...",
+	Description: `Explain the routing decision for the specified IPs and hostnames, using the manifest FILE.
+
+The explanation is an offline approximation: the command does not connect to the running manager,
+so the routes learnt after the last write of .learntRoutes.file are not taken into account.
+The learnt routes are loaded from .learntRoutes.file, when it is specified in the manifest.
+
+The decision of the HTTP and SOCKS proxies is evaluated with the configuration of the "--from" host,
+but hostnames that are not virtual are resolved with the system resolver of the local host, not the "--from" host.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "from",
+			Usage: "the virtual hostname of the host where the HTTP and SOCKS proxies run (default: the only host without cmd)",
+		},
+		&cli.UintFlag{
+			Name:  "port",
+			Usage: "the TCP port, for evaluating the routes with ports (0 means an unknown port)",
+		},
+	},
+	Action: routeExplainAction,
+}
+
+func routeExplainAction(clicontext *cli.Context) error {
+	if clicontext.NArg() < 2 {
+		return errors.New("expected FILE and at least one IP or hostname")
+	}
+	manifestPath := clicontext.Args().First()
+	targets := clicontext.Args().Tail()
+	pm, err := loadManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	port := clicontext.Uint("port")
+	if port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	from := clicontext.String("from")
+	if from == "" {
+		var candidates []string
+		for name, h := range pm.Hosts {
+			if len(h.Cmd) == 0 {
+				candidates = append(candidates, name)
+			}
+		}
+		switch len(candidates) {
+		case 0:
+			return errors.New("all the hosts have cmd, specify \"--from\"")
+		case 1:
+			from = candidates[0]
+		default:
+			sort.Strings(candidates)
+			return fmt.Errorf("multiple hosts have no cmd (%s), specify \"--from\"", strings.Join(candidates, ", "))
+		}
+	}
+	ccSet, err := manager.NewCmdClientSet(context.Background(), pm)
+	if err != nil {
+		return err
+	}
+	fromHost, ok := pm.Hosts[from]
+	if !ok {
+		return fmt.Errorf("unknown host %q", from)
+	}
+	m, err := manager.New(ccSet)
+	if err != nil {
+		return err
+	}
+	args := ccSet.ByVIP[fromHost.VIP.String()].ConfigureRequestArgs()
+	hostnameMap := args.Hostnames()
+	vips := []net.IP{args.Me}
+	for _, o := range args.Others {
+		vips = append(vips, o.IP)
+	}
+	rv, err := resolver.NewWithOptions(&resolver.Options{
+		HostnameMap: hostnameMap,
+		Routes:      args.Routes,
+		VIPs:        vips,
+		NameServers: args.NameServers,
+		DNSRecords:  args.DNSRecords,
+		Egress:      args.Egress,
+	})
+	if err != nil {
+		return err
+	}
+	ex := &routeExplainer{
+		w:        clicontext.App.Writer,
+		m:        m,
+		rv:       rv,
+		from:     from,
+		port:     uint16(port),
+		vipNames: make(map[string][]string),
+		names:    hostnamemap.New(hostnameMap),
+	}
+	for name, ip := range hostnameMap {
+		ex.vipNames[ip.String()] = append(ex.vipNames[ip.String()], name)
+	}
+	for _, names := range ex.vipNames {
+		sort.Strings(names)
+	}
+	fmt.Fprintf(ex.w, "# Offline approximation using %q; the in-memory learnt routes of the running manager are not visible.\n", manifestPath)
+	if pm.LearntRoutes.File == "" {
+		fmt.Fprintf(ex.w, "# No learnt route is taken into account, as .learntRoutes.file is not specified.\n")
+	}
+	for _, target := range targets {
+		ex.explain(target)
+	}
+	return nil
+}
+
+type routeExplainer struct {
+	w        io.Writer
+	m        *manager.Manager
+	rv       *resolver.Resolver
+	from     string
+	port     uint16
+	vipNames map[string][]string // vip -> sorted names
+	names    *hostnamemap.Map
+}
+
+func (ex *routeExplainer) explain(target string) {
+	fmt.Fprintf(ex.w, "%s:\n", target)
+	if ip := net.ParseIP(target); ip != nil {
+		ex.explainIP(ip)
+	} else {
+		canon := dns.CanonicalName(target)
+		if vip, ok := ex.names.Lookup(canon); ok {
+			fmt.Fprintf(ex.w, "  Hostname: virtual hostname of %s\n", ex.describeIP(vip))
+			ex.explainIP(vip)
+		} else {
+			fmt.Fprintf(ex.w, "  Hostname: not a virtual hostname\n")
+			x := ex.m.ExplainRouteWithHostname(target, ex.port)
+			if x.Kind == router.ExplanationKindNone {
+				fmt.Fprintf(ex.w, "  Route: no hostname glob route matched\n")
+			} else {
+				fmt.Fprintf(ex.w, "  Route: hostname glob route %q%s via %s\n", x.Match, describePorts(x.Ports), ex.describeIP(x.Via))
+			}
+		}
+	}
+	rvx := ex.rv.Explain(target, ex.port)
+	decision := "dialed directly (not through the mesh)"
+	if rvx.Interesting {
+		decision = "dialed through the mesh"
+	} else if !ex.rv.DirectAllowed() {
+		decision = "refused (direct dialing is disabled)"
+	}
+	fmt.Fprintf(ex.w, "  Proxies on %q: %s, because %s\n", ex.from, decision, rvx.Reason)
+}
+
+func (ex *routeExplainer) explainIP(ip net.IP) {
+	x := ex.m.ExplainRoute(ip, ex.port)
+	switch x.Kind {
+	case router.ExplanationKindReserved:
+		fmt.Fprintf(ex.w, "  Route: %s is a virtual IP\n", ex.describeIP(x.Via))
+	case router.ExplanationKindLearntNeverForget:
+		fmt.Fprintf(ex.w, "  Route: learnt route via %s\n", ex.describeIP(x.Via))
+	case router.ExplanationKindLearnt:
+		expires := "never expires"
+		if !x.Expires.IsZero() {
+			expires = "expires at " + x.Expires.String()
+		}
+		fmt.Fprintf(ex.w, "  Route: learnt route%s via %s (learnt at %s, %s)\n", describePorts(x.Ports), ex.describeIP(x.Via), x.Learnt, expires)
+	case router.ExplanationKindCIDR:
+		fmt.Fprintf(ex.w, "  Route: CIDR route %q%s via %s\n", x.Match, describePorts(x.Ports), ex.describeIP(x.Via))
+	default:
+		fmt.Fprintf(ex.w, "  Route: no route matched, %s is not reachable from the mesh\n", ip)
+	}
+}
+
+func (ex *routeExplainer) describeIP(ip net.IP) string {
+	if names, ok := ex.vipNames[ip.String()]; ok {
+		return fmt.Sprintf("%s (%v)", ip, names)
+	}
+	return ip.String()
+}
+
+func describePorts(ports []jsonmsg.PortRange) string {
+	if len(ports) == 0 {
+		return ""
+	}
+	var ss []string
+	for _, pr := range ports {
+		ss = append(ss, pr.String())
+	}
+	return fmt.Sprintf(" (ports %s)", strings.Join(ss, ", "))
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package accesslog formats the access logs of the HTTP and SOCKS proxies.
+// Package accesslog is used by both the agent and the manager.
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+)
+
+// Entry is an entry of the access logs.
+type Entry = jsonmsg.AccessLogEntry
+
+// clfTimeLayout is the time layout of Common Log Format.
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// Format formats e with a newline.
+// format is either jsonmsg.AccessLogFormatCLF or jsonmsg.AccessLogFormatJSON.
+// The empty format is interpreted as jsonmsg.AccessLogFormatCLF.
+//
+// The CLF lines are appended with the extra fields, e.g.:
+//
+//	127.0.0.1:41234 - - [02/Jan/2021:15:04:05 +0900] "GET http://host1:8080/ HTTP/1.1" 200 612 proxy=http mesh=true vip=127.0.42.101 duration=12ms
+func Format(e *Entry, format string) ([]byte, error) {
+	switch format {
+	case "", jsonmsg.AccessLogFormatCLF:
+		return []byte(formatCLF(e) + "\n"), nil
+	case jsonmsg.AccessLogFormatJSON:
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+}
+
+func formatCLF(e *Entry) string {
+	client := e.Client
+	if client == "" {
+		client = "-"
+	}
+	target := e.URL
+	if target == "" {
+		target = e.Destination
+	}
+	method := e.Method
+	if method == "" {
+		method = "-"
+	}
+	proto := e.Proto
+	if proto == "" {
+		proto = "-"
+	}
+	status := "-"
+	if e.Status != 0 {
+		status = strconv.Itoa(e.Status)
+	}
+	s := fmt.Sprintf("%s - - [%s] %q %s %d proxy=%s mesh=%v",
+		client, e.Time.Format(clfTimeLayout), method+" "+target+" "+proto,
+		status, e.Bytes, e.Proxy, e.Mesh)
+	if e.VIP != nil {
+		s += " vip=" + e.VIP.String()
+	}
+	s += " duration=" + e.Duration.String()
+	if e.Error != "" {
+		s += " error=" + strconv.Quote(e.Error)
+	}
+	return s
+}
+
+// Logger logs the entries.
+type Logger interface {
+	Log(*Entry)
+}
+
+// LoggerFunc is a function that implements Logger.
+type LoggerFunc func(*Entry)
+
+func (f LoggerFunc) Log(e *Entry) {
+	f(e)
+}
+
+// NewWriterLogger returns a Logger that writes the formatted entries to w.
+func NewWriterLogger(w io.Writer, format string) (Logger, error) {
+	if _, err := Format(&Entry{}, format); err != nil {
+		return nil, err
+	}
+	l := &writerLogger{
+		w:      w,
+		format: format,
+	}
+	return l, nil
+}
+
+type writerLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+func (l *writerLogger) Log(e *Entry) {
+	b, err := Format(e, l.format)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	l.w.Write(b)
+	l.mu.Unlock()
+}
+
+type entryKey struct{}
+
+// WithEntry returns a context with the entry.
+// The entry is filled by the dialers during the request.
+func WithEntry(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, e)
+}
+
+// EntryFromContext returns the entry in ctx, or nil.
+func EntryFromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
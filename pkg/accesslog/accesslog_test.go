@@ -0,0 +1,96 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"gotest.tools/v3/assert"
+)
+
+func testEntry() *Entry {
+	return &Entry{
+		Time:        time.Date(2021, 1, 2, 15, 4, 5, 0, time.FixedZone("JST", 9*60*60)),
+		Proxy:       "http",
+		Client:      "127.0.0.1:41234",
+		Method:      "GET",
+		URL:         "http://host1:8080/",
+		Proto:       "HTTP/1.1",
+		Destination: "host1:8080",
+		VIP:         net.ParseIP("127.0.42.101"),
+		Mesh:        true,
+		Status:      200,
+		Bytes:       612,
+		Duration:    12 * time.Millisecond,
+	}
+}
+
+func TestFormatCLF(t *testing.T) {
+	b, err := Format(testEntry(), jsonmsg.AccessLogFormatCLF)
+	assert.NilError(t, err)
+	assert.Equal(t,
+		`127.0.0.1:41234 - - [02/Jan/2021:15:04:05 +0900] "GET http://host1:8080/ HTTP/1.1" 200 612 proxy=http mesh=true vip=127.0.42.101 duration=12ms`+"\n",
+		string(b))
+
+	e := &Entry{
+		Time:        testEntry().Time,
+		Proxy:       "socks",
+		Method:      "CONNECT",
+		Proto:       "SOCKS",
+		Destination: "example.com:443",
+		Error:       "refused",
+	}
+	b, err = Format(e, "")
+	assert.NilError(t, err)
+	assert.Equal(t,
+		`- - - [02/Jan/2021:15:04:05 +0900] "CONNECT example.com:443 SOCKS" - 0 proxy=socks mesh=false duration=0s error="refused"`+"\n",
+		string(b))
+}
+
+func TestFormatJSON(t *testing.T) {
+	b, err := Format(testEntry(), jsonmsg.AccessLogFormatJSON)
+	assert.NilError(t, err)
+	var e Entry
+	assert.NilError(t, json.Unmarshal(b, &e))
+	assert.Equal(t, "host1:8080", e.Destination)
+	assert.Equal(t, "127.0.42.101", e.VIP.String())
+	assert.Equal(t, 12*time.Millisecond, e.Duration)
+
+	_, err = Format(testEntry(), "xml")
+	assert.ErrorContains(t, err, "unknown access log format")
+}
+
+func TestWriterLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewWriterLogger(&buf, jsonmsg.AccessLogFormatJSON)
+	assert.NilError(t, err)
+	l.Log(testEntry())
+	l.Log(testEntry())
+	assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")))
+}
+
+func TestContext(t *testing.T) {
+	assert.Assert(t, EntryFromContext(context.Background()) == nil)
+	e := testEntry()
+	assert.Equal(t, e, EntryFromContext(WithEntry(context.Background(), e)))
+}
@@ -26,19 +26,26 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/norouter/norouter/pkg/accesslog"
+	"github.com/norouter/norouter/pkg/agent/allowlist"
 	"github.com/norouter/norouter/pkg/agent/bicopy"
 	"github.com/norouter/norouter/pkg/agent/bicopy/bicopyutil"
 	agentdns "github.com/norouter/norouter/pkg/agent/dns"
 	"github.com/norouter/norouter/pkg/agent/etchosts"
 	agenthttp "github.com/norouter/norouter/pkg/agent/http"
+	"github.com/norouter/norouter/pkg/agent/ingress"
 	"github.com/norouter/norouter/pkg/agent/loopback"
 	"github.com/norouter/norouter/pkg/agent/netstackutil"
 	"github.com/norouter/norouter/pkg/agent/netstackutil/gonetutil"
+	"github.com/norouter/norouter/pkg/agent/pac"
 	"github.com/norouter/norouter/pkg/agent/resolver"
 	agentsocks "github.com/norouter/norouter/pkg/agent/socks"
 	"github.com/norouter/norouter/pkg/agent/statedir"
+	"github.com/norouter/norouter/pkg/agent/upstreamproxy"
+	"github.com/norouter/norouter/pkg/policy"
 	"github.com/norouter/norouter/pkg/stream"
 	"github.com/norouter/norouter/pkg/stream/jsonmsg"
 	"github.com/norouter/norouter/pkg/version"
@@ -53,6 +60,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
 
 const (
@@ -72,7 +80,7 @@ func newStack() *stack.Stack {
 	}
 	opts := stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{newIPv4Protocol},
-		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
 		HandleLocal:        false,
 	}
 	st := stack.New(opts)
@@ -196,6 +204,7 @@ func (a *Agent) configure(args *jsonmsg.ConfigureRequestArgs) error {
 	})
 
 	a.meEP = meEP
+	args.HostnameMap = args.Hostnames()
 	a.config = args
 
 	for _, f := range a.config.Forwards {
@@ -216,24 +225,63 @@ func (a *Agent) configure(args *jsonmsg.ConfigureRequestArgs) error {
 		}
 	}
 
-	if err := a.configureDNS(); err != nil {
+	rvOpts := &resolver.Options{
+		HostnameMap:      a.config.HostnameMap,
+		Routes:           a.config.Routes,
+		VIPs:             a.vips(),
+		Stack:            a.stack,
+		NameServers:      a.config.NameServers,
+		DNSRecords:       a.config.DNSRecords,
+		EventSender:      a.sender,
+		Egress:           a.config.Egress,
+		CacheSize:        a.config.Resolver.CacheSize,
+		CacheTTL:         a.config.Resolver.CacheTTL,
+		SkipSystemLookup: a.config.Resolver.SkipSystemLookup,
+	}
+	if a.config.Resolver.DisableCache {
+		rvOpts.CacheSize = -1
+	}
+	rv, err := resolver.NewWithOptions(rvOpts)
+	if err != nil {
+		return err
+	}
+	go a.sendResolverStatsRoutine(rv)
+
+	if err := a.configureDNS(rv); err != nil {
 		return err
 	}
 
-	if a.config.HTTP.Listen != "" || a.config.SOCKS.Listen != "" {
-		rv, err := resolver.New(a.config.HostnameMap, a.config.Routes, a.vips(), a.stack, a.config.NameServers, a.sender)
+	if a.config.HTTP.Listen != "" || a.config.SOCKS.Listen != "" || a.config.Ingress.Listen != "" {
+		pol, err := policy.New(a.config.Policies)
+		if err != nil {
+			return err
+		}
+		accessLogger, err := a.newAccessLogger()
+		if err != nil {
+			return err
+		}
+		upstream, err := upstreamproxy.New(a.config.UpstreamProxy)
 		if err != nil {
 			return err
 		}
+		if upstream != nil {
+			logrus.Debugf("upstream proxy=%q (noProxy=%v)", upstream, a.config.UpstreamProxy.NoProxy)
+		}
 
 		if a.config.HTTP.Listen != "" {
-			if err := a.configureHTTP(rv); err != nil {
+			if err := a.configureHTTP(rv, pol, accessLogger, upstream); err != nil {
 				return err
 			}
 		}
 
 		if a.config.SOCKS.Listen != "" {
-			if err := a.configureSOCKS(rv); err != nil {
+			if err := a.configureSOCKS(rv, pol, accessLogger, upstream); err != nil {
+				return err
+			}
+		}
+
+		if a.config.Ingress.Listen != "" {
+			if err := a.configureIngress(rv, pol); err != nil {
 				return err
 			}
 		}
@@ -257,22 +305,55 @@ func (a *Agent) configure(args *jsonmsg.ConfigureRequestArgs) error {
 	return nil
 }
 
-func (a *Agent) configureDNS() error {
-	var dnsSrv *dns.Server
+func (a *Agent) configureDNS(rv *resolver.Resolver) error {
+	var (
+		dnsHandler *agentdns.Handler
+		dnsSrvs    = make(map[string]*dns.Server) // key: proto
+	)
 	for _, f := range a.config.NameServers {
 		if f.IP.Equal(a.config.Me) {
-			if f.Proto != "tcp" {
-				return fmt.Errorf("expected \"tcp\", got %q as the built-in DNS port", f.Proto)
+			if f.Proto != "tcp" && f.Proto != "udp" {
+				return fmt.Errorf("expected \"tcp\" or \"udp\", got %q as the built-in DNS port", f.Proto)
 			}
-			logrus.Debugf("dns virtual TCP port=%d", f.Port)
-			if dnsSrv != nil {
+			logrus.Debugf("dns virtual %s port=%d", f.Proto, f.Port)
+			if _, ok := dnsSrvs[f.Proto]; ok {
 				return errors.New("duplicated DNS?")
 			}
-			var err error
-			dnsSrv, err = agentdns.New(a.stack, a.config.Me, int(f.Port), a.config.HostnameMap)
+			if dnsHandler == nil {
+				var err error
+				cacheSize := a.config.DNS.CacheSize
+				if cacheSize == 0 {
+					cacheSize = agentdns.DefaultCacheSize
+				}
+				if a.config.DNS.DisableCache {
+					cacheSize = 0
+				}
+				opts := agentdns.HandlerOptions{
+					HostnameMap:       a.config.HostnameMap,
+					Ports:             a.publishedPorts(),
+					Records:           a.config.DNSRecords,
+					Domain:            a.config.Domain,
+					Upstreams:         a.config.DNS.Upstreams,
+					FallbackUpstreams: a.config.DNS.FallbackUpstreams,
+					DisableFallback:   a.config.DNS.DisableFallback,
+					CacheSize:         cacheSize,
+					Forward: func(req *dns.Msg) (*dns.Msg, error) {
+						return rv.ForwardDNS(req, a.config.Me)
+					},
+				}
+				if a.config.DNS.LogQueries {
+					opts.QueryLogger = a.sendDNSQueryEvent
+				}
+				dnsHandler, err = agentdns.NewHandler(opts)
+				if err != nil {
+					return err
+				}
+			}
+			dnsSrv, err := agentdns.New(a.stack, a.config.Me, int(f.Port), f.Proto, dnsHandler)
 			if err != nil {
 				return err
 			}
+			dnsSrvs[f.Proto] = dnsSrv
 		}
 		if !a.config.Loopback.Disable {
 			if err := loopback.GoOther(a.stack, f.IPPortProto); err != nil {
@@ -280,7 +361,13 @@ func (a *Agent) configureDNS() error {
 			}
 		}
 	}
-	if dnsSrv != nil {
+	if len(dnsSrvs) == 0 {
+		logrus.Debug("built-in DNS is disabled")
+	} else {
+		go a.sendDNSStatsRoutine(dnsHandler)
+	}
+	for _, dnsSrv := range dnsSrvs {
+		dnsSrv := dnsSrv
 		go func() {
 			if e := dnsSrv.ActivateAndServe(); e != nil {
 				panic(e)
@@ -290,28 +377,181 @@ func (a *Agent) configureDNS() error {
 	return nil
 }
 
-func (a *Agent) configureHTTP(rv *resolver.Resolver) error {
-	logrus.Debugf("http listen=%q", a.config.HTTP.Listen)
-	l, err := net.Listen("tcp", a.config.HTTP.Listen)
+// publishedPorts returns the published ports of all the virtual hosts, including "me".
+func (a *Agent) publishedPorts() []jsonmsg.IPPortProto {
+	var res []jsonmsg.IPPortProto
+	for _, f := range a.config.Forwards {
+		res = append(res, jsonmsg.IPPortProto{
+			IP:    a.config.Me,
+			Port:  f.ListenPort,
+			Proto: f.Proto,
+		})
+	}
+	for _, port := range []uint16{a.config.HTTP.VIPPort, a.config.SOCKS.VIPPort} {
+		if port != 0 {
+			res = append(res, jsonmsg.IPPortProto{
+				IP:    a.config.Me,
+				Port:  port,
+				Proto: "tcp",
+			})
+		}
+	}
+	return append(res, a.config.Others...)
+}
+
+// publishedUDPPorts returns the UDP ports published by all the virtual hosts, including the built-in DNS.
+func (a *Agent) publishedUDPPorts() []jsonmsg.IPPortProto {
+	var res []jsonmsg.IPPortProto
+	for _, f := range a.publishedPorts() {
+		if f.Proto == "udp" {
+			res = append(res, f)
+		}
+	}
+	for _, f := range a.config.NameServers {
+		if f.Proto == "udp" {
+			res = append(res, f.IPPortProto)
+		}
+	}
+	return res
+}
+
+// listenProxy listens on addr, and also on vipPort of "me" in the netstack when vipPort is non-zero.
+// The listeners are wrapped with the allowlist of allowedClients.
+func (a *Agent) listenProxy(addr string, vipPort uint16, allowedClients []string) ([]net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listeners := []net.Listener{l}
+	if vipPort != 0 {
+		fullAddr := tcpip.FullAddress{
+			Addr: tcpip.Address(a.config.Me.To4()),
+			Port: vipPort,
+		}
+		vl, err := gonet.ListenTCP(a.stack, fullAddr, ipv4.ProtocolNumber)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to listen on %q: %w", fullAddr, err)
+		}
+		listeners = append(listeners, vl)
+	}
+	for i, l := range listeners {
+		al, err := allowlist.NewListener(l, allowedClients)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners[i] = al
+	}
+	return listeners, nil
+}
+
+// newAccessLogger returns nil when the access logs are disabled.
+func (a *Agent) newAccessLogger() (accesslog.Logger, error) {
+	conf := a.config.AccessLog
+	switch conf.Output {
+	case "":
+		return nil, nil
+	case jsonmsg.AccessLogOutputFile:
+		if a.config.StateDir.Disable {
+			return nil, errors.New("access log file requires the state dir")
+		}
+		f, err := statedir.OpenAccessLog(a.config.StateDir.Path)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Debugf("access log file=%q, format=%q", f.Name(), conf.Format)
+		return accesslog.NewWriterLogger(f, conf.Format)
+	case jsonmsg.AccessLogOutputManager:
+		if _, err := accesslog.Format(&accesslog.Entry{}, conf.Format); err != nil {
+			return nil, err
+		}
+		logrus.Debugf("access log output=manager, format=%q", conf.Format)
+		return accesslog.LoggerFunc(func(e *accesslog.Entry) {
+			dat := &jsonmsg.AccessLogEventData{
+				Format: conf.Format,
+				Entry:  *e,
+			}
+			if err := a.sender.SendEvent(jsonmsg.EventTypeAccessLog, dat); err != nil {
+				logrus.WithError(err).Warn("failed to send access log event")
+			}
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown access log output %q", conf.Output)
+	}
+}
+
+func (a *Agent) configureHTTP(rv *resolver.Resolver, pol *policy.Policy, accessLogger accesslog.Logger, upstream *upstreamproxy.Dialer) error {
+	logrus.Debugf("http listen=%q (vipPort=%d, auth=%v, allowedClients=%v)",
+		a.config.HTTP.Listen, a.config.HTTP.VIPPort, a.config.HTTP.Auth != nil, a.config.HTTP.AllowedClients)
+	listeners, err := a.listenProxy(a.config.HTTP.Listen, a.config.HTTP.VIPPort, a.config.HTTP.AllowedClients)
 	if err != nil {
 		return err
 	}
-	httpHandler, err := agenthttp.NewHandler(a.stack, rv)
+	pacHandler := &pac.Handler{
+		HostnameMap:  a.config.HostnameMap,
+		Routes:       a.config.Routes,
+		HTTPListen:   a.config.HTTP.Listen,
+		SOCKSListen:  a.config.SOCKS.Listen,
+		VIP:          a.config.Me,
+		HTTPVIPPort:  a.config.HTTP.VIPPort,
+		SOCKSVIPPort: a.config.SOCKS.VIPPort,
+	}
+	httpHandler, err := agenthttp.NewHandler(a.stack, rv, pol, a.config.Me, pacHandler, upstream)
 	if err != nil {
 		return err
 	}
-	srv := &http.Server{Handler: httpHandler}
-	go srv.Serve(l)
+	// Unauthenticated requests are logged too
+	h := agenthttp.WithAccessLog(agenthttp.WithAuth(httpHandler, a.config.HTTP.Auth), accessLogger)
+	srv := &http.Server{Handler: h}
+	for _, l := range listeners {
+		go srv.Serve(l)
+	}
+	return nil
+}
+
+func (a *Agent) configureSOCKS(rv *resolver.Resolver, pol *policy.Policy, accessLogger accesslog.Logger, upstream *upstreamproxy.Dialer) error {
+	logrus.Debugf("socks listen=%q (vipPort=%d, supports SOCKS4/4a/5, auth=%v, allowedClients=%v, udp=%v, bind=%v)",
+		a.config.SOCKS.Listen, a.config.SOCKS.VIPPort, a.config.SOCKS.Auth != nil, a.config.SOCKS.AllowedClients, a.config.SOCKS.UDP, a.config.SOCKS.Bind)
+	listeners, err := a.listenProxy(a.config.SOCKS.Listen, a.config.SOCKS.VIPPort, a.config.SOCKS.AllowedClients)
+	if err != nil {
+		return err
+	}
+	for i, l := range listeners {
+		srv, err := agentsocks.NewServer(a.stack, rv, pol, a.config.Me, accessLogger, upstream)
+		if err != nil {
+			return err
+		}
+		// SOCKS4 and SOCKS4a are rejected when auth is set
+		l = agentsocks.NewAuthListener(l, a.config.SOCKS.Auth)
+		// The UDP relay listens on the host network, so it is not available on the VIP (listeners[1])
+		if a.config.SOCKS.UDP && i == 0 {
+			l = agentsocks.NewUDPListener(l, a.stack, rv, pol, a.config.Me, accessLogger, upstream, a.publishedUDPPorts())
+		}
+		if a.config.SOCKS.Bind {
+			l = agentsocks.NewBindListener(l, a.stack, rv, pol, a.config.Me, accessLogger)
+		}
+		go srv.Serve(l)
+	}
 	return nil
 }
 
-func (a *Agent) configureSOCKS(rv *resolver.Resolver) error {
-	logrus.Debugf("socks listen=%q (supports SOCKS4/4a/5)", a.config.SOCKS.Listen)
-	l, err := net.Listen("tcp", a.config.SOCKS.Listen)
+func (a *Agent) configureIngress(rv *resolver.Resolver, pol *policy.Policy) error {
+	logrus.Debugf("ingress listen=%q (rules=%d, defaultBackend=%q)",
+		a.config.Ingress.Listen, len(a.config.Ingress.Rules), a.config.Ingress.DefaultBackend)
+	dial := func(host string, port uint16) (net.Conn, error) {
+		if !rv.Interesting(host, port) {
+			return nil, fmt.Errorf("ingress backend %q is not a virtual host", host)
+		}
+		return agenthttp.Dial(a.stack, rv, pol, a.config.Me, host, port)
+	}
+	srv, err := ingress.New(a.config.Ingress.Rules, a.config.Ingress.DefaultBackend, dial)
 	if err != nil {
 		return err
 	}
-	srv, err := agentsocks.NewServer(a.stack, rv)
+	l, err := net.Listen("tcp", a.config.Ingress.Listen)
 	if err != nil {
 		return err
 	}
@@ -335,6 +575,39 @@ func (a *Agent) goGonetForward(me net.IP, f jsonmsg.Forward) error {
 	return nil
 }
 
+// resolverStatsInterval is the interval for sending the statistics of the resolver to the manager.
+const resolverStatsInterval = time.Minute
+
+// sendResolverStatsRoutine sends the statistics of the resolver to the manager, when the caches were used.
+func (a *Agent) sendResolverStatsRoutine(rv *resolver.Resolver) {
+	last := rv.Stats()
+	for range time.Tick(resolverStatsInterval) {
+		st := rv.Stats()
+		if st == last {
+			continue
+		}
+		dat := &jsonmsg.ResolverStatsEventData{
+			Interval:      resolverStatsInterval,
+			LookupCache:   cacheStatsDelta(st.LookupCache, last.LookupCache),
+			DecisionCache: cacheStatsDelta(st.DecisionCache, last.DecisionCache),
+		}
+		last = st
+		if err := a.sender.SendEvent(jsonmsg.EventTypeResolverStats, dat); err != nil {
+			logrus.WithError(err).Warn("failed to send resolver stats event")
+		}
+	}
+}
+
+// cacheStatsDelta returns the counters since last, and the current number of the entries.
+func cacheStatsDelta(st, last resolver.CacheStats) jsonmsg.CacheStats {
+	return jsonmsg.CacheStats{
+		Entries:   st.Entries,
+		Hits:      st.Hits - last.Hits,
+		Misses:    st.Misses - last.Misses,
+		Evictions: st.Evictions - last.Evictions,
+	}
+}
+
 func (a *Agent) sendL3Routine() {
 	for {
 		pkt := a.meEP.ReadContext(context.TODO())
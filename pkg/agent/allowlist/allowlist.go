@@ -0,0 +1,86 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package allowlist provides listeners that refuse the clients outside the allowed CIDRs.
+package allowlist
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NewListener returns a listener that closes the connections from the clients outside cidrs.
+// NewListener returns l as is when cidrs is empty.
+func NewListener(l net.Listener, cidrs []string) (net.Listener, error) {
+	if len(cidrs) == 0 {
+		return l, nil
+	}
+	al := &listener{
+		Listener: l,
+	}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CIDR %q: %w", cidr, err)
+		}
+		al.nets = append(al.nets, ipNet)
+	}
+	return al, nil
+}
+
+type listener struct {
+	net.Listener
+	nets []*net.IPNet
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(c.RemoteAddr()) {
+			return c, nil
+		}
+		logrus.Warnf("refusing a connection to %s from %s (not in the allowed clients)", l.Addr(), c.RemoteAddr())
+		c.Close()
+	}
+}
+
+func (l *listener) allowed(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package allowlist
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAllowed(t *testing.T) {
+	l, err := NewListener(nil, []string{"127.0.0.0/8", "192.168.95.0/24"})
+	assert.NilError(t, err)
+	al := l.(*listener)
+	assert.Equal(t, true, al.allowed(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 42}))
+	assert.Equal(t, true, al.allowed(&net.TCPAddr{IP: net.ParseIP("192.168.95.10"), Port: 42}))
+	assert.Equal(t, false, al.allowed(&net.TCPAddr{IP: net.ParseIP("192.168.96.10"), Port: 42}))
+	assert.Equal(t, false, al.allowed(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 42}))
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	l, err := NewListener(inner, []string{"127.0.0.1/32"})
+	assert.NilError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	c, err := net.Dial("tcp", inner.Addr().String())
+	assert.NilError(t, err)
+	defer c.Close()
+	sc := <-accepted
+	sc.Close()
+
+	_, err = NewListener(inner, []string{"127.0.0.1"})
+	assert.ErrorContains(t, err, "failed to parse CIDR")
+
+	same, err := NewListener(inner, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, inner, same)
+}
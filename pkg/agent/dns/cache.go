@@ -0,0 +1,162 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultCacheSize is the default number of the upstream responses to be cached.
+	DefaultCacheSize = 1024
+
+	// maxCacheTTL caps the TTL of the cached responses.
+	maxCacheTTL = time.Hour
+)
+
+type cacheKey struct {
+	name   string // canonical name
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// cache caches the upstream responses, respecting the TTL.
+// Negative responses (NXDOMAIN and NODATA) are cached for the TTL of the SOA record (RFC 2308).
+type cache struct {
+	mu  sync.Mutex
+	lru *lru.Cache // key: cacheKey, value: *cacheEntry
+	now func() time.Time
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		lru: lru.New(size),
+		now: time.Now,
+	}
+}
+
+func newCacheKey(q dns.Question) cacheKey {
+	return cacheKey{
+		name:   dns.CanonicalName(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}
+}
+
+// get returns a copy of the cached reply for req, with the TTLs decremented.
+// get returns nil on cache miss.
+func (c *cache) get(req *dns.Msg) *dns.Msg {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return nil
+	}
+	k := newCacheKey(req.Question[0])
+	c.mu.Lock()
+	v, ok := c.lru.Get(k)
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	e := v.(*cacheEntry)
+	now := c.now()
+	if !now.Before(e.expires) {
+		c.lru.Remove(k)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	reply := e.msg.Copy()
+	reply.Id = req.Id
+	for _, rrs := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return reply
+}
+
+// put caches reply for req, when reply is cacheable.
+func (c *cache) put(req, reply *dns.Msg) {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 || reply.Truncated {
+		return
+	}
+	ttl, ok := cacheTTL(reply)
+	if !ok || ttl <= 0 {
+		return
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+	now := c.now()
+	e := &cacheEntry{
+		msg:     reply.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	c.mu.Lock()
+	c.lru.Add(newCacheKey(req.Question[0]), e)
+	c.mu.Unlock()
+}
+
+// cacheTTL returns the TTL for caching reply.
+// cacheTTL returns false if reply must not be cached.
+func cacheTTL(reply *dns.Msg) (time.Duration, bool) {
+	switch reply.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return 0, false
+	}
+	if reply.Rcode == dns.RcodeSuccess && len(reply.Answer) > 0 {
+		min := ^uint32(0)
+		for _, rr := range reply.Answer {
+			if ttl := rr.Header().Ttl; ttl < min {
+				min = ttl
+			}
+		}
+		return time.Duration(min) * time.Second, true
+	}
+	// Negative response: NXDOMAIN or NODATA
+	for _, rr := range reply.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second, true
+		}
+	}
+	// Negative responses without SOA are not cached (RFC 2308 Section 5)
+	return 0, false
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := newCache(2)
+	c.now = func() time.Time { return now }
+
+	var req dns.Msg
+	req.SetQuestion("example.com.", dns.TypeA)
+	var reply dns.Msg
+	reply.SetReply(&req)
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	c.put(&req, &reply)
+
+	now = now.Add(10 * time.Second)
+	var req2 dns.Msg
+	req2.SetQuestion("EXAMPLE.com.", dns.TypeA)
+	cached := c.get(&req2)
+	assert.Assert(t, cached != nil)
+	assert.Equal(t, req2.Id, cached.Id)
+	assert.Equal(t, uint32(50), cached.Answer[0].Header().Ttl)
+
+	now = now.Add(60 * time.Second)
+	assert.Assert(t, c.get(&req2) == nil)
+}
+
+func TestCacheNegative(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := newCache(2)
+	c.now = func() time.Time { return now }
+
+	var req dns.Msg
+	req.SetQuestion("nonexistent.example.com.", dns.TypeA)
+	var reply dns.Msg
+	reply.SetRcode(&req, dns.RcodeNameError)
+	c.put(&req, &reply)
+	assert.Assert(t, c.get(&req) == nil, "negative responses without SOA must not be cached")
+
+	reply.Ns = append(reply.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Minttl: 30,
+	})
+	c.put(&req, &reply)
+	cached := c.get(&req)
+	assert.Assert(t, cached != nil)
+	assert.Equal(t, dns.RcodeNameError, cached.Rcode)
+
+	now = now.Add(31 * time.Second)
+	assert.Assert(t, c.get(&req) == nil)
+
+	var servfail dns.Msg
+	servfail.SetRcode(&req, dns.RcodeServerFailure)
+	c.put(&req, &servfail)
+	assert.Assert(t, c.get(&req) == nil, "SERVFAIL must not be cached")
+}
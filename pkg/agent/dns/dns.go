@@ -24,9 +24,13 @@ import (
 	"net"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/norouter/norouter/pkg/agent/hostnamemap"
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
 
 	"github.com/sirupsen/logrus"
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -35,24 +39,37 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
-func New(st *stack.Stack, vip net.IP, tcpPort int, hostnameMap map[string]net.IP) (*dns.Server, error) {
-	h, err := NewHandler(hostnameMap)
-	if err != nil {
-		return nil, err
-	}
+// New creates a DNS server on the VIP in the netstack.
+// proto is either "tcp" or "udp".
+func New(st *stack.Stack, vip net.IP, port int, proto string, h dns.Handler) (*dns.Server, error) {
 	fullAddr := tcpip.FullAddress{
 		Addr: tcpip.Address(vip),
-		Port: uint16(tcpPort),
-	}
-	l, err := gonet.ListenTCP(st, fullAddr, ipv4.ProtocolNumber)
-	if err != nil {
-		return nil, fmt.Errorf("failed to listen on %q: %w", fullAddr, err)
+		Port: uint16(port),
 	}
-	srv := &dns.Server{
-		Handler:  h,
-		Listener: l,
+	switch proto {
+	case "tcp":
+		l, err := gonet.ListenTCP(st, fullAddr, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %q: %w", fullAddr, err)
+		}
+		srv := &dns.Server{
+			Handler:  h,
+			Listener: l,
+		}
+		return srv, nil
+	case "udp":
+		pc, err := gonet.DialUDP(st, &fullAddr, nil, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %q: %w", fullAddr, err)
+		}
+		srv := &dns.Server{
+			Handler:    h,
+			PacketConn: pc,
+		}
+		return srv, nil
+	default:
+		return nil, fmt.Errorf("expected \"tcp\" or \"udp\", got %q", proto)
 	}
-	return srv, nil
 }
 
 func NewClientConfig() (*dns.ClientConfig, error) {
@@ -102,91 +119,465 @@ func NewStaticClientConfig(ips []net.IP) (*dns.ClientConfig, error) {
 	return dns.ClientConfigFromReader(r)
 }
 
-func NewHandler(hostnameMap map[string]net.IP) (dns.Handler, error) {
-	cc, err := NewClientConfig()
-	if err != nil {
-		fallbackIPs := []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1")}
-		logrus.WithError(err).Warnf("failed to detect system DNS, falling back to %v", fallbackIPs)
-		cc, err = NewStaticClientConfig(fallbackIPs)
+// HandlerOptions is the options for NewHandler.
+type HandlerOptions struct {
+	// HostnameMap maps the virtual hostnames to the virtual IPs.
+	HostnameMap map[string]net.IP
+	// Ports are the published ports of the virtual hosts, used for answering SRV queries
+	// such as "_http._tcp.host1".
+	Ports []jsonmsg.IPPortProto
+	// Records are the custom records declared in the manifest.
+	Records []jsonmsg.DNSRecord
+	// Domain is the virtual zone suffix, e.g. "mesh.internal".
+	// The handler is authoritative for the zone.
+	Domain string
+	// Upstreams are the "IP:port" addresses of the upstream servers.
+	// When Upstreams is empty, the system DNS is used.
+	Upstreams []string
+	// FallbackUpstreams are used when the system DNS cannot be detected.
+	// When FallbackUpstreams is empty, DefaultFallbackUpstreams is used.
+	FallbackUpstreams []string
+	// DisableFallback disables FallbackUpstreams.
+	DisableFallback bool
+	// CacheSize is the number of the upstream responses to be cached.
+	// Zero disables the cache.
+	CacheSize int
+	// Forward optionally forwards req to other hosts, typically to the bastion
+	// that the queried name is routed via.
+	// Forward returns nil when req is not forwarded.
+	Forward func(req *dns.Msg) (*dns.Msg, error)
+	// QueryLogger is optionally called for every query, after sending the reply.
+	QueryLogger func(*QueryLog)
+}
+
+// DefaultFallbackUpstreams is the default value of HandlerOptions.FallbackUpstreams.
+var DefaultFallbackUpstreams = []string{"8.8.8.8:53", "1.1.1.1:53"}
+
+// NewHandler creates a DNS handler.
+func NewHandler(opts HandlerOptions) (*Handler, error) {
+	clients := []*dns.Client{
+		&dns.Client{}, // UDP
+		&dns.Client{Net: "tcp"},
+	}
+	names := hostnamemap.New(opts.HostnameMap)
+	canonMap := names.Exact()
+	ptrMap := make(map[string][]string)
+	for canon, ip := range canonMap {
+		rev, err := dns.ReverseAddr(ip.String())
 		if err != nil {
 			return nil, err
 		}
+		ptrMap[rev] = append(ptrMap[rev], canon)
 	}
-	clients := []*dns.Client{
-		&dns.Client{}, // UDP
-		&dns.Client{Net: "tcp"},
+	for _, names := range ptrMap {
+		sort.Strings(names)
 	}
-	canonMap := make(map[string]net.IP)
-	for vague, ip := range hostnameMap {
-		canon := dns.CanonicalName(vague)
-		canonMap[canon] = ip
+	portMap := make(map[string][]jsonmsg.IPPortProto)
+	for _, p := range opts.Ports {
+		k := p.IP.String()
+		portMap[k] = append(portMap[k], p)
+	}
+	recordMap := make(map[string][]jsonmsg.DNSRecord)
+	for _, rec := range opts.Records {
+		canon := dns.CanonicalName(rec.Name)
+		recordMap[canon] = append(recordMap[canon], rec)
 	}
 	h := &Handler{
-		clientConfig: cc,
-		clients:      clients,
-		canonMap:     canonMap,
+		upstreams: upstreamAddrs(opts),
+		clients:   clients,
+		names:     names,
+		canonMap:  canonMap,
+		ptrMap:    ptrMap,
+		portMap:   portMap,
+		recordMap: recordMap,
+		forward:   opts.Forward,
+		logger:    opts.QueryLogger,
+	}
+	if opts.Domain != "" {
+		h.domain = dns.CanonicalName(opts.Domain)
+	}
+	if opts.CacheSize > 0 {
+		h.cache = newCache(opts.CacheSize)
 	}
 	return h, nil
 }
 
+// upstreamAddrs returns the "IP:port" addresses of the upstream servers.
+func upstreamAddrs(opts HandlerOptions) []string {
+	if len(opts.Upstreams) != 0 {
+		return opts.Upstreams
+	}
+	cc, err := NewClientConfig()
+	if err == nil && len(cc.Servers) == 0 {
+		err = errors.New("no DNS found")
+	}
+	if err == nil {
+		var res []string
+		for _, srv := range cc.Servers {
+			res = append(res, net.JoinHostPort(srv, cc.Port))
+		}
+		return res
+	}
+	if opts.DisableFallback {
+		logrus.WithError(err).Warn("failed to detect system DNS, and the fallback is disabled; only the virtual hosts can be resolved")
+		return nil
+	}
+	fallback := opts.FallbackUpstreams
+	if len(fallback) == 0 {
+		fallback = DefaultFallbackUpstreams
+	}
+	logrus.WithError(err).Warnf("failed to detect system DNS, falling back to %v", fallback)
+	return fallback
+}
+
+// Handler answers queries about the virtual hosts, and forwards other queries to the upstream servers.
+//
+// Wildcard names such as "*.host1" are answered with the A records of the virtual IP.
+//
+// Every virtual hostname and the domain are treated as authoritative zones, so the handler
+// returns NXDOMAIN for unknown names under a virtual hostname (e.g. "foo.host1"), and
+// returns NODATA for unsupported types of a virtual hostname (e.g. AAAA of "host1").
 type Handler struct {
-	clientConfig *dns.ClientConfig
-	clients      []*dns.Client
-	canonMap     map[string]net.IP
+	upstreams []string // "IP:port"
+	clients   []*dns.Client
+	cache     *cache // nil when disabled
+	names     *hostnamemap.Map
+	canonMap  map[string]net.IP                // non-wildcard names
+	ptrMap    map[string][]string              // key: reverse name, e.g. "101.42.0.127.in-addr.arpa."
+	portMap   map[string][]jsonmsg.IPPortProto // key: IP string
+	recordMap map[string][]jsonmsg.DNSRecord   // key: canonical name
+	forward   func(req *dns.Msg) (*dns.Msg, error)
+	domain    string // canonical name, e.g. "mesh.internal."
+	logger    func(*QueryLog)
+	stats     stats
 }
 
-func (h *Handler) handleQuery(w dns.ResponseWriter, req *dns.Msg) {
+// maxCNAMEHops is the maximum number of the CNAME records to be chased.
+const maxCNAMEHops = 8
+
+// answer is the answer to a question about the virtual hosts.
+type answer struct {
+	rcode  int
+	answer []dns.RR
+	extra  []dns.RR
+	// zone is used for the SOA record of negative answers
+	zone string
+	// upstream is set when a CNAME target was resolved by the upstream servers
+	upstream string
+}
+
+// handleQuery returns the reply and the upstream label for QueryLog.
+func (h *Handler) handleQuery(req *dns.Msg) (*dns.Msg, string) {
 	var (
-		reply   dns.Msg
-		handled bool
+		reply    dns.Msg
+		handled  bool
+		upstream = UpstreamLocal
 	)
 	reply.SetReply(req)
 	for _, q := range reply.Question {
-		canon := dns.CanonicalName(q.Name)
-		switch q.Qtype {
-		case dns.TypeA:
-			if ip, ok := h.canonMap[canon]; ok {
-				a := &dns.A{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeA,
-						Class:  dns.ClassINET,
-					},
-					A: ip,
-				}
-				reply.Answer = append(reply.Answer, a)
-				handled = true
-			}
+		a := h.answerQuestion(q, 0)
+		if a == nil {
+			continue
+		}
+		handled = true
+		if a.upstream != "" {
+			upstream = a.upstream
+		}
+		reply.Authoritative = true
+		if a.rcode != dns.RcodeSuccess {
+			reply.Rcode = a.rcode
+		}
+		reply.Answer = append(reply.Answer, a.answer...)
+		reply.Extra = append(reply.Extra, a.extra...)
+		if len(a.answer) == 0 {
+			reply.Ns = append(reply.Ns, newSOA(a.zone))
 		}
 	}
 	if handled {
-		w.WriteMsg(&reply)
-		return
+		return &reply, upstream
 	}
-	h.handleDefault(w, req)
+	return h.handleDefault(req)
 }
 
-func (h *Handler) handleDefault(w dns.ResponseWriter, req *dns.Msg) {
+// answerQuestion returns nil if q is neither about the virtual hosts nor about the custom records.
+// hops is the number of the CNAME records chased so far.
+func (h *Handler) answerQuestion(q dns.Question, hops int) *answer {
+	canon := dns.CanonicalName(q.Name)
+	if names, ok := h.ptrMap[canon]; ok {
+		a := &answer{zone: canon}
+		if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+			for _, name := range names {
+				a.answer = append(a.answer, &dns.PTR{
+					Hdr: newHdr(q.Name, dns.TypePTR),
+					Ptr: name,
+				})
+			}
+		}
+		return a
+	}
+	if ip, ok := h.canonMap[canon]; ok {
+		a := &answer{zone: canon}
+		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+			a.answer = append(a.answer, &dns.A{
+				Hdr: newHdr(q.Name, dns.TypeA),
+				A:   ip,
+			})
+		}
+		return a
+	}
+	if recs, ok := h.recordMap[canon]; ok {
+		return h.answerRecords(q, canon, recs, hops)
+	}
+	if canon == h.domain {
+		a := &answer{zone: canon}
+		if q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeANY {
+			a.answer = append(a.answer, newSOA(canon))
+		}
+		return a
+	}
+	if srvs, target, ok := h.srv(canon); ok {
+		a := &answer{zone: target}
+		if q.Qtype == dns.TypeSRV || q.Qtype == dns.TypeANY {
+			for _, srv := range srvs {
+				srv.Hdr = newHdr(q.Name, dns.TypeSRV)
+				a.answer = append(a.answer, srv)
+			}
+			a.extra = append(a.extra, &dns.A{
+				Hdr: newHdr(target, dns.TypeA),
+				A:   h.canonMap[target],
+			})
+		}
+		return a
+	}
+	if ip, ok := h.names.LookupWildcard(canon); ok {
+		a := &answer{zone: canon}
+		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+			a.answer = append(a.answer, &dns.A{
+				Hdr: newHdr(q.Name, dns.TypeA),
+				A:   ip,
+			})
+		}
+		return a
+	}
+	zone := h.zoneOf(canon)
+	if zone == "" {
+		return nil
+	}
+	return &answer{rcode: dns.RcodeNameError, zone: zone}
+}
+
+func (h *Handler) answerRecords(q dns.Question, canon string, recs []jsonmsg.DNSRecord, hops int) *answer {
+	a := &answer{zone: canon}
+	for _, rec := range recs {
+		switch rec.Type {
+		case jsonmsg.DNSRecordTypeA:
+			if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+				a.answer = append(a.answer, &dns.A{
+					Hdr: newHdr(q.Name, dns.TypeA),
+					A:   net.ParseIP(rec.Value),
+				})
+			}
+		case jsonmsg.DNSRecordTypeTXT:
+			if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+				a.answer = append(a.answer, &dns.TXT{
+					Hdr: newHdr(q.Name, dns.TypeTXT),
+					Txt: splitTXT(rec.Value),
+				})
+			}
+		case jsonmsg.DNSRecordTypeCNAME:
+			target := dns.CanonicalName(rec.Value)
+			a.answer = append(a.answer, &dns.CNAME{
+				Hdr:    newHdr(q.Name, dns.TypeCNAME),
+				Target: target,
+			})
+			if q.Qtype == dns.TypeCNAME {
+				return a
+			}
+			if hops >= maxCNAMEHops {
+				logrus.Warnf("too many CNAME hops for %q", q.Name)
+				a.rcode = dns.RcodeServerFailure
+				return a
+			}
+			targetQ := dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}
+			if chased := h.answerQuestion(targetQ, hops+1); chased != nil {
+				a.rcode = chased.rcode
+				a.answer = append(a.answer, chased.answer...)
+				a.extra = append(a.extra, chased.extra...)
+				a.upstream = chased.upstream
+			} else if reply, upstream, err := h.exchange(newQuery(targetQ)); err == nil {
+				a.rcode = reply.Rcode
+				a.answer = append(a.answer, reply.Answer...)
+				a.upstream = upstream
+			}
+			return a
+		}
+	}
+	return a
+}
+
+// splitTXT splits s into 255-byte strings.
+func splitTXT(s string) []string {
+	var res []string
+	for len(s) > 255 {
+		res = append(res, s[:255])
+		s = s[255:]
+	}
+	return append(res, s)
+}
+
+func newQuery(q dns.Question) *dns.Msg {
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Opcode:           dns.OpcodeQuery,
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{q},
+	}
+}
+
+// zoneOf returns the domain or the virtual hostname without dot symbols (e.g. "host1.") that contains canon.
+// zoneOf returns an empty string when canon is not in any virtual zone.
+// Dotted aliases such as "nginx.example.com" are not zones, as the real names under them
+// (e.g. "registry.nginx.example.com") have to be resolved by the upstream servers.
+func (h *Handler) zoneOf(canon string) string {
+	if h.domain != "" && dns.IsSubDomain(h.domain, canon) {
+		return h.domain
+	}
+	labels := dns.SplitDomainName(canon)
+	if len(labels) == 0 {
+		return ""
+	}
+	zone := dns.Fqdn(labels[len(labels)-1])
+	if _, ok := h.canonMap[zone]; ok {
+		return zone
+	}
+	return ""
+}
+
+// srv returns the SRV records for canon such as "_http._tcp.host1.".
+// The records contain all the published (listen) ports of the virtual host for the protocol,
+// regardless of the service name, as the ports are not named in the manifest.
+func (h *Handler) srv(canon string) ([]*dns.SRV, string, bool) {
+	labels := dns.SplitDomainName(canon)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return nil, "", false
+	}
+	proto := labels[1][1:]
+	target := dns.Fqdn(strings.Join(labels[2:], "."))
+	ip, ok := h.canonMap[target]
+	if !ok {
+		return nil, "", false
+	}
+	var srvs []*dns.SRV
+	for _, p := range h.portMap[ip.String()] {
+		if p.Proto == proto {
+			srvs = append(srvs, &dns.SRV{
+				Port:   p.Port,
+				Target: target,
+			})
+		}
+	}
+	return srvs, target, len(srvs) != 0
+}
+
+// newHdr returns a header with zero TTL.
+// The records are not expected to be cached, as the manifest may change across restarts.
+func newHdr(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+	}
+}
+
+func newSOA(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     newHdr(zone, dns.TypeSOA),
+		Ns:      zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  0,
+	}
+}
+
+// handleDefault returns the reply and the upstream label for QueryLog.
+func (h *Handler) handleDefault(req *dns.Msg) (*dns.Msg, string) {
+	reply, upstream, err := h.exchange(req)
+	if err == nil {
+		return reply, upstream
+	}
+	reply = new(dns.Msg)
+	reply.SetRcode(req, dns.RcodeServerFailure)
+	return reply, upstream
+}
+
+// exchange forwards req to other hosts, or sends req to the upstream servers, or returns the cached reply.
+// exchange also returns the upstream label for QueryLog.
+func (h *Handler) exchange(req *dns.Msg) (*dns.Msg, string, error) {
+	if h.forward != nil {
+		reply, err := h.forward(req)
+		if err != nil {
+			// Do not fall back to the upstream servers, as the name is expected to be resolved by other hosts
+			logrus.WithError(err).Warnf("failed to forward %v", req.Question)
+			return nil, UpstreamForwarded, err
+		}
+		if reply != nil {
+			return reply, UpstreamForwarded, nil
+		}
+	}
+	if h.cache != nil {
+		if reply := h.cache.get(req); reply != nil {
+			return reply, UpstreamCache, nil
+		}
+	}
+	var (
+		lastErr  error
+		lastAddr string
+	)
 	for _, client := range h.clients {
-		for _, srv := range h.clientConfig.Servers {
-			addr := fmt.Sprintf("%s:%s", srv, h.clientConfig.Port)
+		for _, addr := range h.upstreams {
 			reply, _, err := client.Exchange(req, addr)
 			if err == nil {
-				w.WriteMsg(reply)
-				return
+				if h.cache != nil {
+					h.cache.put(req, reply)
+				}
+				return reply, addr, nil
 			}
+			lastErr, lastAddr = err, addr
 		}
 	}
-	var reply dns.Msg
-	reply.SetReply(req)
-	w.WriteMsg(&reply)
+	if lastErr == nil {
+		lastErr = errors.New("no upstream server")
+	}
+	return nil, lastAddr, lastErr
 }
 
 func (h *Handler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
+	var (
+		reply    *dns.Msg
+		upstream string
+	)
 	switch req.Opcode {
 	case dns.OpcodeQuery:
-		h.handleQuery(w, req)
+		reply, upstream = h.handleQuery(req)
 	default:
-		h.handleDefault(w, req)
+		reply, upstream = h.handleDefault(req)
+	}
+	if err := w.WriteMsg(reply); err != nil {
+		logrus.WithError(err).Debugf("failed to write the reply for %v", req.Question)
 	}
+	h.stats.record(reply.Rcode)
+	if h.logger != nil {
+		h.logger(newQueryLog(w.RemoteAddr(), req, reply, upstream, time.Since(start)))
+	}
+}
+
+// Stats returns the statistics since the handler was created.
+func (h *Handler) Stats() Stats {
+	return h.stats.get()
 }
@@ -0,0 +1,274 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"gotest.tools/v3/assert"
+)
+
+type testResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.42.102"), Port: 42000}
+}
+
+func testQuery(t *testing.T, h dns.Handler, name string, qtype uint16) *dns.Msg {
+	var req dns.Msg
+	req.SetQuestion(name, qtype)
+	w := &testResponseWriter{}
+	h.ServeDNS(w, &req)
+	assert.Assert(t, w.msg != nil)
+	return w.msg
+}
+
+func TestHandler(t *testing.T) {
+	hostnameMap := map[string]net.IP{
+		"host1":             net.ParseIP("127.0.42.101"),
+		"nginx.example.com": net.ParseIP("127.0.42.101"),
+		"host2":             net.ParseIP("127.0.42.102"),
+	}
+	ports := []jsonmsg.IPPortProto{
+		{IP: net.ParseIP("127.0.42.101"), Port: 80, Proto: "tcp"},
+		{IP: net.ParseIP("127.0.42.102"), Port: 8080, Proto: "tcp"},
+	}
+	h, err := NewHandler(HandlerOptions{HostnameMap: hostnameMap, Ports: ports})
+	assert.NilError(t, err)
+
+	m := testQuery(t, h, "host1.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, true, m.Authoritative)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.Equal(t, "127.0.42.101", m.Answer[0].(*dns.A).A.String())
+
+	m = testQuery(t, h, "host1.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 0, len(m.Answer))
+	assert.Equal(t, 1, len(m.Ns))
+	assert.Equal(t, dns.TypeSOA, m.Ns[0].Header().Rrtype)
+
+	m = testQuery(t, h, "101.42.0.127.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 2, len(m.Answer))
+	assert.Equal(t, "host1.", m.Answer[0].(*dns.PTR).Ptr)
+	assert.Equal(t, "nginx.example.com.", m.Answer[1].(*dns.PTR).Ptr)
+
+	m = testQuery(t, h, "_http._tcp.host1.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.Equal(t, uint16(80), m.Answer[0].(*dns.SRV).Port)
+	assert.Equal(t, "host1.", m.Answer[0].(*dns.SRV).Target)
+
+	m = testQuery(t, h, "_http._tcp.host2.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.Equal(t, uint16(8080), m.Answer[0].(*dns.SRV).Port)
+	assert.Equal(t, "host2.", m.Answer[0].(*dns.SRV).Target)
+
+	m = testQuery(t, h, "_http._udp.host2.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+
+	m = testQuery(t, h, "foo.host1.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	assert.Equal(t, true, m.Authoritative)
+	assert.Equal(t, 1, len(m.Ns))
+	assert.Equal(t, "host1.", m.Ns[0].Header().Name)
+}
+
+func TestHandlerRecords(t *testing.T) {
+	hostnameMap := map[string]net.IP{
+		"host1": net.ParseIP("127.0.42.101"),
+	}
+	records := []jsonmsg.DNSRecord{
+		{Name: "api.internal", Type: "CNAME", Value: "host1"},
+		{Name: "legacy-db", Type: "A", Value: "192.168.95.100"},
+		{Name: "legacy-db", Type: "TXT", Value: "foo=bar"},
+		{Name: "loop1", Type: "CNAME", Value: "loop2"},
+		{Name: "loop2", Type: "CNAME", Value: "loop1"},
+	}
+	h, err := NewHandler(HandlerOptions{HostnameMap: hostnameMap, Records: records})
+	assert.NilError(t, err)
+
+	m := testQuery(t, h, "api.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 2, len(m.Answer))
+	assert.Equal(t, "host1.", m.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "127.0.42.101", m.Answer[1].(*dns.A).A.String())
+
+	m = testQuery(t, h, "legacy-db.", dns.TypeA)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.Equal(t, "192.168.95.100", m.Answer[0].(*dns.A).A.String())
+
+	m = testQuery(t, h, "legacy-db.", dns.TypeTXT)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.DeepEqual(t, []string{"foo=bar"}, m.Answer[0].(*dns.TXT).Txt)
+
+	m = testQuery(t, h, "legacy-db.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 0, len(m.Answer))
+
+	m = testQuery(t, h, "loop1.", dns.TypeA)
+	assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+}
+
+func TestHandlerForward(t *testing.T) {
+	forward := func(req *dns.Msg) (*dns.Msg, error) {
+		if req.Question[0].Name != "db.corp.internal." {
+			return nil, nil
+		}
+		var reply dns.Msg
+		reply.SetReply(req)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.ParseIP("10.0.0.42"),
+		})
+		return &reply, nil
+	}
+	h, err := NewHandler(HandlerOptions{Upstreams: []string{"127.0.0.1:0"}, Forward: forward})
+	assert.NilError(t, err)
+
+	m := testQuery(t, h, "db.corp.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.Equal(t, "10.0.0.42", m.Answer[0].(*dns.A).A.String())
+}
+
+func TestHandlerDottedAlias(t *testing.T) {
+	hostnameMap := map[string]net.IP{
+		"host1":           net.ParseIP("127.0.42.101"),
+		"gitlab.corp.com": net.ParseIP("127.0.42.101"),
+	}
+	var forwarded []string
+	forward := func(req *dns.Msg) (*dns.Msg, error) {
+		forwarded = append(forwarded, req.Question[0].Name)
+		var reply dns.Msg
+		reply.SetReply(req)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.ParseIP("10.0.0.42"),
+		})
+		return &reply, nil
+	}
+	h, err := NewHandler(HandlerOptions{HostnameMap: hostnameMap, Upstreams: []string{"127.0.0.1:0"}, Forward: forward})
+	assert.NilError(t, err)
+
+	m := testQuery(t, h, "gitlab.corp.com.", dns.TypeA)
+	assert.Equal(t, "127.0.42.101", m.Answer[0].(*dns.A).A.String())
+
+	m = testQuery(t, h, "registry.gitlab.corp.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.Equal(t, "10.0.0.42", m.Answer[0].(*dns.A).A.String())
+	assert.DeepEqual(t, []string{"registry.gitlab.corp.com."}, forwarded)
+
+	m = testQuery(t, h, "foo.host1.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+}
+
+func TestHandlerDomain(t *testing.T) {
+	hostnameMap := map[string]net.IP{
+		"host1":               net.ParseIP("127.0.42.101"),
+		"host1.mesh.internal": net.ParseIP("127.0.42.101"),
+	}
+	h, err := NewHandler(HandlerOptions{HostnameMap: hostnameMap, Domain: "mesh.internal", Upstreams: []string{"127.0.0.1:0"}})
+	assert.NilError(t, err)
+
+	m := testQuery(t, h, "host1.mesh.internal.", dns.TypeA)
+	assert.Equal(t, 1, len(m.Answer))
+
+	m = testQuery(t, h, "mesh.internal.", dns.TypeSOA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.Equal(t, dns.TypeSOA, m.Answer[0].Header().Rrtype)
+
+	m = testQuery(t, h, "host2.mesh.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	assert.Equal(t, true, m.Authoritative)
+	assert.Equal(t, "mesh.internal.", m.Ns[0].Header().Name)
+}
+
+func TestHandlerWildcard(t *testing.T) {
+	hostnameMap := map[string]net.IP{
+		"host1":   net.ParseIP("127.0.42.101"),
+		"*.host1": net.ParseIP("127.0.42.101"),
+	}
+	ports := []jsonmsg.IPPortProto{
+		{IP: net.ParseIP("127.0.42.101"), Port: 80, Proto: "tcp"},
+	}
+	h, err := NewHandler(HandlerOptions{HostnameMap: hostnameMap, Ports: ports, Upstreams: []string{"127.0.0.1:0"}})
+	assert.NilError(t, err)
+
+	m := testQuery(t, h, "foo.app.host1.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.Equal(t, "127.0.42.101", m.Answer[0].(*dns.A).A.String())
+
+	m = testQuery(t, h, "_http._tcp.host1.", dns.TypeSRV)
+	assert.Equal(t, 1, len(m.Answer))
+
+	m = testQuery(t, h, "101.42.0.127.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, 1, len(m.Answer))
+	assert.Equal(t, "host1.", m.Answer[0].(*dns.PTR).Ptr)
+}
+
+func TestHandlerStats(t *testing.T) {
+	hostnameMap := map[string]net.IP{
+		"host1": net.ParseIP("127.0.42.101"),
+	}
+	var logs []*QueryLog
+	h, err := NewHandler(HandlerOptions{
+		HostnameMap: hostnameMap,
+		QueryLogger: func(l *QueryLog) {
+			logs = append(logs, l)
+		},
+	})
+	assert.NilError(t, err)
+
+	testQuery(t, h, "host1.", dns.TypeA)
+	testQuery(t, h, "host1.", dns.TypeAAAA)
+	testQuery(t, h, "foo.host1.", dns.TypeA)
+
+	st := h.Stats()
+	assert.Equal(t, uint64(3), st.Queries)
+	assert.DeepEqual(t, map[string]uint64{"NOERROR": 2, "NXDOMAIN": 1}, st.Rcodes)
+
+	assert.Equal(t, 3, len(logs))
+	assert.Equal(t, "127.0.42.102:42000", logs[0].Client.String())
+	assert.Equal(t, "host1.", logs[0].Name)
+	assert.Equal(t, "A", logs[0].Type)
+	assert.Equal(t, "NOERROR", logs[0].Rcode)
+	assert.Equal(t, UpstreamLocal, logs[0].Upstream)
+	assert.Equal(t, 1, len(logs[0].Answer))
+	assert.Equal(t, "NXDOMAIN", logs[2].Rcode)
+
+	testQuery(t, h, "host1.", dns.TypeA)
+	delta := h.Stats().Sub(st)
+	assert.Equal(t, uint64(1), delta.Queries)
+	assert.DeepEqual(t, map[string]uint64{"NOERROR": 1}, delta.Rcodes)
+}
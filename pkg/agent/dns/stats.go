@@ -0,0 +1,119 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream labels of QueryLog, for the replies that were not sent by the upstream servers.
+const (
+	UpstreamLocal     = "local"     // answered by the handler itself
+	UpstreamCache     = "cache"     // answered from the cache
+	UpstreamForwarded = "forwarded" // answered by other hosts
+)
+
+// QueryLog is the log of a query.
+type QueryLog struct {
+	Client   net.Addr
+	Name     string
+	Type     string   // e.g. "A"
+	Rcode    string   // e.g. "NOERROR"
+	Answer   []string // e.g. "host1.\t0\tIN\tA\t127.0.42.101"
+	Upstream string   // "IP:port", or one of UpstreamLocal, UpstreamCache, and UpstreamForwarded
+	Latency  time.Duration
+}
+
+func newQueryLog(client net.Addr, req, reply *dns.Msg, upstream string, latency time.Duration) *QueryLog {
+	l := &QueryLog{
+		Client:   client,
+		Rcode:    rcodeString(reply.Rcode),
+		Upstream: upstream,
+		Latency:  latency,
+	}
+	if len(req.Question) != 0 {
+		q := req.Question[0]
+		l.Name = q.Name
+		l.Type = dns.TypeToString[q.Qtype]
+	}
+	for _, rr := range reply.Answer {
+		l.Answer = append(l.Answer, rr.String())
+	}
+	return l
+}
+
+// Stats is the statistics of a handler.
+type Stats struct {
+	Queries uint64
+	// Rcodes is the number of the replies per response code, e.g. "NOERROR", "NXDOMAIN", and "SERVFAIL".
+	Rcodes map[string]uint64
+}
+
+// Sub returns the difference between st and old.
+func (st Stats) Sub(old Stats) Stats {
+	res := Stats{
+		Queries: st.Queries - old.Queries,
+		Rcodes:  make(map[string]uint64),
+	}
+	for k, v := range st.Rcodes {
+		if d := v - old.Rcodes[k]; d != 0 {
+			res.Rcodes[k] = d
+		}
+	}
+	return res
+}
+
+type stats struct {
+	mu      sync.Mutex
+	queries uint64
+	rcodes  map[int]uint64
+}
+
+func (s *stats) record(rcode int) {
+	s.mu.Lock()
+	s.queries++
+	if s.rcodes == nil {
+		s.rcodes = make(map[int]uint64)
+	}
+	s.rcodes[rcode]++
+	s.mu.Unlock()
+}
+
+func (s *stats) get() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Stats{
+		Queries: s.queries,
+		Rcodes:  make(map[string]uint64),
+	}
+	for rcode, n := range s.rcodes {
+		st.Rcodes[rcodeString(rcode)] = n
+	}
+	return st
+}
+
+func rcodeString(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return strconv.Itoa(rcode)
+}
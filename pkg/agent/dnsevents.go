@@ -0,0 +1,68 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package agent
+
+import (
+	"time"
+
+	agentdns "github.com/norouter/norouter/pkg/agent/dns"
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dnsStatsInterval is the interval for sending the statistics of the built-in DNS to the manager.
+const dnsStatsInterval = time.Minute
+
+// sendDNSQueryEvent sends the query log to the manager.
+func (a *Agent) sendDNSQueryEvent(l *agentdns.QueryLog) {
+	dat := &jsonmsg.DNSQueryEventData{
+		Name:     l.Name,
+		Type:     l.Type,
+		Rcode:    l.Rcode,
+		Answer:   l.Answer,
+		Upstream: l.Upstream,
+		Latency:  l.Latency,
+	}
+	if l.Client != nil {
+		dat.Client = l.Client.String()
+	}
+	if err := a.sender.SendEvent(jsonmsg.EventTypeDNSQuery, dat); err != nil {
+		logrus.WithError(err).Warn("failed to send DNS query event")
+	}
+}
+
+// sendDNSStatsRoutine sends the statistics of the built-in DNS to the manager, when the DNS received queries.
+func (a *Agent) sendDNSStatsRoutine(h *agentdns.Handler) {
+	last := h.Stats()
+	for range time.Tick(dnsStatsInterval) {
+		st := h.Stats()
+		delta := st.Sub(last)
+		last = st
+		if delta.Queries == 0 {
+			continue
+		}
+		dat := &jsonmsg.DNSStatsEventData{
+			Interval: dnsStatsInterval,
+			Queries:  delta.Queries,
+			Rcodes:   delta.Rcodes,
+		}
+		if err := a.sender.SendEvent(jsonmsg.EventTypeDNSStats, dat); err != nil {
+			logrus.WithError(err).Warn("failed to send DNS stats event")
+		}
+	}
+}
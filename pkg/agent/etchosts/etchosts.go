@@ -28,6 +28,7 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/norouter/norouter/pkg/agent/hostnamemap"
 	"github.com/sirupsen/logrus"
 )
 
@@ -119,6 +120,10 @@ func populate(hostnameMap map[string]net.IP, systemEtcHosts io.Reader) []byte {
 	}
 	fmt.Fprintf(&b, "# %s\n", MarkerBegin)
 	for name, ip := range hostnameMap {
+		if hostnamemap.IsWildcard(name) {
+			logrus.Debugf("etchosts: ignoring %q (wildcard)", name)
+			continue
+		}
 		fmt.Fprintf(&b, "%s %s\n", ip.String(), name)
 	}
 	fmt.Fprintf(&b, "# %s\n", MarkerEnd)
@@ -18,6 +18,7 @@ package etchosts
 
 import (
 	"bytes"
+	"net"
 	"strings"
 	"testing"
 
@@ -70,3 +71,13 @@ func TestReadButSkipMarkedRegion(t *testing.T) {
 		t.Logf("=== END : %d===", i)
 	}
 }
+
+func TestPopulateSkipsWildcards(t *testing.T) {
+	hostnameMap := map[string]net.IP{
+		"host1":   net.ParseIP("127.0.42.101"),
+		"*.host1": net.ParseIP("127.0.42.101"),
+	}
+	b := populate(hostnameMap, nil)
+	assert.Assert(t, strings.Contains(string(b), "127.0.42.101 host1\n"))
+	assert.Assert(t, !strings.Contains(string(b), "*"))
+}
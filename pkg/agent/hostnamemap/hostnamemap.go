@@ -0,0 +1,82 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package hostnamemap provides lookups of virtual hostnames, including wildcard names such as "*.host1".
+package hostnamemap
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// IsWildcard returns true if name is a wildcard name such as "*.host1".
+func IsWildcard(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// Map maps the canonical virtual hostnames to the virtual IPs.
+type Map struct {
+	exact     map[string]net.IP // key: canonical name, e.g. "host1."
+	wildcards map[string]net.IP // key: canonical suffix, e.g. "app.host1." for "*.app.host1"
+}
+
+// New creates Map from the hostname map of jsonmsg.ConfigureRequestArgs.
+func New(hostnameMap map[string]net.IP) *Map {
+	m := &Map{
+		exact:     make(map[string]net.IP),
+		wildcards: make(map[string]net.IP),
+	}
+	for name, ip := range hostnameMap {
+		if IsWildcard(name) {
+			m.wildcards[dns.CanonicalName(name[2:])] = ip
+		} else {
+			m.exact[dns.CanonicalName(name)] = ip
+		}
+	}
+	return m
+}
+
+// Exact returns the map of the non-wildcard names.
+// The returned map must not be modified.
+func (m *Map) Exact() map[string]net.IP {
+	return m.exact
+}
+
+// Lookup looks up the canonical name.
+// Exact names take precedence over wildcards, and longer wildcards take precedence over shorter ones.
+// A wildcard "*.host1" matches "foo.host1" and "foo.bar.host1", but does not match "host1".
+func (m *Map) Lookup(canon string) (net.IP, bool) {
+	if ip, ok := m.exact[canon]; ok {
+		return ip, true
+	}
+	return m.LookupWildcard(canon)
+}
+
+// LookupWildcard looks up the canonical name only in the wildcards.
+func (m *Map) LookupWildcard(canon string) (net.IP, bool) {
+	var (
+		matched string
+		res     net.IP
+	)
+	for suffix, ip := range m.wildcards {
+		if canon != suffix && dns.IsSubDomain(suffix, canon) && len(suffix) > len(matched) {
+			matched, res = suffix, ip
+		}
+	}
+	return res, res != nil
+}
@@ -0,0 +1,56 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hostnamemap
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLookup(t *testing.T) {
+	m := New(map[string]net.IP{
+		"host1":             net.ParseIP("127.0.42.101"),
+		"*.host1":           net.ParseIP("127.0.42.101"),
+		"*.app.host1":       net.ParseIP("127.0.42.102"),
+		"special.app.host1": net.ParseIP("127.0.42.103"),
+	})
+	testCases := map[string]string{
+		"host1.":             "127.0.42.101",
+		"foo.host1.":         "127.0.42.101",
+		"app.host1.":         "127.0.42.101",
+		"foo.app.host1.":     "127.0.42.102",
+		"foo.bar.app.host1.": "127.0.42.102",
+		"special.app.host1.": "127.0.42.103",
+		"host2.":             "",
+		"foo.host2.":         "",
+		"notreallyhost1.":    "",
+	}
+	for canon, expected := range testCases {
+		ip, ok := m.Lookup(canon)
+		if expected == "" {
+			assert.Assert(t, !ok, canon)
+		} else {
+			assert.Assert(t, ok, canon)
+			assert.Equal(t, expected, ip.String(), canon)
+		}
+	}
+	_, ok := m.LookupWildcard("host1.")
+	assert.Assert(t, !ok)
+	assert.Equal(t, 2, len(m.Exact()))
+}
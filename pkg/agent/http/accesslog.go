@@ -0,0 +1,210 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/norouter/norouter/pkg/accesslog"
+)
+
+// WithAccessLog wraps h to log the proxy requests.
+// Non-proxy requests such as "GET /proxy.pac" are not logged.
+//
+// CONNECT requests are logged when the tunnel is closed.
+func WithAccessLog(h http.Handler, l accesslog.Logger) http.Handler {
+	if l == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isProxyRequest(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		e := &accesslog.Entry{
+			Time:        time.Now(),
+			Proxy:       "http",
+			Client:      req.RemoteAddr,
+			Method:      req.Method,
+			Proto:       req.Proto,
+			Destination: destinationOf(req),
+		}
+		if req.Method != http.MethodConnect {
+			e.URL = req.URL.String()
+		}
+		rec := &recorder{
+			ResponseWriter: w,
+			entry:          e,
+			logger:         l,
+		}
+		h.ServeHTTP(rec, req.WithContext(accesslog.WithEntry(req.Context(), e)))
+		rec.handlerDone()
+	})
+}
+
+// destinationOf returns "host:port" of req.
+func destinationOf(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return req.Host
+	}
+	port, err := portNumFromURL(req.URL)
+	if err != nil {
+		return req.URL.Host
+	}
+	return net.JoinHostPort(req.URL.Hostname(), strconv.Itoa(port))
+}
+
+// setEntryError sets err to the access log entry of req, if any.
+func setEntryError(req *http.Request, err error) {
+	if e := accesslog.EntryFromContext(req.Context()); e != nil {
+		e.Error = err.Error()
+	}
+}
+
+// setEntryMesh marks the access log entry of req as dialed over the mesh, if any.
+func setEntryMesh(req *http.Request, conn net.Conn) {
+	if e := accesslog.EntryFromContext(req.Context()); e != nil {
+		e.Mesh = true
+		if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			e.VIP = a.IP
+		}
+	}
+}
+
+// recorder records the status and the bytes of the response, including the hijacked connection.
+type recorder struct {
+	http.ResponseWriter
+	mu       sync.Mutex
+	entry    *accesslog.Entry
+	logger   accesslog.Logger
+	hijacked bool
+	done     bool // handler returned
+	closed   bool // hijacked connection closed
+	logged   bool
+}
+
+func (r *recorder) WriteHeader(code int) {
+	r.mu.Lock()
+	if r.entry.Status == 0 {
+		r.entry.Status = code
+	}
+	r.mu.Unlock()
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.mu.Lock()
+	if r.entry.Status == 0 {
+		r.entry.Status = http.StatusOK
+	}
+	r.entry.Bytes += int64(n)
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *recorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not implement http.Hijacker")
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	r.mu.Lock()
+	r.hijacked = true
+	r.mu.Unlock()
+	return &hijackedConn{Conn: c, rec: r}, rw, nil
+}
+
+func (r *recorder) handlerDone() {
+	r.mu.Lock()
+	r.done = true
+	r.maybeLog()
+	r.mu.Unlock()
+}
+
+// maybeLog must be called with r.mu held.
+func (r *recorder) maybeLog() {
+	if r.logged || !r.done || (r.hijacked && !r.closed) {
+		return
+	}
+	r.logged = true
+	r.entry.Duration = time.Since(r.entry.Time)
+	r.logger.Log(r.entry)
+}
+
+// hijackedConn counts the bytes sent to the client, and sniffs the status line
+// such as "HTTP/1.1 200 Connection established".
+type hijackedConn struct {
+	net.Conn
+	rec       *recorder
+	closeOnce sync.Once
+}
+
+func (c *hijackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.rec.mu.Lock()
+	if c.rec.entry.Status == 0 {
+		c.rec.entry.Status = sniffStatus(p)
+	}
+	c.rec.entry.Bytes += int64(n)
+	c.rec.mu.Unlock()
+	return n, err
+}
+
+func (c *hijackedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.rec.mu.Lock()
+		c.rec.closed = true
+		c.rec.maybeLog()
+		c.rec.mu.Unlock()
+	})
+	return err
+}
+
+// sniffStatus returns the status code of the status line such as "HTTP/1.1 200 OK".
+// sniffStatus returns 0 when p does not begin with a status line.
+func sniffStatus(p []byte) int {
+	if !bytes.HasPrefix(p, []byte("HTTP/")) {
+		return 0
+	}
+	fields := bytes.Fields(p)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0
+	}
+	return code
+}
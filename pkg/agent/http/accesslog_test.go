@@ -0,0 +1,80 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/norouter/norouter/pkg/accesslog"
+	"gotest.tools/v3/assert"
+)
+
+func TestWithAccessLog(t *testing.T) {
+	logged := make(chan *accesslog.Entry, 1)
+	logger := accesslog.LoggerFunc(func(e *accesslog.Entry) {
+		logged <- e
+	})
+	inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodConnect {
+			c, _, err := w.(http.Hijacker).Hijack()
+			assert.NilError(t, err)
+			c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			c.Write([]byte("hello"))
+			c.Close()
+			return
+		}
+		io.WriteString(w, "hello")
+	})
+	h := WithAccessLog(inner, logger)
+
+	req := httptest.NewRequest(http.MethodGet, "http://host1/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	e := <-logged
+	assert.Equal(t, "http", e.Proxy)
+	assert.Equal(t, "GET", e.Method)
+	assert.Equal(t, "http://host1/", e.URL)
+	assert.Equal(t, "host1:80", e.Destination)
+	assert.Equal(t, http.StatusOK, e.Status)
+	assert.Equal(t, int64(5), e.Bytes)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	assert.NilError(t, err)
+	defer c.Close()
+	_, err = io.WriteString(c, "CONNECT host1:443 HTTP/1.1\r\nHost: host1:443\r\n\r\n")
+	assert.NilError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	e = <-logged
+	assert.Equal(t, "CONNECT", e.Method)
+	assert.Equal(t, "host1:443", e.Destination)
+	assert.Equal(t, http.StatusOK, e.Status)
+	assert.Equal(t, int64(len("HTTP/1.1 200 Connection established\r\n\r\nhello")), e.Bytes)
+}
+
+func TestSniffStatus(t *testing.T) {
+	assert.Equal(t, 403, sniffStatus([]byte("HTTP/1.1 403 Forbidden\r\n\r\n")))
+	assert.Equal(t, 0, sniffStatus([]byte("hello")))
+}
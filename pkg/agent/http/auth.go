@@ -0,0 +1,71 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WithAuth wraps h to require HTTP Basic authentication ("Proxy-Authorization" header) for the proxy requests.
+// Non-proxy requests such as "GET /proxy.pac" are passed through without authentication.
+func WithAuth(h http.Handler, auth *jsonmsg.ProxyAuth) http.Handler {
+	if auth == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isProxyRequest(req) {
+			if !checkBasicAuth(req.Header.Get("Proxy-Authorization"), auth) {
+				logrus.Warnf("refusing an unauthenticated proxy request from %s", req.RemoteAddr)
+				w.Header().Set("Proxy-Authenticate", `Basic realm="NoRouter"`)
+				http.Error(w, "NoRouter: proxy authentication required", http.StatusProxyAuthRequired)
+				return
+			}
+			// Do not leak the credentials to the destination
+			req.Header.Del("Proxy-Authorization")
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func isProxyRequest(req *http.Request) bool {
+	return req.Method == http.MethodConnect || req.URL.IsAbs()
+}
+
+func checkBasicAuth(header string, auth *jsonmsg.ProxyAuth) bool {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) == 1
+	return userOK && passOK
+}
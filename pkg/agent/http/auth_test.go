@@ -0,0 +1,67 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"gotest.tools/v3/assert"
+)
+
+func TestWithAuth(t *testing.T) {
+	auth := &jsonmsg.ProxyAuth{Username: "foo", Password: "bar"}
+	var gotAuthHeader string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotAuthHeader = req.Header.Get("Proxy-Authorization")
+		w.WriteHeader(http.StatusOK)
+	})
+	h := WithAuth(inner, auth)
+
+	req := httptest.NewRequest(http.MethodGet, "http://host1:8080/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+	assert.Equal(t, `Basic realm="NoRouter"`, rec.Header().Get("Proxy-Authenticate"))
+
+	req = httptest.NewRequest(http.MethodGet, "http://host1:8080/", nil)
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJheg==") // foo:baz
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "http://host1:8080/", nil)
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==") // foo:bar
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "", gotAuthHeader)
+
+	req = httptest.NewRequest(http.MethodConnect, "host1:443", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+
+	// Non-proxy requests do not require authentication
+	req = httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+	req.URL.Scheme, req.URL.Host = "", ""
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,158 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Stages of DialError.
+const (
+	// StageResolve means that the hostname could not be resolved into a virtual IP.
+	StageResolve = "resolve"
+	// StagePolicy means that the connection was refused by the policies.
+	StagePolicy = "policy"
+	// StageNetstack means that the TCP connection to the virtual IP could not be established over the netstack,
+	// e.g., the port is not forwarded by the remote host, or the remote host is not reachable.
+	StageNetstack = "netstack"
+	// StageBackend means that the remote host accepted the connection, but the backend of the remote host failed,
+	// e.g., the backend refused the connection dialed by the remote host, or returned a malformed response.
+	StageBackend = "backend"
+	// StageEgress means that the destination is not a virtual host, and egress.disableDirect is set.
+	StageEgress = "egress"
+)
+
+// Headers of the error responses.
+const (
+	HeaderStage = "X-NoRouter-Error-Stage"
+	HeaderError = "X-NoRouter-Error"
+	HeaderVIP   = "X-NoRouter-VIP"
+	HeaderRoute = "X-NoRouter-Route"
+)
+
+// DialError is an error of dialing a virtual host.
+type DialError struct {
+	Stage string // StageResolve, StagePolicy, StageNetstack, StageBackend, or StageEgress
+	Host  string
+	Port  uint16
+	VIP   net.IP // nil for StageResolve and StageEgress
+	Route string // human-readable explanation of the route, e.g. `"host1" is a virtual hostname of 127.0.42.101`
+	Err   error
+}
+
+func (e *DialError) Error() string {
+	s := fmt.Sprintf("failed to dial %s (stage: %s", net.JoinHostPort(e.Host, strconv.Itoa(int(e.Port))), e.Stage)
+	if e.VIP != nil {
+		s += ", vip: " + e.VIP.String()
+	}
+	return s + "): " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true if the error was caused by a timeout.
+func (e *DialError) Timeout() bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(e.Err, &ne) && ne.Timeout()
+}
+
+// StatusCode returns 403 for StagePolicy and StageEgress, 504 for timeouts, and 502 for others.
+func (e *DialError) StatusCode() int {
+	switch {
+	case e.Stage == StagePolicy, e.Stage == StageEgress:
+		return http.StatusForbidden
+	case e.Timeout():
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// diagnose converts err into an error response.
+// Errors other than *DialError are treated as StageBackend errors.
+func diagnose(err error) (int, http.Header, string) {
+	var de *DialError
+	if !errors.As(err, &de) {
+		de = &DialError{Stage: StageBackend, Err: err}
+	}
+	h := make(http.Header)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set(HeaderStage, de.Stage)
+	h.Set(HeaderError, headerValue(de.Err.Error()))
+	var b strings.Builder
+	fmt.Fprintf(&b, "NoRouter: %s\n", err.Error())
+	fmt.Fprintf(&b, "Stage: %s\n", de.Stage)
+	if de.VIP != nil {
+		h.Set(HeaderVIP, de.VIP.String())
+		fmt.Fprintf(&b, "VIP: %s\n", de.VIP)
+	}
+	if de.Route != "" {
+		h.Set(HeaderRoute, headerValue(de.Route))
+		fmt.Fprintf(&b, "Route: %s\n", de.Route)
+	}
+	return de.StatusCode(), h, b.String()
+}
+
+// headerValue replaces the control characters with spaces.
+func headerValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// writeError writes the error response of err to w.
+func writeError(w http.ResponseWriter, err error) {
+	code, h, body := diagnose(err)
+	for k, v := range h {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	io.WriteString(w, body)
+}
+
+// newErrorResponse returns the error response of err, for req.
+func newErrorResponse(req *http.Request, err error) *http.Response {
+	code, h, body := diagnose(err)
+	return &http.Response{
+		Request:       req,
+		StatusCode:    code,
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDiagnose(t *testing.T) {
+	err := &DialError{
+		Stage: StageNetstack,
+		Host:  "host1",
+		Port:  8080,
+		VIP:   net.ParseIP("127.0.42.101"),
+		Route: `"host1" is a virtual hostname of 127.0.42.101`,
+		Err:   errors.New("connection refused"),
+	}
+	code, h, body := diagnose(fmt.Errorf("wrapped: %w", err))
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Equal(t, StageNetstack, h.Get(HeaderStage))
+	assert.Equal(t, "127.0.42.101", h.Get(HeaderVIP))
+	assert.Equal(t, `"host1" is a virtual hostname of 127.0.42.101`, h.Get(HeaderRoute))
+	assert.Equal(t, "connection refused", h.Get(HeaderError))
+	assert.Assert(t, strings.Contains(body, "failed to dial host1:8080 (stage: netstack, vip: 127.0.42.101): connection refused"), body)
+
+	err.Err = fmt.Errorf("failed to dial gonet: %w", context.DeadlineExceeded)
+	code, _, _ = diagnose(err)
+	assert.Equal(t, http.StatusGatewayTimeout, code)
+
+	err.Stage = StagePolicy
+	code, _, _ = diagnose(err)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, h, _ = diagnose(errors.New("malformed\r\nresponse"))
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Equal(t, StageBackend, h.Get(HeaderStage))
+	assert.Equal(t, "malformed  response", h.Get(HeaderError))
+}
+
+func TestRoundTripBackendError(t *testing.T) {
+	// Emulates the remote agent that closes the connection when the backend is down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			http.ReadRequest(bufio.NewReader(c))
+			c.Close()
+		}
+	}()
+	tr := newTransport(func(ctx context.Context, host string, port uint16) (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	defer tr.CloseIdleConnections()
+	req := httptest.NewRequest(http.MethodGet, "http://host1:8080/", nil)
+	_, err = roundTrip(tr, req)
+	var de *DialError
+	assert.Assert(t, errors.As(err, &de), err)
+	assert.Equal(t, StageBackend, de.Stage)
+	assert.Equal(t, "host1", de.Host)
+	assert.Equal(t, uint16(8080), de.Port)
+	assert.Equal(t, "127.0.0.1", de.VIP.String())
+	assert.ErrorContains(t, err, "the backend may be down")
+
+	resp := newErrorResponse(req, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, StageBackend, resp.Header.Get(HeaderStage))
+}
@@ -17,19 +17,20 @@
 package http
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/elazarl/goproxy"
-	"github.com/hashicorp/go-multierror"
 	"github.com/norouter/norouter/pkg/agent/bicopy"
 	"github.com/norouter/norouter/pkg/agent/resolver"
+	"github.com/norouter/norouter/pkg/agent/upstreamproxy"
+	"github.com/norouter/norouter/pkg/policy"
 
 	"github.com/sirupsen/logrus"
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -39,84 +40,98 @@ import (
 )
 
 // NewHandlerHandler returns a http.Handler that works as proxy.
-func NewHandler(st *stack.Stack, rv *resolver.Resolver) (http.Handler, error) {
+//
+// Connections to the netstack that violate pol are refused.
+// me is used as the source IP for evaluating pol.
+//
+// nonProxy optionally serves the requests that are not proxy requests, such as "GET /proxy.pac".
+//
+// upstream optionally proxies the requests to the destinations that are not "interesting" for rv.
+func NewHandler(st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, nonProxy http.Handler, upstream *upstreamproxy.Dialer) (http.Handler, error) {
 	p := goproxy.NewProxyHttpServer()
+	if nonProxy != nil {
+		p.NonproxyHandler = nonProxy
+	}
+	if upstream != nil {
+		// Replaces the defaults of goproxy that read $HTTP_PROXY, $HTTPS_PROXY, and $NO_PROXY
+		p.Tr.Proxy = upstream.ProxyURL
+		p.ConnectDial = upstream.Dial
+	}
 	var cond goproxy.ReqConditionFunc = func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
-		s := req.URL.Hostname()
-		return rv.Interesting(s)
+		return interesting(rv, req)
 	}
+	tr := newTransport(func(ctx context.Context, host string, port uint16) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+		defer cancel()
+		return DialContext(ctx, st, rv, pol, me, host, port)
+	})
 	var doFunc = func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		resp, err := do(st, rv, req, ctx)
+		resp, err := roundTrip(tr, req)
 		if err != nil {
-			logrus.WithError(err).Warn("failed to call do()")
-			return req, goproxy.NewResponse(req,
-				goproxy.ContentTypeText, http.StatusInternalServerError,
-				"See NoRouter agent log\n")
+			explainError(rv, err)
+			logrus.WithError(err).Warn("failed to call roundTrip()")
+			setEntryError(req, err)
+			return req, newErrorResponse(req, err)
 		}
 		return req, resp
 	}
 	p.OnRequest(cond).DoFunc(doFunc)
 	var hijackFunc = func(req *http.Request, clientConn net.Conn, ctx *goproxy.ProxyCtx) {
 		defer clientConn.Close()
-		if err := hijack(st, rv, req, clientConn, ctx); err != nil {
+		if err := hijack(st, rv, pol, me, req, clientConn, ctx); err != nil {
 			logrus.WithError(err).Warn("failed to call hijack()")
-			clientConn.Write([]byte("HTTP/1.1 500 Cannot reach destination\r\n\r\n"))
+			setEntryError(req, err)
+			resp := newErrorResponse(req, err)
+			resp.Close = true
+			resp.Write(clientConn)
 		}
 	}
 	p.OnRequest(cond).HijackConnect(hijackFunc)
-	return p, nil
-}
-
-func do(st *stack.Stack, rv *resolver.Resolver, req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
-	gonetDialConn, err := gonetDial(st, rv, req)
-	if err != nil {
-		return nil, err
-	}
-	// Do NOT defer close gonetDialConn
-	remoteBuf := bufio.NewReadWriter(bufio.NewReader(gonetDialConn), bufio.NewWriter(gonetDialConn))
-	if err := req.Write(gonetDialConn); err != nil {
-		gonetDialConn.Close()
-		return nil, err
-	}
-	if err := remoteBuf.Flush(); err != nil {
-		gonetDialConn.Close()
-		return nil, err
-	}
-	resp, err := http.ReadResponse(remoteBuf.Reader, req)
-	if err != nil {
-		gonetDialConn.Close()
-		return nil, err
-	}
-	rc := &readCloserWithHook{
-		Reader:    resp.Body,
-		klose:     resp.Body.Close,
-		postClose: gonetDialConn.Close,
+	if !rv.DirectAllowed() {
+		var refuseFunc = func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, newErrorResponse(req, egressError(rv, req))
+		}
+		p.OnRequest(goproxy.Not(cond)).DoFunc(refuseFunc)
+		var refuseConnectFunc = func(req *http.Request, clientConn net.Conn, ctx *goproxy.ProxyCtx) {
+			defer clientConn.Close()
+			resp := newErrorResponse(req, egressError(rv, req))
+			resp.Close = true
+			resp.Write(clientConn)
+		}
+		p.OnRequest(goproxy.Not(cond)).HijackConnect(refuseConnectFunc)
+	}
+	var h http.HandlerFunc = func(w http.ResponseWriter, req *http.Request) {
+		// goproxy cannot relay "101 Switching Protocols" responses from DoFunc
+		if req.Method != http.MethodConnect && req.URL.IsAbs() && isUpgradeRequest(req) && interesting(rv, req) {
+			conn, err := gonetDial(st, rv, pol, me, req)
+			if err == nil {
+				err = upgrade(w, req, conn)
+			}
+			if err != nil {
+				logrus.WithError(err).Warn("failed to call upgrade()")
+				setEntryError(req, err)
+				writeError(w, err)
+			}
+			return
+		}
+		p.ServeHTTP(w, req)
 	}
-	resp.Body = rc
-	return resp, nil
+	return h, nil
 }
 
-type readCloserWithHook struct {
-	io.Reader
-	klose     func() error
-	postClose func() error
-}
-
-func (rc *readCloserWithHook) Close() error {
-	var merr *multierror.Error
-	if err := rc.klose(); err != nil {
-		merr = multierror.Append(merr, err)
-	}
-	if rc.postClose != nil {
-		if err := rc.postClose(); err != nil {
-			merr = multierror.Append(merr, err)
-		}
+// interesting returns true if the destination of req should be dialed over the netstack.
+func interesting(rv *resolver.Resolver, req *http.Request) bool {
+	s := req.URL.Hostname()
+	port, err := portNumFromURL(req.URL)
+	if err != nil {
+		// evaluate only the routes without ports
+		port = 0
 	}
-	return merr.ErrorOrNil()
+	return rv.Interesting(s, uint16(port))
 }
 
-func hijack(st *stack.Stack, rv *resolver.Resolver, req *http.Request, clientConn net.Conn, ctx *goproxy.ProxyCtx) error {
-	gonetDialConn, err := gonetDial(st, rv, req)
+func hijack(st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, req *http.Request, clientConn net.Conn, ctx *goproxy.ProxyCtx) error {
+	gonetDialConn, err := gonetDial(st, rv, pol, me, req)
 	if err != nil {
 		return err
 	}
@@ -126,26 +141,88 @@ func hijack(st *stack.Stack, rv *resolver.Resolver, req *http.Request, clientCon
 	return nil
 }
 
-func gonetDial(st *stack.Stack, rv *resolver.Resolver, req *http.Request) (net.Conn, error) {
-	ip, err := rv.Resolve(req.URL.Hostname())
+func gonetDial(st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, req *http.Request) (net.Conn, error) {
+	port, err := portNumFromURL(req.URL)
 	if err != nil {
 		return nil, err
 	}
-	port, err := portNumFromURL(req.URL)
+	conn, err := Dial(st, rv, pol, me, req.URL.Hostname(), uint16(port))
 	if err != nil {
 		return nil, err
 	}
+	setEntryMesh(req, conn)
+	return conn, nil
+}
+
+// DialTimeout is the timeout of Dial.
+const DialTimeout = 30 * time.Second
+
+// Dial dials the virtual host over the netstack, with DialTimeout.
+// host must be "interesting" for rv.
+//
+// Connections that violate pol are refused.
+// me is used as the source IP for evaluating pol.
+//
+// The returned error is *DialError.
+func Dial(st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, host string, port uint16) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	return DialContext(ctx, st, rv, pol, me, host, port)
+}
+
+// DialContext is similar to Dial but without DialTimeout.
+func DialContext(ctx context.Context, st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, host string, port uint16) (net.Conn, error) {
+	dialErr := func(stage string, ip net.IP, err error) error {
+		return &DialError{
+			Stage: stage,
+			Host:  host,
+			Port:  port,
+			VIP:   ip,
+			Route: rv.Explain(host, port).Reason,
+			Err:   err,
+		}
+	}
+	ip, err := rv.Resolve(host, port)
+	if err != nil {
+		return nil, dialErr(StageResolve, nil, err)
+	}
+	if err := pol.CheckDial(me, ip, port); err != nil {
+		return nil, dialErr(StagePolicy, ip, err)
+	}
 	fullAddr := tcpip.FullAddress{
 		Addr: tcpip.Address(ip),
-		Port: uint16(port),
+		Port: port,
 	}
-	conn, err := gonet.DialContextTCP(context.TODO(), st, fullAddr, ipv4.ProtocolNumber)
+	conn, err := gonet.DialContextTCP(ctx, st, fullAddr, ipv4.ProtocolNumber)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial gonet %s:%d: %w", ip, port, err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, dialErr(StageNetstack, ip, fmt.Errorf("failed to dial gonet %s:%d: %w", ip, port, err))
 	}
 	return conn, nil
 }
 
+// egressError returns the error for the non-mesh destination of req, when egress.disableDirect is set.
+func egressError(rv *resolver.Resolver, req *http.Request) error {
+	port, _ := portNumFromURL(req.URL)
+	return &DialError{
+		Stage: StageEgress,
+		Host:  req.URL.Hostname(),
+		Port:  uint16(port),
+		Route: rv.Explain(req.URL.Hostname(), uint16(port)).Reason,
+		Err:   errors.New("dialing non-mesh destinations directly is disabled (egress.disableDirect)"),
+	}
+}
+
+// explainError sets the route of err, if err is *DialError without the route.
+func explainError(rv *resolver.Resolver, err error) {
+	var de *DialError
+	if errors.As(err, &de) && de.Route == "" {
+		de.Route = rv.Explain(de.Host, de.Port).Reason
+	}
+}
+
 func portNumFromURL(u *url.URL) (int, error) {
 	s := u.Port()
 	if s != "" {
@@ -0,0 +1,208 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/norouter/norouter/pkg/agent/bicopy"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxIdleConns is the maximum number of the idle connections to the virtual hosts, in total.
+	MaxIdleConns = 64
+	// MaxIdleConnsPerHost is the maximum number of the idle connections per destination "host:port".
+	MaxIdleConnsPerHost = 4
+	// IdleConnTimeout is the duration after which the idle connections are closed.
+	IdleConnTimeout = 90 * time.Second
+)
+
+// dialFunc dials host:port over the netstack.
+type dialFunc func(ctx context.Context, host string, port uint16) (net.Conn, error)
+
+// newTransport returns a transport that keeps the connections to the virtual hosts alive,
+// so that the requests to the same destination do not need to pay for the handshake over the stdio link.
+//
+// The transport never uses proxies, and never compresses the bodies by itself.
+func newTransport(dial dialFunc) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, portStr, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			port, err := strconv.ParseUint(portStr, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the port of %q: %w", addr, err)
+			}
+			return dial(ctx, host, uint16(port))
+		},
+		MaxIdleConns:        MaxIdleConns,
+		MaxIdleConnsPerHost: MaxIdleConnsPerHost,
+		IdleConnTimeout:     IdleConnTimeout,
+		DisableCompression:  true,
+	}
+}
+
+// roundTrip sends the proxy request req via tr.
+//
+// The errors after establishing the connection are returned as *DialError with StageBackend.
+// The route of the error is left empty.
+func roundTrip(tr http.RoundTripper, req *http.Request) (*http.Response, error) {
+	var got *httptrace.GotConnInfo
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			got = &info
+			setEntryMesh(req, info.Conn)
+		},
+	}
+	outreq := req.Clone(httptrace.WithClientTrace(req.Context(), trace))
+	outreq.RequestURI = ""
+	removeHopHeaders(outreq.Header)
+	resp, err := tr.RoundTrip(outreq)
+	if err == nil || got == nil {
+		return resp, err
+	}
+	var de *DialError
+	if errors.As(err, &de) {
+		return nil, err
+	}
+	de = &DialError{
+		Stage: StageBackend,
+		Host:  req.URL.Hostname(),
+		Err:   err,
+	}
+	if port, err := portNumFromURL(req.URL); err == nil {
+		de.Port = uint16(port)
+	}
+	if a, ok := got.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		de.VIP = a.IP
+	}
+	if !got.Reused && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+		// The remote agent closes the connection when it fails to dial the backend
+		de.Err = fmt.Errorf("the connection was closed by the remote host before the response, the backend may be down: %w", err)
+	}
+	return nil, de
+}
+
+// hopHeaders are removed from the proxy requests.
+// "Connection" and the headers listed in "Connection" are removed too.
+var hopHeaders = []string{
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	h.Del("Connection")
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// isUpgradeRequest returns true for requests with "Connection: Upgrade", such as websocket handshakes.
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrade relays the upgrade request req to conn, and relays the response to the client.
+// When the response is "101 Switching Protocols", the connections are spliced until either of them is closed.
+// Otherwise the client connection is closed after relaying the response.
+//
+// conn is closed by upgrade.
+// The errors after hijacking the client connection are logged, not returned.
+func upgrade(w http.ResponseWriter, req *http.Request, conn net.Conn) error {
+	defer conn.Close()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.New("the response writer does not implement http.Hijacker")
+	}
+	outreq := req.Clone(req.Context())
+	outreq.Header.Del("Proxy-Connection")
+	outreq.Header.Del("Proxy-Authorization")
+	if err := outreq.Write(conn); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, outreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	defer clientConn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Close = true
+	}
+	if err := resp.Write(clientConn); err != nil {
+		logrus.WithError(err).Debug("failed to relay the upgrade response")
+		return nil
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil
+	}
+	// The bytes that were already read ahead by bufio are relayed too
+	bicopy.Bicopy(
+		&bufferedConn{Conn: clientConn, r: clientBuf.Reader},
+		&bufferedConn{Conn: conn, r: br}, nil)
+	return nil
+}
+
+// bufferedConn reads from r, which is a bufio.Reader of Conn.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
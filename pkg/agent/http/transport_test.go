@@ -0,0 +1,118 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRoundTripReusesConnections(t *testing.T) {
+	var gotHeaders []http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotHeaders = append(gotHeaders, req.Header.Clone())
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	var dialed int32
+	tr := newTransport(func(ctx context.Context, host string, port uint16) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		return net.Dial("tcp", backend.Listener.Addr().String())
+	})
+	defer tr.CloseIdleConnections()
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://host1/", nil)
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		req.Header.Set("Connection", "X-Foo")
+		req.Header.Set("X-Foo", "foo")
+		req.Header.Set("X-Bar", "bar")
+		resp, err := roundTrip(tr, req)
+		assert.NilError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		assert.NilError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "hello", string(b))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dialed))
+	assert.Equal(t, 3, len(gotHeaders))
+	assert.Equal(t, "", gotHeaders[0].Get("Proxy-Connection"))
+	assert.Equal(t, "", gotHeaders[0].Get("X-Foo"))
+	assert.Equal(t, "bar", gotHeaders[0].Get("X-Bar"))
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://host1/", nil)
+	assert.Equal(t, false, isUpgradeRequest(req))
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	assert.Equal(t, true, isUpgradeRequest(req))
+	req.Header.Set("Connection", "keep-alive")
+	assert.Equal(t, false, isUpgradeRequest(req))
+}
+
+func TestUpgrade(t *testing.T) {
+	backendL, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer backendL.Close()
+	go func() {
+		c, err := backendL.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: "+req.Header.Get("Upgrade")+"\r\nConnection: Upgrade\r\n\r\n")
+		// echo
+		line, _ := br.ReadString('\n')
+		io.WriteString(c, strings.ToUpper(line))
+	}()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := net.Dial("tcp", backendL.Addr().String())
+		assert.NilError(t, err)
+		assert.NilError(t, upgrade(w, req, conn))
+	})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	assert.NilError(t, err)
+	defer c.Close()
+	_, err = io.WriteString(c, "GET http://host1/ws HTTP/1.1\r\nHost: host1\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhello\n")
+	assert.NilError(t, err)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+	line, err := br.ReadString('\n')
+	assert.NilError(t, err)
+	assert.Equal(t, "HELLO\n", line)
+}
@@ -0,0 +1,344 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ingress provides the reverse proxy that routes requests to the virtual hosts
+// by the Host header (plain HTTP), and connections by the SNI (TLS).
+//
+// TLS is not terminated.
+package ingress
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/norouter/norouter/pkg/agent/bicopy"
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sniffTimeout is the timeout for reading the Host header or the SNI.
+const sniffTimeout = 30 * time.Second
+
+// tlsRecordTypeHandshake is the first byte of TLS ClientHello.
+const tlsRecordTypeHandshake = 0x16
+
+// DialFunc dials the backend.
+type DialFunc func(host string, port uint16) (net.Conn, error)
+
+type backend struct {
+	host string
+	port uint16
+}
+
+func (b *backend) String() string {
+	return net.JoinHostPort(b.host, strconv.Itoa(int(b.port)))
+}
+
+type rule struct {
+	host    string // canonical, without the trailing dot. Wildcards are "*.example.com".
+	backend *backend
+}
+
+// Server is the ingress server.
+type Server struct {
+	rules          []rule
+	defaultBackend *backend // nil when not set
+	dial           DialFunc
+	proxy          *httputil.ReverseProxy
+}
+
+// New creates an ingress server.
+// The backends of rules and defaultBackend are "host:port" strings.
+// defaultBackend is optional.
+func New(rules []jsonmsg.IngressRule, defaultBackend string, dial DialFunc) (*Server, error) {
+	s := &Server{
+		dial: dial,
+	}
+	s.proxy = &httputil.ReverseProxy{
+		// The URL is set by ServeHTTP. The Host header is passed to the backend as is.
+		Director: func(*http.Request) {},
+		Transport: &http.Transport{
+			DialContext:     s.dialContext,
+			IdleConnTimeout: 90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			logrus.WithError(err).Warnf("ingress: failed to proxy %q from %s to %s", req.Host, req.RemoteAddr, req.URL.Host)
+			http.Error(w, fmt.Sprintf("NoRouter: failed to dial ingress backend %s", req.URL.Host), http.StatusBadGateway)
+		},
+	}
+	for _, r := range rules {
+		b, err := parseBackend(r.Backend)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = append(s.rules, rule{
+			host:    canonicalHost(r.Host),
+			backend: b,
+		})
+	}
+	if defaultBackend != "" {
+		b, err := parseBackend(defaultBackend)
+		if err != nil {
+			return nil, err
+		}
+		s.defaultBackend = b
+	}
+	return s, nil
+}
+
+func parseBackend(s string) (*backend, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse backend %q: %w", s, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("failed to parse the port of backend %q", s)
+	}
+	return &backend{host: host, port: uint16(port)}, nil
+}
+
+func canonicalHost(s string) string {
+	return strings.TrimSuffix(strings.ToLower(s), ".")
+}
+
+// backendOf returns the backend for the hostname.
+// Exact rules take precedence over wildcard rules, and longer wildcards take precedence over shorter ones.
+func (s *Server) backendOf(hostname string) *backend {
+	hostname = canonicalHost(hostname)
+	var (
+		wildcard    *backend
+		wildcardLen int
+	)
+	for _, r := range s.rules {
+		if r.host == hostname {
+			return r.backend
+		}
+		if strings.HasPrefix(r.host, "*.") {
+			suffix := r.host[1:] // ".example.com"
+			if strings.HasSuffix(hostname, suffix) && len(hostname) > len(suffix) && len(suffix) > wildcardLen {
+				wildcard, wildcardLen = r.backend, len(suffix)
+			}
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return s.defaultBackend
+}
+
+// dialContext dials the backend addr ("host:port") for the reverse proxy.
+func (s *Server) dialContext(_ context.Context, _, addr string) (net.Conn, error) {
+	b, err := parseBackend(addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.dial(b.host, b.port)
+}
+
+// Serve serves l.
+func (s *Server) Serve(l net.Listener) error {
+	hl := newConnListener(l.Addr())
+	defer hl.Close()
+	httpSrv := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: sniffTimeout,
+	}
+	go httpSrv.Serve(hl)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.handle(c, hl); err != nil {
+				logrus.WithError(err).Warnf("ingress: failed to handle the connection from %s", c.RemoteAddr())
+			}
+		}()
+	}
+}
+
+// ServeHTTP routes the plain HTTP request by the Host header.
+// Every request is routed, as a keep-alive connection may switch the Host header.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hostname := req.Host
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	b := s.backendOf(hostname)
+	if b == nil {
+		logrus.Warnf("ingress: no backend for %q from %s", hostname, req.RemoteAddr)
+		http.Error(w, fmt.Sprintf("NoRouter: no ingress backend for %q", hostname), http.StatusBadGateway)
+		return
+	}
+	logrus.Debugf("ingress: routing %q (tls=false) from %s to %s", hostname, req.RemoteAddr, b)
+	req.URL.Scheme = "http"
+	req.URL.Host = b.String()
+	s.proxy.ServeHTTP(w, req)
+}
+
+// handle routes the TLS connection c by the SNI.
+// When c is a plain HTTP connection, c is passed to hl, so that the requests are routed by ServeHTTP.
+func (s *Server) handle(c net.Conn, hl *connListener) error {
+	if err := c.SetReadDeadline(time.Now().Add(sniffTimeout)); err != nil {
+		c.Close()
+		return err
+	}
+	br := bufio.NewReader(c)
+	first, err := br.Peek(1)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if first[0] != tlsRecordTypeHandshake {
+		if err := c.SetReadDeadline(time.Time{}); err != nil {
+			c.Close()
+			return err
+		}
+		return hl.push(&bufferedConn{Conn: c, r: br})
+	}
+	defer c.Close()
+	hostname, peeked, err := sniffTLS(br)
+	if err != nil {
+		return err
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	b := s.backendOf(hostname)
+	if b == nil {
+		return fmt.Errorf("no backend for %q", hostname)
+	}
+	logrus.Debugf("ingress: routing %q (tls=true) from %s to %s", hostname, c.RemoteAddr(), b)
+	bc, err := s.dial(b.host, b.port)
+	if err != nil {
+		return fmt.Errorf("failed to dial backend %s for %q: %w", b, hostname, err)
+	}
+	defer bc.Close()
+	// The bytes buffered in br after the ClientHello are relayed too, so that c can be relayed as is
+	buffered, _ := br.Peek(br.Buffered())
+	if _, err := bc.Write(append(peeked, buffered...)); err != nil {
+		return err
+	}
+	bicopy.Bicopy(c, bc, nil)
+	return nil
+}
+
+// sniffTLS reads the SNI of the TLS ClientHello.
+// sniffTLS also returns the bytes that have been read from r.
+func sniffTLS(r io.Reader) (hostname string, peeked []byte, err error) {
+	var buf bytes.Buffer
+	hostname, err = sniffSNI(io.TeeReader(r, &buf))
+	return hostname, buf.Bytes(), err
+}
+
+// bufferedConn is a net.Conn that reads the bytes buffered in r first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// connListener is a net.Listener that accepts the connections passed by push.
+type connListener struct {
+	addr      net.Addr
+	ch        chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		ch:     make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// push passes c to Accept. c is closed when l is closed.
+func (l *connListener) push(c net.Conn) error {
+	select {
+	case l.ch <- c:
+		return nil
+	case <-l.closed:
+		c.Close()
+		return net.ErrClosed
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+var errSniffed = errors.New("sniffed")
+
+// sniffSNI reads the TLS ClientHello and returns the SNI.
+func sniffSNI(r io.Reader) (string, error) {
+	var hello *tls.ClientHelloInfo
+	conf := &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errSniffed
+		},
+	}
+	err := tls.Server(&readOnlyConn{r: r}, conf).Handshake()
+	if hello == nil {
+		return "", fmt.Errorf("failed to read TLS ClientHello: %w", err)
+	}
+	return hello.ServerName, nil
+}
+
+// readOnlyConn is a net.Conn that can be only read.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                     { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (c *readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,119 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ingress
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"gotest.tools/v3/assert"
+)
+
+func TestBackendOf(t *testing.T) {
+	rules := []jsonmsg.IngressRule{
+		{Host: "app.example.com", Backend: "host1:443"},
+		{Host: "*.example.com", Backend: "host2:443"},
+		{Host: "*.api.example.com", Backend: "host3:8443"},
+	}
+	s, err := New(rules, "host4:80", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, "host1:443", s.backendOf("App.Example.Com.").String())
+	assert.Equal(t, "host2:443", s.backendOf("www.example.com").String())
+	assert.Equal(t, "host3:8443", s.backendOf("v1.api.example.com").String())
+	assert.Equal(t, "host4:80", s.backendOf("example.com").String())
+	assert.Equal(t, "host4:80", s.backendOf("").String())
+
+	s, err = New(rules, "", nil)
+	assert.NilError(t, err)
+	assert.Assert(t, s.backendOf("example.org") == nil)
+
+	_, err = New([]jsonmsg.IngressRule{{Host: "app.example.com", Backend: "host1"}}, "", nil)
+	assert.ErrorContains(t, err, "failed to parse backend")
+}
+
+func TestSniffTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "app.example.com"}).Handshake()
+		client.Close()
+	}()
+	hostname, peeked, err := sniffTLS(server)
+	assert.NilError(t, err)
+	assert.Equal(t, "app.example.com", hostname)
+	assert.Equal(t, byte(0x16), peeked[0])
+}
+
+func TestServe(t *testing.T) {
+	backendL, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer backendL.Close()
+	go http.Serve(backendL, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello from "+req.Host)
+	}))
+
+	var (
+		mu     sync.Mutex
+		dialed []string
+	)
+	dial := func(host string, port uint16) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, host)
+		mu.Unlock()
+		return net.Dial("tcp", backendL.Addr().String())
+	}
+	rules := []jsonmsg.IngressRule{
+		{Host: "app.example.com", Backend: "host1:80"},
+		{Host: "api.example.com", Backend: "host2:80"},
+	}
+	s, err := New(rules, "", dial)
+	assert.NilError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+	go s.Serve(l)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// The requests on a keep-alive connection are routed one by one
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NilError(t, err)
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for _, host := range []string{"app.example.com", "api.example.com"} {
+		_, err = io.WriteString(c, "GET / HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		assert.NilError(t, err)
+		resp, err = http.ReadResponse(br, nil)
+		assert.NilError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		assert.NilError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "hello from "+host, string(body))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.DeepEqual(t, []string{"host1", "host2"}, dialed)
+}
@@ -23,10 +23,13 @@ import (
 	"net"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/norouter/norouter/pkg/agent/bicopy/bicopyutil"
 	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"github.com/sirupsen/logrus"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
@@ -58,12 +61,32 @@ func listen(proto, addr string) (net.Listener, error) {
 	return l, err
 }
 
+func listenPacket(proto, addr string) (net.PacketConn, error) {
+	pc, err := net.ListenPacket(proto, addr)
+	if err != nil {
+		if errors.Is(err, syscall.EADDRNOTAVAIL) || strings.Contains(err.Error(), "can't assign requested address") {
+			if isBSD(runtime.GOOS) {
+				err = fmt.Errorf("hint: try running `sudo ifconfig lo0 alias <IP>`: %w", err)
+			}
+		}
+	}
+	return pc, err
+}
+
 // GoOther forwards connections to "others" VIP such as 127.0.42.102:8080, 127.0.42.103:8080..
 // to the netstack network.
 func GoOther(st *stack.Stack, o jsonmsg.IPPortProto) error {
-	if o.Proto != "tcp" {
-		return fmt.Errorf("expected proto be \"tcp\", got %q", o.Proto)
+	switch o.Proto {
+	case "tcp":
+		return goOtherTCP(st, o)
+	case "udp":
+		return goOtherUDP(st, o)
+	default:
+		return fmt.Errorf("expected proto be \"tcp\" or \"udp\", got %q", o.Proto)
 	}
+}
+
+func goOtherTCP(st *stack.Stack, o jsonmsg.IPPortProto) error {
 	oAddr := fmt.Sprintf("%s:%d", o.IP.String(), o.Port)
 	l, err := listen(o.Proto, oAddr)
 	if err != nil {
@@ -83,6 +106,80 @@ func GoOther(st *stack.Stack, o jsonmsg.IPPortProto) error {
 	return nil
 }
 
+// udpIdleTimeout is the duration after which an idle UDP "session" is closed.
+const udpIdleTimeout = 60 * time.Second
+
+func goOtherUDP(st *stack.Stack, o jsonmsg.IPPortProto) error {
+	oAddr := fmt.Sprintf("%s:%d", o.IP.String(), o.Port)
+	pc, err := listenPacket(o.Proto, oAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %w", oAddr, err)
+	}
+	fullAddr := tcpip.FullAddress{
+		Addr: tcpip.Address(o.IP),
+		Port: o.Port,
+	}
+	go relayUDP(pc, func() (net.Conn, error) {
+		return gonet.DialUDP(st, nil, &fullAddr, ipv4.ProtocolNumber)
+	})
+	return nil
+}
+
+// relayUDP relays datagrams received on pc to the connections created by dial.
+// A connection is created for each client address, and closed after udpIdleTimeout.
+func relayUDP(pc net.PacketConn, dial func() (net.Conn, error)) {
+	var (
+		mu    sync.Mutex
+		conns = make(map[string]net.Conn) // key: client address
+	)
+	buf := make([]byte, 65536)
+	for {
+		n, clientAddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to read from %s", pc.LocalAddr())
+			return
+		}
+		k := clientAddr.String()
+		mu.Lock()
+		conn, ok := conns[k]
+		if !ok {
+			conn, err = dial()
+			if err != nil {
+				mu.Unlock()
+				logrus.WithError(err).Warnf("failed to dial for %s", k)
+				continue
+			}
+			conns[k] = conn
+			go func() {
+				defer func() {
+					mu.Lock()
+					delete(conns, k)
+					mu.Unlock()
+					conn.Close()
+				}()
+				rBuf := make([]byte, 65536)
+				for {
+					if err := conn.SetReadDeadline(time.Now().Add(udpIdleTimeout)); err != nil {
+						return
+					}
+					rn, err := conn.Read(rBuf)
+					if err != nil {
+						return
+					}
+					if _, err := pc.WriteTo(rBuf[:rn], clientAddr); err != nil {
+						logrus.WithError(err).Warnf("failed to write to %s", k)
+						return
+					}
+				}
+			}()
+		}
+		mu.Unlock()
+		if _, err := conn.Write(buf[:n]); err != nil {
+			logrus.WithError(err).Warnf("failed to write a datagram from %s", k)
+		}
+	}
+}
+
 // GoLocalForward forwards connections to "my" VIP such as 127.0.42.101:8080
 // to the underlying application such as 127.0.0.1:80
 func GoLocalForward(me net.IP, f jsonmsg.Forward) error {
@@ -0,0 +1,260 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package pac generates Proxy Auto-Configuration (PAC) files that send only the mesh destinations to the proxies.
+package pac
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/norouter/norouter/pkg/agent/hostnamemap"
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Path is the path of the PAC file served on the HTTP proxy listener.
+const Path = "/proxy.pac"
+
+// ContentType is the MIME type of PAC files.
+const ContentType = "application/x-ns-proxy-autoconfig"
+
+// Generate generates a PAC file.
+//
+// hostnameMap may contain wildcard names such as "*.host1".
+// The ports of the routes are ignored, as the proxies pass through the connections to the ports that are not routed.
+//
+// proxies are the PAC proxy strings such as "PROXY 127.0.0.1:18080" and "SOCKS5 127.0.0.1:18081".
+// Destinations that are not in the mesh are sent "DIRECT".
+func Generate(hostnameMap map[string]net.IP, routes []jsonmsg.Route, proxies []string) string {
+	var (
+		names    []string
+		suffixes []string
+		globs    []string
+		nets     [][2]string // IP and mask
+	)
+	seenIPs := make(map[string]struct{})
+	addNet := func(ipNet *net.IPNet) {
+		k := ipNet.String()
+		if _, ok := seenIPs[k]; ok {
+			return
+		}
+		seenIPs[k] = struct{}{}
+		nets = append(nets, [2]string{ipNet.IP.String(), net.IP(ipNet.Mask).String()})
+	}
+	for name, ip := range hostnameMap {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if hostnamemap.IsWildcard(name) {
+			// "*.host1" -> ".host1"
+			suffixes = append(suffixes, strings.TrimPrefix(name, "*"))
+		} else {
+			names = append(names, name)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			addNet(&net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		}
+	}
+	for _, route := range routes {
+		for _, cidr := range route.ToCIDR {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil || ipNet.IP.To4() == nil {
+				logrus.WithError(err).Debugf("pac: ignoring CIDR %q", cidr)
+				continue
+			}
+			addNet(ipNet)
+		}
+		for _, g := range route.ToHostnameGlob {
+			globs = append(globs, strings.ToLower(strings.TrimSuffix(g, ".")))
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(suffixes)
+	sort.Strings(globs)
+	sort.Slice(nets, func(i, j int) bool {
+		return nets[i][0] < nets[j][0] || (nets[i][0] == nets[j][0] && nets[i][1] < nets[j][1])
+	})
+
+	proxy := "DIRECT"
+	if len(proxies) != 0 {
+		proxy = strings.Join(proxies, "; ")
+	}
+	var b strings.Builder
+	b.WriteString("// Generated by NoRouter. Do not edit.\n")
+	fmt.Fprintf(&b, "var norouterProxy = %s;\n", jsString(proxy))
+	fmt.Fprintf(&b, "var norouterNames = %s;\n", jsStrings(names))
+	fmt.Fprintf(&b, "var norouterSuffixes = %s;\n", jsStrings(suffixes))
+	fmt.Fprintf(&b, "var norouterGlobs = %s;\n", jsStrings(globs))
+	b.WriteString("var norouterNets = [")
+	for i, n := range nets {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "[%s, %s]", jsString(n[0]), jsString(n[1]))
+	}
+	b.WriteString("];\n")
+	b.WriteString(`
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (host.charAt(host.length - 1) == ".") {
+    host = host.substring(0, host.length - 1);
+  }
+  var i;
+  for (i = 0; i < norouterNames.length; i++) {
+    if (host == norouterNames[i]) {
+      return norouterProxy;
+    }
+  }
+  for (i = 0; i < norouterSuffixes.length; i++) {
+    if (dnsDomainIs(host, norouterSuffixes[i]) && host != norouterSuffixes[i]) {
+      return norouterProxy;
+    }
+  }
+  for (i = 0; i < norouterGlobs.length; i++) {
+    if (shExpMatch(host, norouterGlobs[i])) {
+      return norouterProxy;
+    }
+  }
+  // Only IP literals are evaluated, to avoid resolving every hostname in the browser
+  if (/^[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+$/.test(host)) {
+    for (i = 0; i < norouterNets.length; i++) {
+      if (isInNet(host, norouterNets[i][0], norouterNets[i][1])) {
+        return norouterProxy;
+      }
+    }
+  }
+  return "DIRECT";
+}
+`)
+	return b.String()
+}
+
+func jsString(s string) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func jsStrings(ss []string) string {
+	if len(ss) == 0 {
+		return "[]"
+	}
+	b, err := json.Marshal(ss)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// Handler serves the PAC file on Path.
+type Handler struct {
+	HostnameMap map[string]net.IP
+	Routes      []jsonmsg.Route
+	// HTTPListen and SOCKSListen are the listen addresses of the proxies, e.g. "127.0.0.1:18080".
+	// When the host of the address is unspecified (e.g. "0.0.0.0:18080"),
+	// the host is taken from the Host header of the request.
+	HTTPListen  string
+	SOCKSListen string
+	// VIP, HTTPVIPPort, and SOCKSVIPPort are used when the request arrived on the VIP listener of the HTTP proxy,
+	// i.e., when the PAC file is requested by other hosts.
+	// The proxies without the VIP ports are not advertised to such requests, as the listen addresses are not
+	// reachable from other hosts.
+	// The zero port means that the proxy does not listen on the VIP.
+	VIP          net.IP
+	HTTPVIPPort  uint16
+	SOCKSVIPPort uint16
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != Path {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	httpAddr, socksAddr := proxyAddr(h.HTTPListen, req.Host), proxyAddr(h.SOCKSListen, req.Host)
+	if h.onVIP(req) {
+		httpAddr, socksAddr = vipAddr(h.VIP, h.HTTPVIPPort), vipAddr(h.VIP, h.SOCKSVIPPort)
+	}
+	var proxies []string
+	if httpAddr != "" {
+		proxies = append(proxies, "PROXY "+httpAddr)
+	}
+	if socksAddr != "" {
+		proxies = append(proxies, "SOCKS5 "+socksAddr, "SOCKS "+socksAddr)
+	}
+	w.Header().Set("Content-Type", ContentType)
+	if req.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write([]byte(Generate(h.HostnameMap, h.Routes, proxies))); err != nil {
+		logrus.WithError(err).Debug("pac: failed to write")
+	}
+}
+
+// onVIP returns true if req arrived on the VIP listener.
+func (h *Handler) onVIP(req *http.Request) bool {
+	if h.VIP == nil || h.HTTPVIPPort == 0 {
+		return false
+	}
+	local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return false
+	}
+	return h.VIP.Equal(net.ParseIP(host)) && port == strconv.Itoa(int(h.HTTPVIPPort))
+}
+
+func vipAddr(vip net.IP, port uint16) string {
+	if port == 0 {
+		return ""
+	}
+	return net.JoinHostPort(vip.String(), strconv.Itoa(int(port)))
+}
+
+// proxyAddr returns the address of the proxy listening on listen, as seen from the client that connected to reqHost.
+func proxyAddr(listen, reqHost string) string {
+	if listen == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = reqHost
+		if h, _, err := net.SplitHostPort(reqHost); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			host = "127.0.0.1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
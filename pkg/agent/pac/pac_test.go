@@ -0,0 +1,107 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pac
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"gotest.tools/v3/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	hostnameMap := map[string]net.IP{
+		"host1":   net.ParseIP("127.0.42.101"),
+		"*.host1": net.ParseIP("127.0.42.101"),
+		"Host2.":  net.ParseIP("127.0.42.102"),
+	}
+	routes := []jsonmsg.Route{
+		{
+			ToCIDR:         []string{"192.168.95.0/24", "127.0.42.102/32"},
+			ToHostnameGlob: []string{"*.cloud1.example.com"},
+			Via:            net.ParseIP("127.0.42.101"),
+		},
+	}
+	s := Generate(hostnameMap, routes, []string{"PROXY 127.0.0.1:18080"})
+	assert.Assert(t, strings.Contains(s, `var norouterProxy = "PROXY 127.0.0.1:18080";`), s)
+	assert.Assert(t, strings.Contains(s, `var norouterNames = ["host1","host2"];`), s)
+	assert.Assert(t, strings.Contains(s, `var norouterSuffixes = [".host1"];`), s)
+	assert.Assert(t, strings.Contains(s, `var norouterGlobs = ["*.cloud1.example.com"];`), s)
+	assert.Assert(t, strings.Contains(s,
+		`var norouterNets = [["127.0.42.101", "255.255.255.255"], ["127.0.42.102", "255.255.255.255"], ["192.168.95.0", "255.255.255.0"]];`), s)
+	assert.Assert(t, strings.Contains(s, "function FindProxyForURL(url, host)"), s)
+}
+
+func TestHandler(t *testing.T) {
+	h := &Handler{
+		HostnameMap: map[string]net.IP{"host1": net.ParseIP("127.0.42.101")},
+		HTTPListen:  "0.0.0.0:18080",
+		SOCKSListen: "127.0.0.1:18081",
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://192.168.1.10:18080/proxy.pac", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	assert.Assert(t, strings.Contains(rec.Body.String(),
+		`var norouterProxy = "PROXY 192.168.1.10:18080; SOCKS5 127.0.0.1:18081; SOCKS 127.0.0.1:18081";`), rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "http://192.168.1.10:18080/foo", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHandlerVIP(t *testing.T) {
+	h := &Handler{
+		HostnameMap:  map[string]net.IP{"host1": net.ParseIP("127.0.42.101")},
+		HTTPListen:   "127.0.0.1:18080",
+		SOCKSListen:  "127.0.0.1:18081",
+		VIP:          net.ParseIP("127.0.42.101"),
+		HTTPVIPPort:  8080,
+		SOCKSVIPPort: 1080,
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://127.0.42.101:8080/proxy.pac", nil)
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.42.101"), Port: 8080}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Assert(t, strings.Contains(rec.Body.String(),
+		`var norouterProxy = "PROXY 127.0.42.101:8080; SOCKS5 127.0.42.101:1080; SOCKS 127.0.42.101:1080";`), rec.Body.String())
+
+	// The SOCKS proxy that does not listen on the VIP is not advertised to the other hosts
+	h.SOCKSVIPPort = 0
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Assert(t, strings.Contains(rec.Body.String(),
+		`var norouterProxy = "PROXY 127.0.42.101:8080";`), rec.Body.String())
+
+	// The request on the real listener
+	req = httptest.NewRequest(http.MethodGet, "http://127.0.0.1:18080/proxy.pac", nil)
+	local = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 18080}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Assert(t, strings.Contains(rec.Body.String(),
+		`var norouterProxy = "PROXY 127.0.0.1:18080; SOCKS5 127.0.0.1:18081; SOCKS 127.0.0.1:18081";`), rec.Body.String())
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// CacheStats is the statistics of a cache.
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"` // including expirations and invalidations
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// cache is a size-bounded LRU cache with TTL.
+// A nil cache is valid, and caches nothing.
+type cache struct {
+	mu  sync.Mutex
+	lru *lru.Cache // key: string, value: *cacheEntry
+	// mirror exists because lru.Cache cannot be iterated
+	mirror map[string]*cacheEntry
+	now    func() time.Time
+	stats  CacheStats
+}
+
+func newCache(size int) *cache {
+	c := &cache{
+		lru:    lru.New(size),
+		mirror: make(map[string]*cacheEntry),
+		now:    time.Now,
+	}
+	c.lru.OnEvicted = func(k lru.Key, _ interface{}) {
+		delete(c.mirror, k.(string))
+		c.stats.Evictions++
+	}
+	return c
+}
+
+func (c *cache) get(k string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.lru.Get(k)
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	e := v.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(k)
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	return e.value, true
+}
+
+func (c *cache) put(k string, v interface{}, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	e := &cacheEntry{value: v, expires: c.now().Add(ttl)}
+	c.mu.Lock()
+	c.lru.Add(k, e)
+	c.mirror[k] = e
+	c.mu.Unlock()
+}
+
+// removeFunc removes the entries for which fn returns true.
+func (c *cache) removeFunc(fn func(k string, v interface{}) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.mirror {
+		if fn(k, e.value) {
+			c.lru.Remove(k)
+		}
+	}
+}
+
+func (c *cache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Entries = c.lru.Len()
+	return st
+}
@@ -0,0 +1,60 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := newCache(2)
+	c.now = func() time.Time { return now }
+
+	c.put("a", 1, time.Minute)
+	c.put("b", 2, time.Minute)
+	v, ok := c.get("a")
+	assert.Assert(t, ok)
+	assert.Equal(t, 1, v)
+
+	// "b" is the least recently used one
+	c.put("c", 3, time.Minute)
+	_, ok = c.get("b")
+	assert.Assert(t, !ok)
+
+	now = now.Add(2 * time.Minute)
+	_, ok = c.get("a")
+	assert.Assert(t, !ok)
+
+	assert.DeepEqual(t, CacheStats{Entries: 1, Hits: 1, Misses: 2, Evictions: 2}, c.Stats())
+
+	c.put("d", 4, time.Minute)
+	c.removeFunc(func(k string, v interface{}) bool { return v.(int) == 1 })
+	_, ok = c.get("a")
+	assert.Assert(t, !ok)
+	v, ok = c.get("d")
+	assert.Assert(t, ok)
+	assert.Equal(t, 4, v)
+
+	var nilCache *cache
+	nilCache.put("a", 1, time.Minute)
+	_, ok = nilCache.get("a")
+	assert.Assert(t, !ok)
+}
@@ -18,11 +18,13 @@ package resolver
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/norouter/norouter/pkg/agent/hostnamemap"
 	"github.com/norouter/norouter/pkg/router"
 	"github.com/norouter/norouter/pkg/stream"
 	"github.com/norouter/norouter/pkg/stream/jsonmsg"
@@ -34,87 +36,310 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
+const (
+	// DefaultCacheSize is the default size of the caches of the resolved addresses and the decisions.
+	DefaultCacheSize = 1024
+
+	// DefaultCacheTTL is the default TTL of the system resolver results and the decisions.
+	// The addresses resolved with the built-in DNS of other hosts are cached for the TTL of the DNS records,
+	// up to DefaultCacheTTL.
+	DefaultCacheTTL = 30 * time.Second
+)
+
+// Options is the options for NewWithOptions.
+type Options struct {
+	HostnameMap map[string]net.IP
+	Routes      []jsonmsg.Route
+	VIPs        []net.IP
+	Stack       *stack.Stack
+	NameServers []jsonmsg.NameServer
+	// DNSRecords are the custom DNS records.
+	DNSRecords []jsonmsg.DNSRecord
+	// EventSender is used for sending the route suggestions to the manager.
+	EventSender *stream.Sender
+	Egress      jsonmsg.Egress
+	// CacheSize is the size of the caches. Negative disables the caches.
+	// Zero means DefaultCacheSize.
+	CacheSize int
+	// CacheTTL is the TTL of the caches.
+	// Zero means DefaultCacheTTL.
+	CacheTTL time.Duration
+	// SkipSystemLookup skips looking up non-virtual hostnames with the system resolver
+	// for deciding whether the hostnames are interesting.
+	// When SkipSystemLookup is set, CIDR routes are not applied to the hostnames.
+	SkipSystemLookup bool
+}
+
 func New(hostnameMap map[string]net.IP, routes []jsonmsg.Route, vips []net.IP, st *stack.Stack, nameServers []jsonmsg.NameServer, eventSender *stream.Sender) (*Resolver, error) {
-	rt, err := router.New(routes, vips)
+	return NewWithOptions(&Options{
+		HostnameMap: hostnameMap,
+		Routes:      routes,
+		VIPs:        vips,
+		Stack:       st,
+		NameServers: nameServers,
+		EventSender: eventSender,
+	})
+}
+
+func NewWithOptions(opts *Options) (*Resolver, error) {
+	cacheSize := opts.CacheSize
+	if cacheSize == 0 {
+		cacheSize = DefaultCacheSize
+	}
+	cacheTTL := opts.CacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = DefaultCacheTTL
+	}
+	rt, err := router.New(opts.Routes, opts.VIPs)
 	if err != nil {
 		return nil, err
 	}
-	canonMap := make(map[string]net.IP)
-	for k, v := range hostnameMap {
-		canonMap[dns.CanonicalName(k)] = v
+	names := hostnamemap.New(opts.HostnameMap)
+	recordMap := make(map[string][]jsonmsg.DNSRecord)
+	for _, rec := range opts.DNSRecords {
+		canon := dns.CanonicalName(rec.Name)
+		recordMap[canon] = append(recordMap[canon], rec)
 	}
 	r := &Resolver{
 		router:      rt,
-		canonMap:    canonMap,
-		stack:       st,
-		nameServers: nameServers,
-		eventSender: eventSender,
+		names:       names,
+		canonMap:    names.Exact(),
+		recordMap:   recordMap,
+		stack:       opts.Stack,
+		nameServers: opts.NameServers,
+		eventSender: opts.EventSender,
+		egress:      opts.Egress,
+		cacheTTL:    cacheTTL,
+		skipLookup:  opts.SkipSystemLookup,
+	}
+	if cacheSize > 0 {
+		r.lookupCache = newCache(cacheSize)
+		r.decisionCache = newCache(cacheSize)
 	}
 	return r, nil
 }
 
 type Resolver struct {
 	router      *router.Router
-	canonMap    map[string]net.IP
+	names       *hostnamemap.Map
+	canonMap    map[string]net.IP              // non-wildcard names
+	recordMap   map[string][]jsonmsg.DNSRecord // key: canonical name
 	stack       *stack.Stack
 	nameServers []jsonmsg.NameServer
 	eventSender *stream.Sender
+	egress      jsonmsg.Egress
+	cacheTTL    time.Duration
+	skipLookup  bool
+	// lookupCache caches the resolved addresses. key: "system/<canon>" or "<via>/<canon>", value: *lookupResult
+	lookupCache *cache
+	// decisionCache caches the decisions of Explain for hostnames. key: "<canon>:<port>", value: *decision
+	decisionCache *cache
+}
+
+// decision is the cached decision of Explain.
+type decision struct {
+	x Explanation
+	// lookedUp is the addresses resolved with the system resolver, for invalidating the decision
+	// when the routes for the addresses are learnt.
+	lookedUp []net.IP
+}
+
+type lookupResult struct {
+	ips []net.IP
+	err error
+}
+
+// Stats is the statistics of the resolver.
+type Stats struct {
+	LookupCache   CacheStats `json:"lookupCache"`
+	DecisionCache CacheStats `json:"decisionCache"`
+}
+
+// Stats returns the statistics of the resolver.
+func (r *Resolver) Stats() Stats {
+	return Stats{
+		LookupCache:   r.lookupCache.Stats(),
+		DecisionCache: r.decisionCache.Stats(),
+	}
+}
+
+// lookupIP looks up req with the system resolver, or returns the cached result.
+// Errors are cached as well.
+func (r *Resolver) lookupIP(req string) ([]net.IP, error) {
+	k := "system/" + dns.CanonicalName(req)
+	if v, ok := r.lookupCache.get(k); ok {
+		res := v.(*lookupResult)
+		return res.ips, res.err
+	}
+	ips, err := net.LookupIP(req)
+	r.lookupCache.put(k, &lookupResult{ips: ips, err: err}, r.cacheTTL)
+	return ips, err
+}
+
+// DirectAllowed returns false if the destinations that are not interesting must not be dialed directly.
+func (r *Resolver) DirectAllowed() bool {
+	return !r.egress.DisableDirect
 }
 
 // Interesting returns true if req shouldn't be passed through to the OS.
 // i.e. the req should be dialed with gonet dial.
 // req must be either hostname or IP
-func (r *Resolver) Interesting(req string) bool {
+//
+// port is the TCP port to be dialed, for evaluating the routes with ports.
+// The zero port means an unknown port.
+func (r *Resolver) Interesting(req string, port uint16) bool {
+	return r.Explain(req, port).Interesting
+}
+
+// Explanation explains the decision of Interesting.
+type Explanation struct {
+	Interesting bool
+	// Reason is a human-readable string
+	Reason string
+}
+
+// maxCNAMEHops is the maximum number of the CNAME records to be chased.
+const maxCNAMEHops = 8
+
+// Explain explains the decision of Interesting.
+func (r *Resolver) Explain(req string, port uint16) Explanation {
+	return r.explain(req, port, 0)
+}
+
+func (r *Resolver) explain(req string, port uint16, hops int) Explanation {
 	reqAsIP := net.ParseIP(req)
 	reqCanon := dns.CanonicalName(req)
 	// The actual router is in manager.
 	// In agent, we only check whether it is in the routes config or not
-	routeRes := r.router.Route(reqAsIP)
-	routeWithHostnameRes := r.router.RouteWithHostname(reqCanon)
+	routeRes := r.router.RouteWithPort(reqAsIP, port)
+	routeWithHostnameX := r.router.ExplainWithHostname(reqCanon, port)
+	routeWithHostnameRes := routeWithHostnameX.Via
 	for canon, ip := range r.canonMap {
 		if reqCanon == canon {
-			return true
+			return Explanation{true, fmt.Sprintf("%q is a virtual hostname of %s", req, ip)}
 		}
 		if ip.Equal(reqAsIP) {
-			return true
+			return Explanation{true, fmt.Sprintf("%s is a virtual IP", ip)}
 		}
 		if ip.Equal(routeRes) {
-			return true
+			return Explanation{true, fmt.Sprintf("%s is routed via %s", req, ip)}
 		}
 		if ip.Equal(routeWithHostnameRes) {
-			return true
+			return Explanation{true, fmt.Sprintf("%q is routed via %s", req, ip)}
 		}
 	}
 
+	if reqAsIP == nil {
+		if ip, ok := r.names.LookupWildcard(reqCanon); ok {
+			return Explanation{true, fmt.Sprintf("%q matches a virtual wildcard hostname of %s", req, ip)}
+		}
+	}
+
+	if x, ok := r.explainRecords(req, reqCanon, port, hops); ok {
+		return x
+	}
+
+	if r.egress.Via != nil {
+		return Explanation{true, fmt.Sprintf("%s is not a virtual host, and routed via the egress host %s", req, r.egress.Via)}
+	}
+
 	// if req is a hostname, try resolve it, and see whether the resolved IP
 	// is interesting.
 	if reqAsIP == nil {
-		if lookedUp, err := net.LookupIP(req); err == nil {
-			for _, ip := range lookedUp {
-				if x := r.Interesting(ip.String()); x {
-					return true
-				}
+		if r.skipLookup {
+			return Explanation{false, fmt.Sprintf("%q is not a virtual hostname, and looking up with the system resolver is skipped", req)}
+		}
+		k := fmt.Sprintf("%s:%d", reqCanon, port)
+		if v, ok := r.decisionCache.get(k); ok {
+			return v.(*decision).x
+		}
+		x, lookedUp := r.explainLookedUp(req, port)
+		r.decisionCache.put(k, &decision{x: x, lookedUp: lookedUp}, r.cacheTTL)
+		return x
+	}
+	return Explanation{false, fmt.Sprintf("%s is not a virtual IP, and not routed via a virtual IP", req)}
+}
+
+// explainLookedUp explains the decision for the non-virtual hostname req, by looking up req with the system resolver.
+// explainLookedUp also returns the looked up addresses.
+func (r *Resolver) explainLookedUp(req string, port uint16) (Explanation, []net.IP) {
+	lookedUp, err := r.lookupIP(req)
+	if err != nil {
+		return Explanation{false, fmt.Sprintf("%q is not a virtual hostname, and could not be resolved with the system resolver: %v", req, err)}, nil
+	}
+	for _, ip := range lookedUp {
+		if x := r.Explain(ip.String(), port); x.Interesting {
+			return Explanation{true, fmt.Sprintf("%q resolves to %s with the system resolver, and %s", req, ip, x.Reason)}, lookedUp
+		}
+	}
+	return Explanation{false, fmt.Sprintf("%q resolves to %v with the system resolver, but none of them is a virtual IP or routed via a virtual IP", req, lookedUp)}, lookedUp
+}
+
+// explainRecords explains the decision for the custom DNS records.
+// explainRecords returns false if reqCanon has neither A nor CNAME records.
+func (r *Resolver) explainRecords(req, reqCanon string, port uint16, hops int) (Explanation, bool) {
+	var (
+		found   bool
+		reasons []string
+	)
+	for _, rec := range r.recordMap[reqCanon] {
+		switch rec.Type {
+		case jsonmsg.DNSRecordTypeA, jsonmsg.DNSRecordTypeCNAME:
+			found = true
+			if hops >= maxCNAMEHops {
+				return Explanation{false, fmt.Sprintf("%q has too many CNAME hops", req)}, true
 			}
+			x := r.explain(rec.Value, port, hops+1)
+			if x.Interesting {
+				return Explanation{true, fmt.Sprintf("%q is a DNS record (%s %s), and %s", req, rec.Type, rec.Value, x.Reason)}, true
+			}
+			reasons = append(reasons, x.Reason)
 		}
 	}
-	return false
+	if !found {
+		return Explanation{}, false
+	}
+	return Explanation{false, fmt.Sprintf("%q is a DNS record, but %s", req, strings.Join(reasons, "; "))}, true
 }
 
 // Resolve must be called only when r.Interesting() returned true.
 // Behavior of Resolve is undefined when r.Interesteing() returned false.
-func (r *Resolver) Resolve(req string) (net.IP, error) {
+func (r *Resolver) Resolve(req string, port uint16) (net.IP, error) {
+	return r.resolve(req, port, 0)
+}
+
+func (r *Resolver) resolve(req string, port uint16, hops int) (net.IP, error) {
 	if reqAsIP := net.ParseIP(req); reqAsIP != nil {
 		return reqAsIP, nil
 	}
 	reqCanon := dns.CanonicalName(req)
-	for canon, ip := range r.canonMap {
-		if reqCanon == canon {
-			return ip, nil
+	if ip, ok := r.names.Lookup(reqCanon); ok {
+		return ip, nil
+	}
+	for _, rec := range r.recordMap[reqCanon] {
+		switch rec.Type {
+		case jsonmsg.DNSRecordTypeA, jsonmsg.DNSRecordTypeCNAME:
+			if hops >= maxCNAMEHops {
+				return nil, fmt.Errorf("too many CNAME hops for %q", req)
+			}
+			if r.explain(rec.Value, port, hops+1).Interesting {
+				return r.resolve(rec.Value, port, hops+1)
+			}
 		}
 	}
-	routeWithHostnameRes := r.router.RouteWithHostname(reqCanon)
+	routeWithHostnameX := r.router.ExplainWithHostname(reqCanon, port)
+	routeWithHostnameRes := routeWithHostnameX.Via
+	if routeWithHostnameRes == nil && r.egress.Via != nil {
+		// The route is not learnt, as the manager routes the packets via the egress host
+		// only for this host, not for other hosts
+		res, _, err := r.resolveWithGonet(req, r.egress.Via)
+		if err != nil {
+			return nil, err
+		}
+		return res[0], nil
+	}
 	if routeWithHostnameRes == nil {
-		lookedUp, err := net.LookupIP(req)
+		lookedUp, err := r.lookupIP(req)
 		if err != nil {
 			return nil, err
 		}
@@ -125,42 +350,139 @@ func (r *Resolver) Resolve(req string) (net.IP, error) {
 		}
 		return nil, fmt.Errorf("failed to resolve %q", req)
 	}
-	for _, ns := range r.nameServers {
-		if ns.IP.Equal(routeWithHostnameRes) && ns.Proto == "tcp" {
-			res, err := resolveWithGonetTCP(r.stack, req, ns.IP, ns.Port)
-			if err != nil {
-				return nil, err
-			}
-			r.router.Learn(res, routeWithHostnameRes, true)
-			routeSuggestion := jsonmsg.RouteSuggestionEventData{
-				IP:    res,
-				Route: routeWithHostnameRes,
-			}
-			if err := sendRouteSuggestionEvent(r.eventSender, &routeSuggestion); err != nil {
-				logrus.WithError(err).Warn("failed to send RouteSuggestion event")
+	res, cached, err := r.resolveWithGonet(req, routeWithHostnameRes)
+	if err != nil {
+		return nil, err
+	}
+	if !cached {
+		r.learn(res, routeWithHostnameRes, routeWithHostnameX.Ports)
+	}
+	// TODO: shuffle?
+	return res[0], nil
+}
+
+// learn learns the route for res, and suggests the route to the manager.
+// ports is the ports of the hostname glob route that via was derived from.
+//
+// The addresses that have been already learnt with the same route within the cache TTL are skipped,
+// so that the manager is not flooded with the suggestions for every forwarded DNS answer.
+// The cached decisions for the hostnames that resolve to the learnt addresses are invalidated.
+func (r *Resolver) learn(res []net.IP, via net.IP, ports []jsonmsg.PortRange) {
+	var learnt []net.IP
+	for _, ip := range res {
+		if lr, ok := r.router.LookupLearnt(ip); ok && lr.Via.Equal(via) && portRangesEqual(lr.Ports, ports) &&
+			time.Since(lr.Learnt) < r.cacheTTL {
+			continue
+		}
+		learnt = append(learnt, ip)
+	}
+	if len(learnt) == 0 {
+		return
+	}
+	r.router.LearnWithPorts(learnt, via, ports, true)
+	r.decisionCache.removeFunc(func(_ string, v interface{}) bool {
+		for _, ip := range v.(*decision).lookedUp {
+			for _, l := range learnt {
+				if ip.Equal(l) {
+					return true
+				}
 			}
-			// TODO: shuffle?
-			return res[0], nil
 		}
+		return false
+	})
+	routeSuggestion := jsonmsg.RouteSuggestionEventData{
+		IP:    learnt,
+		Route: via,
+		Ports: ports,
+	}
+	if err := r.eventSender.SendEvent(jsonmsg.EventTypeRouteSuggestion, &routeSuggestion); err != nil {
+		logrus.WithError(err).Warn("failed to send RouteSuggestion event")
 	}
-	return nil, fmt.Errorf("no gonet DNS found for %q", req)
 }
 
-func resolveWithGonetTCP(st *stack.Stack, query string, srv net.IP, port uint16) ([]net.IP, error) {
-	fullAddr := tcpip.FullAddress{
-		Addr: tcpip.Address(srv),
-		Port: port,
+func portRangesEqual(a, b []jsonmsg.PortRange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ForwardDNS forwards req to the built-in DNS of the host that the queried name is routed via,
+// so that the names such as "db.corp.internal" can be resolved by the bastion.
+// The IP addresses in the reply are learnt as routes, as in Resolve.
+//
+// ForwardDNS returns nil if the queried name is not routed via other hosts than me.
+// The routes restricted with ports are not used, as the port is unknown.
+func (r *Resolver) ForwardDNS(req *dns.Msg, me net.IP) (*dns.Msg, error) {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return nil, nil
 	}
-	conn, err := gonet.DialContextTCP(context.TODO(), st, fullAddr, ipv4.ProtocolNumber)
+	via := r.router.RouteWithHostname(dns.CanonicalName(req.Question[0].Name))
+	if via == nil || via.Equal(me) {
+		return nil, nil
+	}
+	ns, ok := r.nameServerOf(via)
+	if !ok {
+		return nil, fmt.Errorf("no gonet DNS found for %q (the built-in DNS of %s may be disabled)", req.Question[0].Name, via)
+	}
+	reply, err := exchangeWithGonet(r.stack, req, ns)
 	if err != nil {
 		return nil, err
 	}
-	dnsConn := &dns.Conn{
-		Conn: conn,
+	var res []net.IP
+	for _, rr := range reply.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			res = append(res, a.A)
+		}
 	}
-	client := &dns.Client{
-		Net: "tcp",
+	if len(res) != 0 {
+		r.learn(res, via, nil)
+	}
+	return reply, nil
+}
+
+// resolveWithGonet resolves req using the built-in DNS of via, or returns the cached result.
+// The result is cached for the TTL of the DNS records, up to r.cacheTTL.
+func (r *Resolver) resolveWithGonet(req string, via net.IP) (res []net.IP, cached bool, err error) {
+	k := via.String() + "/" + dns.CanonicalName(req)
+	if v, ok := r.lookupCache.get(k); ok {
+		return v.(*lookupResult).ips, true, nil
+	}
+	ns, ok := r.nameServerOf(via)
+	if !ok {
+		return nil, false, fmt.Errorf("no gonet DNS found for %q (the built-in DNS of %s may be disabled)", req, via)
+	}
+	res, ttl, err := resolveWithGonetConn(r.stack, req, ns)
+	if err != nil {
+		return nil, false, err
+	}
+	if ttl > r.cacheTTL {
+		ttl = r.cacheTTL
+	}
+	r.lookupCache.put(k, &lookupResult{ips: res}, ttl)
+	return res, false, nil
+}
+
+// nameServerOf returns the built-in DNS of via.
+// TCP is preferred over UDP, as the DNS over TCP does not need to care about truncation.
+func (r *Resolver) nameServerOf(via net.IP) (jsonmsg.IPPortProto, bool) {
+	for _, proto := range []string{"tcp", "udp"} {
+		for _, ns := range r.nameServers {
+			if ns.IP.Equal(via) && ns.Proto == proto {
+				return ns.IPPortProto, true
+			}
+		}
 	}
+	return jsonmsg.IPPortProto{}, false
+}
+
+// resolveWithGonetConn returns the resolved addresses and the minimum TTL of them.
+func resolveWithGonetConn(st *stack.Stack, query string, ns jsonmsg.IPPortProto) ([]net.IP, time.Duration, error) {
 	req := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Opcode:           dns.OpcodeQuery,
@@ -175,46 +497,56 @@ func resolveWithGonetTCP(st *stack.Stack, query string, srv net.IP, port uint16)
 			},
 		},
 	}
-	reply, _, err := client.ExchangeWithConn(req, dnsConn)
+	reply, err := exchangeWithGonet(st, req, ns)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	var res []net.IP
+	var (
+		res []net.IP
+		ttl = ^uint32(0)
+	)
 	for _, rr := range reply.Answer {
 		if a, ok := rr.(*dns.A); ok {
 			res = append(res, a.A)
+			if a.Hdr.Ttl < ttl {
+				ttl = a.Hdr.Ttl
+			}
 		}
 	}
 	if len(res) == 0 {
-		return nil, fmt.Errorf("failed to lookup %q with gonet DNS %s:%d/tcp: reply=%+v", query, srv.String(), port, reply)
+		return nil, 0, fmt.Errorf("failed to lookup %q with gonet DNS %s:%d/%s: reply=%+v", query, ns.IP.String(), ns.Port, ns.Proto, reply)
 	}
-	return res, nil
+	return res, time.Duration(ttl) * time.Second, nil
 }
 
-func sendRouteSuggestionEvent(sender *stream.Sender, dat *jsonmsg.RouteSuggestionEventData) error {
-	datJSON, err := json.Marshal(dat)
-	if err != nil {
-		return err
+// exchangeWithGonet sends req to the built-in DNS ns over the netstack.
+func exchangeWithGonet(st *stack.Stack, req *dns.Msg, ns jsonmsg.IPPortProto) (*dns.Msg, error) {
+	fullAddr := tcpip.FullAddress{
+		Addr: tcpip.Address(ns.IP),
+		Port: ns.Port,
 	}
-	ev := jsonmsg.Event{
-		Type: jsonmsg.EventTypeRouteSuggestion,
-		Data: datJSON,
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch ns.Proto {
+	case "tcp":
+		conn, err = gonet.DialContextTCP(context.TODO(), st, fullAddr, ipv4.ProtocolNumber)
+	case "udp":
+		conn, err = gonet.DialUDP(st, nil, &fullAddr, ipv4.ProtocolNumber)
+	default:
+		err = fmt.Errorf("unexpected proto %q", ns.Proto)
 	}
-	evJSON, err := json.Marshal(ev)
 	if err != nil {
-		return err
-	}
-	msg := jsonmsg.Message{
-		Type: jsonmsg.TypeEvent,
-		Body: evJSON,
+		return nil, err
 	}
-	msgJSON, err := json.Marshal(msg)
-	if err != nil {
-		return err
+	defer conn.Close()
+	dnsConn := &dns.Conn{
+		Conn: conn,
 	}
-	pkt := &stream.Packet{
-		Type:    stream.TypeJSON,
-		Payload: msgJSON,
+	client := &dns.Client{
+		Net: ns.Proto,
 	}
-	return sender.Send(pkt)
+	reply, _, err := client.ExchangeWithConn(req, dnsConn)
+	return reply, err
 }
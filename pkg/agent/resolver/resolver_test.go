@@ -0,0 +1,70 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/norouter/norouter/pkg/stream"
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"gotest.tools/v3/assert"
+)
+
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n++
+	return len(p), nil
+}
+
+func TestLearn(t *testing.T) {
+	via1, via2 := net.ParseIP("127.0.42.101"), net.ParseIP("127.0.42.102")
+	routes := []jsonmsg.Route{
+		{
+			ToHostnameGlob: []string{"*.internal.example.com"},
+			Via:            via1,
+		},
+	}
+	w := &countingWriter{}
+	rv, err := New(nil, routes, []net.IP{via1, via2}, nil, nil, &stream.Sender{Writer: w})
+	assert.NilError(t, err)
+	rv.decisionCache.put("a.example.com.:0", &decision{lookedUp: []net.IP{net.ParseIP("10.0.0.1")}}, rv.cacheTTL)
+	rv.decisionCache.put("b.example.com.:0", &decision{lookedUp: []net.IP{net.ParseIP("10.0.0.2")}}, rv.cacheTTL)
+
+	rv.learn([]net.IP{net.ParseIP("10.0.0.1")}, via1, nil)
+	assert.Equal(t, 1, w.n)
+	assert.Equal(t, via1.String(), rv.router.Route(net.ParseIP("10.0.0.1")).String())
+	// Only the decision that depends on the learnt address is invalidated
+	_, ok := rv.decisionCache.get("a.example.com.:0")
+	assert.Assert(t, !ok)
+	_, ok = rv.decisionCache.get("b.example.com.:0")
+	assert.Assert(t, ok)
+
+	// The route that is already learnt is not suggested again
+	rv.learn([]net.IP{net.ParseIP("10.0.0.1")}, via1, nil)
+	assert.Equal(t, 1, w.n)
+
+	// The route that has changed is suggested again
+	rv.learn([]net.IP{net.ParseIP("10.0.0.1")}, via2, nil)
+	assert.Equal(t, 2, w.n)
+	assert.Equal(t, via2.String(), rv.router.Route(net.ParseIP("10.0.0.1")).String())
+	rv.learn([]net.IP{net.ParseIP("10.0.0.1")}, via2, []jsonmsg.PortRange{{Start: 22, End: 22}})
+	assert.Equal(t, 3, w.n)
+}
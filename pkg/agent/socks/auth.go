@@ -0,0 +1,139 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package socks
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+)
+
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xFF
+
+	userPassVersion = 0x01 // RFC 1929
+	userPassSuccess = 0x00
+	userPassFailure = 0x01
+
+	socks4Rejected = 0x5B
+
+	// authTimeout is the timeout of the authentication handshake.
+	authTimeout = 30 * time.Second
+)
+
+// NewAuthListener returns a listener that requires SOCKS5 username/password authentication (RFC 1929).
+// SOCKS4 and SOCKS4a clients are rejected, as they cannot send passwords.
+//
+// The connections returned by Accept have been already authenticated, and are presented to
+// the SOCKS server as SOCKS5 connections that do not require authentication.
+// NewAuthListener returns l as is when auth is nil.
+func NewAuthListener(l net.Listener, auth *jsonmsg.ProxyAuth) net.Listener {
+	if auth == nil {
+		return l
+	}
+	return newHandshakeListener(l, func(c net.Conn) (net.Conn, error) {
+		return authenticate(c, auth)
+	})
+}
+
+// authenticate authenticates the client with RFC 1929.
+// The returned connection replays a SOCKS5 greeting without authentication for the SOCKS server,
+// and discards the reply of the greeting.
+func authenticate(c net.Conn, auth *jsonmsg.ProxyAuth) (net.Conn, error) {
+	if err := c.SetDeadline(time.Now().Add(authTimeout)); err != nil {
+		return nil, err
+	}
+	var ver [1]byte
+	if _, err := io.ReadFull(c, ver[:]); err != nil {
+		return nil, err
+	}
+	switch ver[0] {
+	case socks5Version:
+	case socks4Version:
+		// VN=0, CD=91 (rejected), DSTPORT, DSTIP
+		c.Write([]byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return nil, errors.New("SOCKS4 is not supported when authentication is required")
+	default:
+		return nil, fmt.Errorf("unexpected SOCKS version %d", ver[0])
+	}
+	methods, err := readBytes(c)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(methods, socks5AuthUserPass) < 0 {
+		c.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return nil, errors.New("the client does not support username/password authentication")
+	}
+	if _, err := c.Write([]byte{socks5Version, socks5AuthUserPass}); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, ver[:]); err != nil {
+		return nil, err
+	}
+	if ver[0] != userPassVersion {
+		return nil, fmt.Errorf("unexpected username/password authentication version %d", ver[0])
+	}
+	username, err := readBytes(c)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readBytes(c)
+	if err != nil {
+		return nil, err
+	}
+	userOK := subtle.ConstantTimeCompare(username, []byte(auth.Username)) == 1
+	passOK := subtle.ConstantTimeCompare(password, []byte(auth.Password)) == 1
+	if !userOK || !passOK {
+		c.Write([]byte{userPassVersion, userPassFailure})
+		return nil, fmt.Errorf("authentication failed for user %q", username)
+	}
+	if _, err := c.Write([]byte{userPassVersion, userPassSuccess}); err != nil {
+		return nil, err
+	}
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &replayConn{
+		Conn: c,
+		r:    io.MultiReader(bytes.NewReader([]byte{socks5Version, 1, socks5AuthNone}), c),
+		skip: 2, // VER, METHOD
+	}, nil
+}
+
+// readBytes reads a length-prefixed byte string.
+func readBytes(r io.Reader) ([]byte, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"gotest.tools/v3/assert"
+)
+
+type authResult struct {
+	conn net.Conn
+	err  error
+}
+
+func startAuthenticate(t *testing.T, auth *jsonmsg.ProxyAuth) (net.Conn, chan authResult) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	ch := make(chan authResult, 1)
+	go func() {
+		c, err := authenticate(server, auth)
+		ch <- authResult{c, err}
+	}()
+	return client, ch
+}
+
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	assert.NilError(t, err)
+	return b
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := &jsonmsg.ProxyAuth{Username: "foo", Password: "bar"}
+	client, ch := startAuthenticate(t, auth)
+
+	_, err := client.Write([]byte{5, 2, 0, 2})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{5, 2}, readN(t, client, 2))
+	_, err = client.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{1, 0}, readN(t, client, 2))
+
+	res := <-ch
+	assert.NilError(t, res.err)
+	// The SOCKS server sees a greeting without authentication
+	assert.DeepEqual(t, []byte{5, 1, 0}, readN(t, res.conn, 3))
+	// The reply of the greeting is discarded
+	go func() {
+		res.conn.Write([]byte{5, 0})
+		res.conn.Write([]byte{5, 0, 0, 1})
+	}()
+	assert.DeepEqual(t, []byte{5, 0, 0, 1}, readN(t, client, 4))
+}
+
+func TestAuthenticateWrongPassword(t *testing.T) {
+	auth := &jsonmsg.ProxyAuth{Username: "foo", Password: "bar"}
+	client, ch := startAuthenticate(t, auth)
+
+	_, err := client.Write([]byte{5, 1, 2})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{5, 2}, readN(t, client, 2))
+	_, err = client.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{1, 1}, readN(t, client, 2))
+	assert.ErrorContains(t, (<-ch).err, "authentication failed")
+}
+
+func TestAuthenticateNoAuthMethod(t *testing.T) {
+	auth := &jsonmsg.ProxyAuth{Username: "foo", Password: "bar"}
+	client, ch := startAuthenticate(t, auth)
+
+	_, err := client.Write([]byte{5, 1, 0})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{5, 0xFF}, readN(t, client, 2))
+	assert.ErrorContains(t, (<-ch).err, "does not support username/password")
+}
+
+func TestAuthenticateSOCKS4(t *testing.T) {
+	auth := &jsonmsg.ProxyAuth{Username: "foo", Password: "bar"}
+	client, ch := startAuthenticate(t, auth)
+
+	_, err := client.Write([]byte{4})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{0, 0x5B, 0, 0, 0, 0, 0, 0}, readN(t, client, 8))
+	assert.ErrorContains(t, (<-ch).err, "SOCKS4 is not supported")
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/norouter/norouter/pkg/accesslog"
+	"github.com/norouter/norouter/pkg/agent/bicopy"
+	"github.com/norouter/norouter/pkg/agent/resolver"
+	"github.com/norouter/norouter/pkg/policy"
+
+	"github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// BindTimeout is the timeout of waiting for the incoming connection of a SOCKS5 BIND request.
+const BindTimeout = 2 * time.Minute
+
+// NewBindListener returns a listener that handles SOCKS5 BIND requests (RFC 1928).
+// For each request, a temporary listener is opened on an ephemeral port of me in the netstack,
+// so that the other hosts can connect to it over the mesh.
+// The temporary listener accepts only one connection, and is closed after BindTimeout.
+//
+// When DST.ADDR of the request is a virtual host, only the connection from that host is accepted.
+// When DST.ADDR is 0.0.0.0, the connection from any virtual host is accepted.
+// Connections that violate pol are refused.
+//
+// The other requests are passed to the SOCKS server, see newCommandListener.
+//
+// logger is optional, and logs the connections when they are closed.
+func NewBindListener(l net.Listener, st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, logger accesslog.Logger) net.Listener {
+	b := &binder{
+		listen: func() (net.Listener, error) {
+			fullAddr := tcpip.FullAddress{
+				Addr: tcpip.Address(me.To4()),
+			}
+			return gonet.ListenTCP(st, fullAddr, ipv4.ProtocolNumber)
+		},
+		resolvePeer: func(host string, port uint16) (net.IP, error) {
+			if !rv.Interesting(host, port) {
+				return nil, fmt.Errorf("%q is not a virtual host", host)
+			}
+			return rv.Resolve(host, port)
+		},
+		checkPeer: func(peer net.IP, port uint16) error {
+			return pol.CheckDial(peer, me, port)
+		},
+		logger:  logger,
+		timeout: BindTimeout,
+	}
+	return newBindListener(l, b)
+}
+
+func newBindListener(l net.Listener, b *binder) net.Listener {
+	return newCommandListener(l, socks5CmdBind, b.serve)
+}
+
+type binder struct {
+	// listen opens a temporary listener.
+	listen func() (net.Listener, error)
+	// resolvePeer resolves DST.ADDR of the request.
+	resolvePeer func(host string, port uint16) (net.IP, error)
+	// checkPeer checks whether the connection from peer to port is allowed.
+	checkPeer func(peer net.IP, port uint16) error
+	logger    accesslog.Logger // optional
+	timeout   time.Duration
+}
+
+// serve serves the BIND request for the connection from host.
+// port is ignored, as the source port of the incoming connection is usually unknown to the client.
+func (b *binder) serve(c net.Conn, host string, port uint16) {
+	defer c.Close()
+	var peer net.IP
+	if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+		var err error
+		peer, err = b.resolvePeer(host, port)
+		if err != nil {
+			logrus.WithError(err).Warnf("refusing SOCKS5 BIND from %s", c.RemoteAddr())
+			c.Write(socks5Reply(socks5ReplyNotAllowed, nil, 0))
+			return
+		}
+	}
+	l, err := b.listen()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to listen for SOCKS5 BIND")
+		c.Write(socks5Reply(socks5ReplyGeneralFailure, nil, 0))
+		return
+	}
+	defer l.Close()
+	bnd, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		logrus.Warnf("unexpected listener address %v for SOCKS5 BIND", l.Addr())
+		c.Write(socks5Reply(socks5ReplyGeneralFailure, nil, 0))
+		return
+	}
+	if _, err := c.Write(socks5Reply(socks5ReplySucceeded, bnd.IP, bnd.Port)); err != nil {
+		return
+	}
+	start := time.Now()
+	accepted, err := b.accept(c, l, peer, uint16(bnd.Port))
+	if err != nil {
+		logrus.WithError(err).Debugf("failed to accept SOCKS5 BIND on %s", bnd)
+		c.Write(socks5Reply(socks5ReplyTTLExpired, nil, 0))
+		return
+	}
+	l.Close()
+	from, _ := accepted.RemoteAddr().(*net.TCPAddr)
+	if from == nil {
+		from = &net.TCPAddr{}
+	}
+	if _, err := c.Write(socks5Reply(socks5ReplySucceeded, from.IP, from.Port)); err != nil {
+		accepted.Close()
+		return
+	}
+	var conn net.Conn = accepted
+	if b.logger != nil {
+		e := &accesslog.Entry{
+			Time:        start,
+			Proxy:       "socks",
+			Client:      c.RemoteAddr().String(),
+			Method:      "BIND",
+			Proto:       "SOCKS5",
+			Destination: bnd.String(),
+			VIP:         from.IP,
+			Mesh:        true,
+		}
+		conn = &loggedConn{Conn: accepted, entry: e, logger: b.logger}
+	}
+	bicopy.Bicopy(c, conn, nil)
+}
+
+// accept accepts the first connection from peer (any virtual host if nil) that conforms to the policies.
+// accept fails when c is closed by the client, or when b.timeout elapses.
+func (b *binder) accept(c net.Conn, l net.Listener, peer net.IP, port uint16) (net.Conn, error) {
+	// The client must not send anything until the second reply, so the reads only detect the closure
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		if _, err := io.Copy(io.Discard, c); err == nil || !isTimeout(err) {
+			l.Close()
+		}
+	}()
+	defer func() {
+		// Stop the watcher without closing c
+		c.SetReadDeadline(time.Now())
+		<-watchDone
+		c.SetReadDeadline(time.Time{})
+	}()
+	timer := time.AfterFunc(b.timeout, func() { l.Close() })
+	defer timer.Stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil, err
+		}
+		from, _ := conn.RemoteAddr().(*net.TCPAddr)
+		if from == nil {
+			conn.Close()
+			continue
+		}
+		if peer != nil && !peer.Equal(from.IP) {
+			logrus.Debugf("refusing SOCKS5 BIND connection from %s (expected %s)", from, peer)
+			conn.Close()
+			continue
+		}
+		if err := b.checkPeer(from.IP, port); err != nil {
+			logrus.WithError(err).Warnf("refusing SOCKS5 BIND connection from %s", from)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,180 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package socks
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/norouter/norouter/pkg/accesslog"
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"gotest.tools/v3/assert"
+)
+
+func startBindListener(t *testing.T, b *binder) string {
+	tcpL, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	l := newBindListener(tcpL, b)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	return tcpL.Addr().String()
+}
+
+func newTestBinder(timeout time.Duration, logger accesslog.Logger) *binder {
+	return &binder{
+		listen: func() (net.Listener, error) {
+			return net.Listen("tcp", "127.0.0.1:0")
+		},
+		resolvePeer: func(host string, port uint16) (net.IP, error) {
+			if host != "host1" {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return net.IPv4(127, 0, 0, 1), nil
+		},
+		checkPeer: func(peer net.IP, port uint16) error {
+			return nil
+		},
+		logger:  logger,
+		timeout: timeout,
+	}
+}
+
+func sendBindRequest(t *testing.T, addr string, host string) net.Conn {
+	control, err := net.Dial("tcp", addr)
+	assert.NilError(t, err)
+	t.Cleanup(func() { control.Close() })
+	_, err = control.Write([]byte{5, 1, 0})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{5, 0}, readN(t, control, 2))
+	req := append([]byte{5, 2, 0, 3, byte(len(host))}, host...)
+	_, err = control.Write(append(req, 0, 21))
+	assert.NilError(t, err)
+	return control
+}
+
+func TestBind(t *testing.T) {
+	logged := make(chan *accesslog.Entry, 1)
+	logger := accesslog.LoggerFunc(func(e *accesslog.Entry) { logged <- e })
+	addr := startBindListener(t, newTestBinder(10*time.Second, logger))
+	control := sendBindRequest(t, addr, "host1")
+
+	reply := readN(t, control, 10)
+	assert.DeepEqual(t, []byte{5, 0, 0, 1, 127, 0, 0, 1}, reply[:8])
+	bndPort := int(reply[8])<<8 | int(reply[9])
+
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bndPort)))
+	assert.NilError(t, err)
+	defer peer.Close()
+	reply = readN(t, control, 10)
+	assert.DeepEqual(t, []byte{5, 0, 0, 1, 127, 0, 0, 1}, reply[:8])
+	assert.Equal(t, peer.LocalAddr().(*net.TCPAddr).Port, int(reply[8])<<8|int(reply[9]))
+
+	_, err = io.WriteString(peer, "hello")
+	assert.NilError(t, err)
+	assert.Equal(t, "hello", string(readN(t, control, 5)))
+	_, err = io.WriteString(control, "world")
+	assert.NilError(t, err)
+	assert.Equal(t, "world", string(readN(t, peer, 5)))
+
+	peer.Close()
+	control.Close()
+	select {
+	case e := <-logged:
+		assert.Equal(t, "BIND", e.Method)
+		assert.Equal(t, int64(5), e.Bytes)
+		assert.Equal(t, "127.0.0.1", e.VIP.String())
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the access log")
+	}
+}
+
+func TestBindNotAllowed(t *testing.T) {
+	addr := startBindListener(t, newTestBinder(10*time.Second, nil))
+	control := sendBindRequest(t, addr, "example.com")
+	assert.DeepEqual(t, []byte{5, socks5ReplyNotAllowed}, readN(t, control, 2))
+}
+
+func TestBindTimeout(t *testing.T) {
+	addr := startBindListener(t, newTestBinder(100*time.Millisecond, nil))
+	control := sendBindRequest(t, addr, "0.0.0.0")
+	assert.DeepEqual(t, []byte{5, 0}, readN(t, control, 10)[:2])
+	assert.DeepEqual(t, []byte{5, socks5ReplyTTLExpired}, readN(t, control, 2))
+}
+
+func TestBindAuth(t *testing.T) {
+	tcpL, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	auth := &jsonmsg.ProxyAuth{Username: "foo", Password: "bar"}
+	l := newBindListener(NewAuthListener(tcpL, auth), newTestBinder(10*time.Second, nil))
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	control, err := net.Dial("tcp", tcpL.Addr().String())
+	assert.NilError(t, err)
+	defer control.Close()
+	_, err = control.Write([]byte{5, 1, 2})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{5, 2}, readN(t, control, 2))
+	_, err = control.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{1, 0}, readN(t, control, 2))
+	// The reply of the greeting replayed by the auth listener must not be sent to the client
+	_, err = control.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0})
+	assert.NilError(t, err)
+	reply := readN(t, control, 10)
+	assert.DeepEqual(t, []byte{5, 0, 0, 1, 127, 0, 0, 1}, reply[:8])
+	bndPort := int(reply[8])<<8 | int(reply[9])
+
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bndPort)))
+	assert.NilError(t, err)
+	defer peer.Close()
+	assert.DeepEqual(t, []byte{5, 0}, readN(t, control, 10)[:2])
+	_, err = io.WriteString(peer, "hello")
+	assert.NilError(t, err)
+	assert.Equal(t, "hello", string(readN(t, control, 5)))
+}
+
+func TestBindAuthNoAuthMethod(t *testing.T) {
+	tcpL, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	auth := &jsonmsg.ProxyAuth{Username: "foo", Password: "bar"}
+	l := newBindListener(NewAuthListener(tcpL, auth), newTestBinder(10*time.Second, nil))
+	defer l.Close()
+
+	control, err := net.Dial("tcp", tcpL.Addr().String())
+	assert.NilError(t, err)
+	defer control.Close()
+	// BIND without authentication is rejected before reaching the binder
+	_, err = control.Write([]byte{5, 1, 0})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{5, 0xFF}, readN(t, control, 2))
+}
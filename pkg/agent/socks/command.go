@@ -0,0 +1,182 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5ReplySucceeded        = 0x00
+	socks5ReplyGeneralFailure   = 0x01
+	socks5ReplyNotAllowed       = 0x02
+	socks5ReplyTTLExpired       = 0x06
+	socks5ReplyAtypNotSupported = 0x08
+
+	// handshakeTimeout is the timeout of reading the SOCKS5 request.
+	handshakeTimeout = 30 * time.Second
+)
+
+// commandFunc serves the SOCKS5 request with DST.ADDR host and DST.PORT port.
+// The reply is written by commandFunc, and c is closed by commandFunc.
+type commandFunc func(c net.Conn, host string, port uint16)
+
+// newCommandListener returns a listener that serves the SOCKS5 requests of cmd with fn.
+// The connections of the other requests are passed to the SOCKS server,
+// after replaying the greeting without authentication.
+// So l must not require authentication by itself; wrap the listener returned by NewAuthListener instead.
+//
+// The command listeners can be stacked, as the greeting replayed by the outer listener is consumed by the inner one.
+func newCommandListener(l net.Listener, cmd byte, fn commandFunc) net.Listener {
+	return newHandshakeListener(l, func(c net.Conn) (net.Conn, error) {
+		return handleCommand(c, cmd, fn)
+	})
+}
+
+// handleCommand negotiates the method and reads the request.
+// The requests of cmd are served in background, and the other requests are replayed.
+func handleCommand(c net.Conn, cmd byte, fn commandFunc) (net.Conn, error) {
+	if err := c.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, err
+	}
+	var ver [1]byte
+	if _, err := io.ReadFull(c, ver[:]); err != nil {
+		return nil, err
+	}
+	if ver[0] != socks5Version {
+		if err := c.SetDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+		// SOCKS4 and SOCKS4a are passed to the SOCKS server as is
+		return &replayConn{Conn: c, r: io.MultiReader(bytes.NewReader(ver[:]), c)}, nil
+	}
+	methods, err := readBytes(c)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(methods, socks5AuthNone) < 0 {
+		c.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return nil, errors.New("the client does not support the SOCKS5 method without authentication")
+	}
+	if _, err := c.Write([]byte{socks5Version, socks5AuthNone}); err != nil {
+		return nil, err
+	}
+	// VER, CMD, RSV, ATYP, DST.ADDR, DST.PORT
+	var hdr [3]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return nil, err
+	}
+	rawAddr, host, port, err := readAddr(c)
+	if err != nil {
+		if errors.Is(err, errAtypNotSupported) {
+			c.Write(socks5Reply(socks5ReplyAtypNotSupported, nil, 0))
+		}
+		return nil, err
+	}
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if hdr[1] != cmd {
+		req := append([]byte{socks5Version, 1, socks5AuthNone}, hdr[:]...)
+		req = append(req, rawAddr...)
+		return &replayConn{
+			Conn: c,
+			r:    io.MultiReader(bytes.NewReader(req), c),
+			skip: 2, // VER, METHOD
+		}, nil
+	}
+	go fn(c, host, port)
+	return nil, nil
+}
+
+var errAtypNotSupported = errors.New("unsupported SOCKS5 address type")
+
+// readAddr reads ATYP, DST.ADDR, and DST.PORT.
+// rawAddr contains the bytes that were read.
+func readAddr(rd io.Reader) (rawAddr []byte, host string, port uint16, err error) {
+	var atyp [1]byte
+	if _, err = io.ReadFull(rd, atyp[:]); err != nil {
+		return
+	}
+	var addr []byte
+	switch atyp[0] {
+	case socks5AtypIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socks5AtypIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socks5AtypDomain:
+		if addr, err = readBytes(rd); err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("%w: 0x%02x", errAtypNotSupported, atyp[0])
+		return
+	}
+	if atyp[0] != socks5AtypDomain {
+		if _, err = io.ReadFull(rd, addr); err != nil {
+			return
+		}
+		host = net.IP(addr).String()
+	} else {
+		host = string(addr)
+	}
+	var portBytes [2]byte
+	if _, err = io.ReadFull(rd, portBytes[:]); err != nil {
+		return
+	}
+	port = binary.BigEndian.Uint16(portBytes[:])
+	rawAddr = append(atyp[:], addr...)
+	if atyp[0] == socks5AtypDomain {
+		rawAddr = append([]byte{socks5AtypDomain, byte(len(addr))}, addr...)
+	}
+	rawAddr = append(rawAddr, portBytes[:]...)
+	return
+}
+
+// appendAddr appends ATYP, ADDR, and PORT.
+// A nil ip is appended as 0.0.0.0.
+func appendAddr(b []byte, ip net.IP, port int) []byte {
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// socks5Reply returns VER, REP, RSV, ATYP, BND.ADDR, and BND.PORT.
+func socks5Reply(rep byte, ip net.IP, port int) []byte {
+	return appendAddr([]byte{socks5Version, rep, 0x00}, ip, port)
+}
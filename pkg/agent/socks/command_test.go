@@ -0,0 +1,103 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package socks
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestHandleCommandPassthrough(t *testing.T) {
+	fn := func(c net.Conn, host string, port uint16) {
+		t.Errorf("unexpected command to %s:%d", host, port)
+		c.Close()
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ch := make(chan authResult, 1)
+	go func() {
+		c, err := handleCommand(server, socks5CmdUDPAssociate, fn)
+		ch <- authResult{c, err}
+	}()
+	_, err := client.Write([]byte{5, 1, 0})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{5, 0}, readN(t, client, 2))
+	req := []byte{5, 1, 0, 3, 5, 'h', 'o', 's', 't', '1', 0x1f, 0x90}
+	_, err = client.Write(req)
+	assert.NilError(t, err)
+	res := <-ch
+	assert.NilError(t, res.err)
+	assert.Assert(t, res.conn != nil)
+
+	// The greeting is replayed without authentication, followed by the request
+	go res.conn.Write([]byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	assert.DeepEqual(t, append([]byte{5, 1, 0}, req...), readN(t, res.conn, 3+len(req)))
+	// The method selection reply is not written to the client again
+	assert.DeepEqual(t, []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}, readN(t, client, 10))
+}
+
+func TestHandleCommandSOCKS4(t *testing.T) {
+	fn := func(c net.Conn, host string, port uint16) {
+		t.Errorf("unexpected command to %s:%d", host, port)
+		c.Close()
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ch := make(chan authResult, 1)
+	go func() {
+		c, err := handleCommand(server, socks5CmdUDPAssociate, fn)
+		ch <- authResult{c, err}
+	}()
+	go client.Write([]byte{4, 1, 0x1f, 0x90})
+	res := <-ch
+	assert.NilError(t, res.err)
+	assert.DeepEqual(t, []byte{4, 1, 0x1f, 0x90}, readN(t, res.conn, 4))
+}
+
+func TestHandleCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	type request struct {
+		host string
+		port uint16
+	}
+	reqCh := make(chan request, 1)
+	fn := func(c net.Conn, host string, port uint16) {
+		reqCh <- request{host, port}
+		c.Write(socks5Reply(socks5ReplySucceeded, net.IPv4(127, 0, 42, 101), 10080))
+	}
+	ch := make(chan authResult, 1)
+	go func() {
+		c, err := handleCommand(server, socks5CmdBind, fn)
+		ch <- authResult{c, err}
+	}()
+	_, err := client.Write([]byte{5, 2, 2, 0})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{5, 0}, readN(t, client, 2))
+	_, err = client.Write([]byte{5, 2, 0, 1, 127, 0, 42, 102, 0x1f, 0x90})
+	assert.NilError(t, err)
+	res := <-ch
+	assert.NilError(t, res.err)
+	assert.Assert(t, res.conn == nil)
+	assert.Equal(t, request{"127.0.42.102", 8080}, <-reqCh)
+	assert.DeepEqual(t, []byte{5, 0, 0, 1, 127, 0, 42, 101, 0x27, 0x60}, readN(t, client, 10))
+}
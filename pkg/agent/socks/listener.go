@@ -0,0 +1,129 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package socks
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// handshakeFunc processes the beginning of the SOCKS connection c, before the SOCKS server.
+// handshakeFunc returns the connection to be passed to the SOCKS server,
+// or nil if the connection was consumed by handshakeFunc.
+type handshakeFunc func(c net.Conn) (net.Conn, error)
+
+// newHandshakeListener returns a listener that calls fn for the accepted connections in background.
+// The connections that failed fn are closed.
+func newHandshakeListener(l net.Listener, fn handshakeFunc) net.Listener {
+	hl := &handshakeListener{
+		Listener: l,
+		fn:       fn,
+		connCh:   make(chan net.Conn),
+		errCh:    make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go hl.acceptRoutine()
+	return hl
+}
+
+type handshakeListener struct {
+	net.Listener
+	fn        handshakeFunc
+	connCh    chan net.Conn
+	errCh     chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *handshakeListener) acceptRoutine() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.errCh <- err
+			return
+		}
+		go func() {
+			hc, err := l.fn(c)
+			if err != nil {
+				logrus.WithError(err).Warnf("refusing a SOCKS connection from %s", c.RemoteAddr())
+				c.Close()
+				return
+			}
+			if hc == nil {
+				return
+			}
+			select {
+			case l.connCh <- hc:
+			case <-l.done:
+				hc.Close()
+			}
+		}()
+	}
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case err := <-l.errCh:
+		// Keep the error for the subsequent calls
+		l.errCh <- err
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *handshakeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// replayConn replays r for Read, and discards the first skip bytes of Write.
+type replayConn struct {
+	net.Conn
+	r    io.Reader
+	mu   sync.Mutex
+	skip int // the number of the bytes to be discarded in Write
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	skipped := 0
+	if c.skip > 0 {
+		skipped = c.skip
+		if skipped > len(p) {
+			skipped = len(p)
+		}
+		c.skip -= skipped
+	}
+	c.mu.Unlock()
+	if skipped == len(p) {
+		return len(p), nil
+	}
+	n, err := c.Conn.Write(p[skipped:])
+	return n + skipped, err
+}
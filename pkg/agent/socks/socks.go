@@ -20,17 +20,32 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cybozu-go/usocksd/socks"
+	"github.com/norouter/norouter/pkg/accesslog"
 	"github.com/norouter/norouter/pkg/agent/resolver"
+	"github.com/norouter/norouter/pkg/agent/upstreamproxy"
+	"github.com/norouter/norouter/pkg/policy"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
-func NewServer(st *stack.Stack, rv *resolver.Resolver) (*socks.Server, error) {
-	d, err := NewDialer(st, rv)
+// NewServer creates a SOCKS server.
+//
+// Connections to the netstack that violate pol are refused.
+// me is used as the source IP for evaluating pol.
+//
+// logger is optional, and logs the connections when they are closed.
+//
+// upstream is optional, and dials the destinations that are not "interesting" for rv.
+func NewServer(st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, logger accesslog.Logger, upstream *upstreamproxy.Dialer) (*socks.Server, error) {
+	d, err := NewDialer(st, rv, pol, me, logger, upstream)
 	if err != nil {
 		return nil, err
 	}
@@ -41,10 +56,14 @@ func NewServer(st *stack.Stack, rv *resolver.Resolver) (*socks.Server, error) {
 	return s, nil
 }
 
-func NewDialer(st *stack.Stack, rv *resolver.Resolver) (socks.Dialer, error) {
+func NewDialer(st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, logger accesslog.Logger, upstream *upstreamproxy.Dialer) (socks.Dialer, error) {
 	d := &dialer{
 		stack:    st,
 		resolver: rv,
+		policy:   pol,
+		me:       me,
+		logger:   logger,
+		upstream: upstream,
 	}
 	return d, nil
 }
@@ -52,24 +71,94 @@ func NewDialer(st *stack.Stack, rv *resolver.Resolver) (socks.Dialer, error) {
 type dialer struct {
 	stack    *stack.Stack
 	resolver *resolver.Resolver
+	policy   *policy.Policy
+	me       net.IP
+	logger   accesslog.Logger      // optional
+	upstream *upstreamproxy.Dialer // optional
 }
 
 func (d *dialer) Dial(req *socks.Request) (net.Conn, error) {
+	start := time.Now()
 	s := req.Hostname
 	if s == "" && req.IP != nil {
 		s = req.IP.String()
 	}
-	if !d.resolver.Interesting(s) {
-		addr := fmt.Sprintf("%s:%d", s, req.Port)
-		return net.Dial("tcp", addr)
+	conn, vip, err := d.dial(s, uint16(req.Port))
+	if d.logger == nil {
+		return conn, err
+	}
+	e := &accesslog.Entry{
+		Time:        start,
+		Proxy:       "socks",
+		Method:      "CONNECT",
+		Proto:       "SOCKS",
+		Destination: net.JoinHostPort(s, strconv.Itoa(req.Port)),
+		VIP:         vip,
+		Mesh:        vip != nil,
+	}
+	if req.Conn != nil {
+		e.Client = req.Conn.RemoteAddr().String()
 	}
-	gonetIP, err := d.resolver.Resolve(s)
 	if err != nil {
+		e.Error = err.Error()
+		e.Duration = time.Since(start)
+		d.logger.Log(e)
 		return nil, err
 	}
+	return &loggedConn{Conn: conn, entry: e, logger: d.logger}, nil
+}
+
+// dial returns the virtual IP when dialed over the netstack.
+func (d *dialer) dial(s string, port uint16) (net.Conn, net.IP, error) {
+	if !d.resolver.Interesting(s, port) {
+		if !d.resolver.DirectAllowed() {
+			return nil, nil, fmt.Errorf("refusing to dial %s:%d directly (egress.disableDirect is set)", s, port)
+		}
+		addr := net.JoinHostPort(s, strconv.Itoa(int(port)))
+		// nil upstream dials directly
+		conn, err := d.upstream.Dial("tcp", addr)
+		return conn, nil, err
+	}
+	gonetIP, err := d.resolver.Resolve(s, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := d.policy.CheckDial(d.me, gonetIP, port); err != nil {
+		return nil, nil, err
+	}
 	fullAddr := tcpip.FullAddress{
 		Addr: tcpip.Address(gonetIP),
-		Port: uint16(req.Port),
+		Port: port,
 	}
-	return gonet.DialContextTCP(context.TODO(), d.stack, fullAddr, ipv4.ProtocolNumber)
+	conn, err := gonet.DialContextTCP(context.TODO(), d.stack, fullAddr, ipv4.ProtocolNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, gonetIP, nil
+}
+
+// loggedConn counts the bytes read from the destination (i.e., sent to the client),
+// and logs the entry on Close.
+type loggedConn struct {
+	net.Conn
+	entry     *accesslog.Entry
+	logger    accesslog.Logger
+	bytes     int64
+	closeOnce sync.Once
+}
+
+func (c *loggedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.bytes, int64(n))
+	return n, err
+}
+
+func (c *loggedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.entry.Bytes = atomic.LoadInt64(&c.bytes)
+		c.entry.Duration = time.Since(c.entry.Time)
+		c.logger.Log(c.entry)
+	})
+	return err
 }
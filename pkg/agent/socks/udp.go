@@ -0,0 +1,324 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/norouter/norouter/pkg/accesslog"
+	"github.com/norouter/norouter/pkg/agent/resolver"
+	"github.com/norouter/norouter/pkg/agent/upstreamproxy"
+	"github.com/norouter/norouter/pkg/policy"
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+
+	"github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// maxUDPTargets is the maximum number of the destinations per UDP association.
+	maxUDPTargets = 64
+
+	// maxDatagramSize is the maximum size of the datagrams.
+	maxDatagramSize = 65535
+)
+
+// NewUDPListener returns a listener that handles SOCKS5 UDP ASSOCIATE requests (RFC 1928).
+// The datagrams to the virtual hosts are relayed over the netstack, and
+// the other datagrams are relayed directly from the host, unless disabled by the egress config.
+// The upstream proxy is not used for UDP, as HTTP CONNECT cannot relay UDP.
+//
+// udpPorts are the UDP ports published by the virtual hosts, i.e., the UDP forwards and the built-in DNS.
+// The datagrams to the other ports of the virtual hosts, and the datagrams to the destinations routed via
+// the virtual hosts are refused, as the routers relay only TCP to the non-virtual destinations.
+//
+// The other requests are passed to the SOCKS server, after replaying the greeting without authentication.
+// So l must not require authentication by itself; wrap the listener returned by NewAuthListener instead.
+//
+// logger is optional, and logs each destination of the associations when the associations are closed.
+func NewUDPListener(l net.Listener, st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, logger accesslog.Logger, upstream *upstreamproxy.Dialer, udpPorts []jsonmsg.IPPortProto) net.Listener {
+	published := make(map[string]struct{})
+	for _, f := range udpPorts {
+		published[udpPortKey(f.IP, f.Port)] = struct{}{}
+	}
+	r := &udpRelay{
+		dial: func(host string, port uint16) (net.Conn, net.IP, error) {
+			return dialUDP(st, rv, pol, me, upstream, published, host, port)
+		},
+		logger: logger,
+	}
+	return newUDPListener(l, r)
+}
+
+func newUDPListener(l net.Listener, r *udpRelay) net.Listener {
+	return newCommandListener(l, socks5CmdUDPAssociate, r.serve)
+}
+
+func udpPortKey(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// dialUDP returns the virtual IP when dialed over the netstack.
+// published is the set of udpPortKey of the UDP ports published by the virtual hosts.
+func dialUDP(st *stack.Stack, rv *resolver.Resolver, pol *policy.Policy, me net.IP, upstream *upstreamproxy.Dialer, published map[string]struct{}, host string, port uint16) (net.Conn, net.IP, error) {
+	if !rv.Interesting(host, port) {
+		if !rv.DirectAllowed() {
+			return nil, nil, fmt.Errorf("refusing to send UDP datagrams to %s:%d directly (egress.disableDirect is set)", host, port)
+		}
+		if !upstream.Bypass(host) {
+			return nil, nil, fmt.Errorf("refusing to send UDP datagrams to %s:%d directly (not covered by upstreamProxy.noProxy)", host, port)
+		}
+		conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		return conn, nil, err
+	}
+	ip, err := rv.Resolve(host, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, nil, fmt.Errorf("expected %s to be an IPv4 address", ip)
+	}
+	if _, ok := published[udpPortKey(ip4, port)]; !ok {
+		return nil, nil, fmt.Errorf("refusing to send UDP datagrams to %s:%d (%s), as it is not a UDP port published by a virtual host (UDP cannot be routed via the virtual hosts)", host, port, ip4)
+	}
+	if err := pol.CheckDial(me, ip4, port); err != nil {
+		return nil, nil, err
+	}
+	fullAddr := &tcpip.FullAddress{
+		Addr: tcpip.Address(ip4),
+		Port: port,
+	}
+	conn, err := gonet.DialUDP(st, nil, fullAddr, ipv4.ProtocolNumber)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial gonet udp %s:%d: %w", ip4, port, err)
+	}
+	return conn, ip4, nil
+}
+
+type udpRelay struct {
+	dial   func(host string, port uint16) (conn net.Conn, vip net.IP, err error)
+	logger accesslog.Logger // optional
+}
+
+// parseDatagram parses the UDP request header: RSV, FRAG, ATYP, DST.ADDR, DST.PORT, and DATA.
+func parseDatagram(b []byte) (host string, port uint16, data []byte, err error) {
+	if len(b) < 4 {
+		return "", 0, nil, errors.New("too short datagram")
+	}
+	if b[2] != 0 {
+		return "", 0, nil, errors.New("fragmented datagrams are not supported")
+	}
+	rd := bytes.NewReader(b[3:])
+	if _, host, port, err = readAddr(rd); err != nil {
+		return "", 0, nil, err
+	}
+	return host, port, b[len(b)-rd.Len():], nil
+}
+
+// serve serves the UDP association until c is closed.
+// port is the port that the client expects to send the datagrams from, or 0 if unknown.
+// host is ignored, as the client address is taken from c.
+func (r *udpRelay) serve(c net.Conn, host string, port uint16) {
+	defer c.Close()
+	var bindIP net.IP
+	if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		bindIP = a.IP
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		logrus.WithError(err).Warn("failed to listen on UDP for SOCKS5 UDP ASSOCIATE")
+		c.Write(socks5Reply(socks5ReplyGeneralFailure, nil, 0))
+		return
+	}
+	defer pc.Close()
+	bnd := pc.LocalAddr().(*net.UDPAddr)
+	if _, err := c.Write(socks5Reply(socks5ReplySucceeded, bnd.IP, bnd.Port)); err != nil {
+		return
+	}
+	a := &udpAssociation{
+		relay:   r,
+		pc:      pc,
+		control: c,
+		targets: make(map[string]*udpTarget),
+	}
+	if ca, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		a.clientIP = ca.IP
+	}
+	a.clientPort = int(port)
+	go a.readClientRoutine()
+	// The association terminates when the control connection is closed
+	io.Copy(io.Discard, c)
+	a.close()
+}
+
+type udpAssociation struct {
+	relay      *udpRelay
+	pc         *net.UDPConn
+	control    net.Conn
+	clientIP   net.IP
+	clientPort int // 0 means any port
+	mu         sync.Mutex
+	client     *net.UDPAddr // the first client address
+	targets    map[string]*udpTarget
+	closed     bool
+}
+
+type udpTarget struct {
+	conn  net.Conn
+	entry *accesslog.Entry // nil when logger is nil
+	bytes int64
+}
+
+func (a *udpAssociation) readClientRoutine() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := a.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.acceptFrom(from) {
+			continue
+		}
+		host, port, data, err := parseDatagram(buf[:n])
+		if err != nil {
+			logrus.WithError(err).Debugf("dropping a SOCKS5 UDP datagram from %s", from)
+			continue
+		}
+		t, err := a.target(host, port)
+		if err != nil {
+			logrus.WithError(err).Debugf("dropping a SOCKS5 UDP datagram from %s", from)
+			continue
+		}
+		if _, err := t.conn.Write(data); err != nil {
+			logrus.WithError(err).Debugf("failed to relay a SOCKS5 UDP datagram to %s:%d", host, port)
+		}
+	}
+}
+
+// acceptFrom returns true if the datagram from addr belongs to the association.
+func (a *udpAssociation) acceptFrom(addr *net.UDPAddr) bool {
+	if a.clientIP != nil && !a.clientIP.Equal(addr.IP) {
+		return false
+	}
+	if a.clientPort != 0 && a.clientPort != addr.Port {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		a.client = addr
+		return true
+	}
+	return a.client.IP.Equal(addr.IP) && a.client.Port == addr.Port
+}
+
+// target returns the target for host:port, dialing it on the first call.
+func (a *udpAssociation) target(host string, port uint16) (*udpTarget, error) {
+	k := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, net.ErrClosed
+	}
+	if t, ok := a.targets[k]; ok {
+		return t, nil
+	}
+	if len(a.targets) >= maxUDPTargets {
+		return nil, fmt.Errorf("too many destinations (> %d) in the UDP association", maxUDPTargets)
+	}
+	start := time.Now()
+	conn, vip, err := a.relay.dial(host, port)
+	if err != nil {
+		return nil, err
+	}
+	t := &udpTarget{conn: conn}
+	if a.relay.logger != nil {
+		t.entry = &accesslog.Entry{
+			Time:        start,
+			Proxy:       "socks",
+			Client:      a.control.RemoteAddr().String(),
+			Method:      "UDP",
+			Proto:       "SOCKS5",
+			Destination: k,
+			VIP:         vip,
+			Mesh:        vip != nil,
+		}
+	}
+	a.targets[k] = t
+	go a.readTargetRoutine(t)
+	return t, nil
+}
+
+// readTargetRoutine relays the datagrams from t to the client.
+func (a *udpAssociation) readTargetRoutine(t *udpTarget) {
+	buf := make([]byte, maxDatagramSize)
+	src := &net.UDPAddr{}
+	switch ra := t.conn.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		src = ra
+	default:
+		if ap, err := net.ResolveUDPAddr("udp", ra.String()); err == nil {
+			src = ap
+		}
+	}
+	hdr := appendAddr([]byte{0x00, 0x00, 0x00}, src.IP, src.Port)
+	for {
+		n, err := t.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&t.bytes, int64(n))
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+		if client == nil {
+			continue
+		}
+		if _, err := a.pc.WriteToUDP(append(hdr[:len(hdr):len(hdr)], buf[:n]...), client); err != nil {
+			logrus.WithError(err).Debugf("failed to relay a SOCKS5 UDP datagram to %s", client)
+		}
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	a.closed = true
+	targets := a.targets
+	a.targets = nil
+	a.mu.Unlock()
+	a.pc.Close()
+	for _, t := range targets {
+		t.conn.Close()
+		if t.entry != nil {
+			t.entry.Bytes = atomic.LoadInt64(&t.bytes)
+			t.entry.Duration = time.Since(t.entry.Time)
+			a.relay.logger.Log(t.entry)
+		}
+	}
+}
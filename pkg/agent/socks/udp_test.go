@@ -0,0 +1,123 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package socks
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/norouter/norouter/pkg/accesslog"
+	"gotest.tools/v3/assert"
+)
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+
+	var (
+		mu      sync.Mutex
+		entries []*accesslog.Entry
+		logged  = make(chan struct{})
+	)
+	r := &udpRelay{
+		dial: func(host string, port uint16) (net.Conn, net.IP, error) {
+			assert.Equal(t, "host1", host)
+			assert.Equal(t, uint16(53), port)
+			conn, err := net.DialUDP("udp", nil, echo.LocalAddr().(*net.UDPAddr))
+			return conn, net.IPv4(127, 0, 42, 101), err
+		},
+		logger: accesslog.LoggerFunc(func(e *accesslog.Entry) {
+			mu.Lock()
+			entries = append(entries, e)
+			mu.Unlock()
+			close(logged)
+		}),
+	}
+	tcpL, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	l := newUDPListener(tcpL, r)
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	control, err := net.Dial("tcp", tcpL.Addr().String())
+	assert.NilError(t, err)
+	_, err = control.Write([]byte{5, 1, 0})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte{5, 0}, readN(t, control, 2))
+	_, err = control.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	assert.NilError(t, err)
+	reply := readN(t, control, 10)
+	assert.DeepEqual(t, []byte{5, 0, 0, 1, 127, 0, 0, 1}, reply[:8])
+	relayAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(reply[8])<<8 | int(reply[9])}
+
+	uc, err := net.DialUDP("udp", nil, relayAddr)
+	assert.NilError(t, err)
+	defer uc.Close()
+	hdr := []byte{0, 0, 0, 3, 5, 'h', 'o', 's', 't', '1', 0, 53}
+	_, err = uc.Write(append(hdr, "hello"...))
+	assert.NilError(t, err)
+	assert.NilError(t, uc.SetReadDeadline(time.Now().Add(10*time.Second)))
+	buf := make([]byte, 1024)
+	n, err := uc.Read(buf)
+	assert.NilError(t, err)
+	host, port, data, err := parseDatagram(buf[:n])
+	assert.NilError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+	assert.Equal(t, echo.LocalAddr().(*net.UDPAddr).Port, int(port))
+	assert.Equal(t, "HELLO", string(data))
+
+	// Fragmented datagrams are dropped
+	_, err = uc.Write(append([]byte{0, 0, 1}, append(hdr[3:], "frag"...)...))
+	assert.NilError(t, err)
+
+	control.Close()
+	select {
+	case <-logged:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the access log")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, len(entries))
+	e := entries[0]
+	assert.Equal(t, "UDP", e.Method)
+	assert.Equal(t, "host1:53", e.Destination)
+	assert.Equal(t, true, e.Mesh)
+	assert.Equal(t, int64(5), e.Bytes)
+	assert.Assert(t, strings.HasPrefix(e.Client, "127.0.0.1:"))
+}
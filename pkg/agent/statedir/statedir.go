@@ -24,8 +24,8 @@ import (
 	"path/filepath"
 
 	"github.com/norouter/norouter/pkg/agent/etchosts"
-	"github.com/norouter/norouter/pkg/agent/filepathutil"
 	"github.com/norouter/norouter/pkg/agent/hostaliases"
+	"github.com/norouter/norouter/pkg/filepathutil"
 	"github.com/sirupsen/logrus"
 )
 
@@ -38,6 +38,7 @@ Files in this directory:
 - README.md:    This file
 - hosts:        Can be used as /etc/hosts
 - hostaliases:  Can be used as $HOSTALIASES
+- access.log:   Access logs of the HTTP and SOCKS proxies, when .[]hosts.accessLog.output is "file"
 
 ## About "hosts" file:
 The hosts file can be used as /etc/hosts if you copy to there manually.
@@ -60,7 +61,7 @@ For further information, see https://norouter.io/
 
 // Populate populates the state dir.
 // When the dir path is empty, it is interpreted as "~/.norouter/agent".
-// The dir path is expanded using ../filepathutil.Expand .
+// The dir path is expanded using filepathutil.Expand .
 //
 // The following files are created in the directory: "hosts", "hostaliases", "README.md"
 func Populate(dirPath string, hostnameMap map[string]net.IP) error {
@@ -99,6 +100,19 @@ func Populate(dirPath string, hostnameMap map[string]net.IP) error {
 	return nil
 }
 
+// OpenAccessLog opens "access.log" in the state dir for appending.
+// When the dir path is empty, it is interpreted as "~/.norouter/agent".
+func OpenAccessLog(dirPath string) (*os.File, error) {
+	dirPath, err := expandDirPath(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dirPath, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(dirPath, "access.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
 func expandDirPath(dirPath string) (string, error) {
 	if dirPath == "" {
 		u, err := user.Current()
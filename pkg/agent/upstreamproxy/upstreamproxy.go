@@ -0,0 +1,386 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package upstreamproxy dials the non-mesh destinations of the HTTP and SOCKS proxies
+// via an upstream proxy (HTTP CONNECT or SOCKS5).
+package upstreamproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+)
+
+// Dialer dials the destinations via the upstream proxy, unless the destinations match NoProxy.
+//
+// A nil Dialer dials all the destinations directly.
+type Dialer struct {
+	url     *url.URL
+	noProxy []matcher
+	direct  net.Dialer
+}
+
+// New returns nil when c.URL is empty.
+func New(c jsonmsg.UpstreamProxy) (*Dialer, error) {
+	if c.URL == "" {
+		return nil, nil
+	}
+	u, err := ParseURL(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dialer{
+		url: u,
+	}
+	for _, s := range c.NoProxy {
+		m, err := parseMatcher(s)
+		if err != nil {
+			return nil, err
+		}
+		d.noProxy = append(d.noProxy, m)
+	}
+	return d, nil
+}
+
+// ParseURL parses "http://[user:pass@]host[:port]" or "socks5://[user:pass@]host[:port]".
+// The port defaults to 80 for "http", and 1080 for "socks5".
+func ParseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream proxy URL %q: %w", s, err)
+	}
+	defaultPort := ""
+	switch u.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "socks5":
+		defaultPort = "1080"
+	default:
+		return nil, fmt.Errorf("expected the scheme of upstream proxy URL %q be \"http\" or \"socks5\", got %q", s, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream proxy URL %q lacks host", s)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("upstream proxy URL %q must not have path, query, or fragment", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	} else if p, err := strconv.ParseUint(u.Port(), 10, 16); err != nil || p == 0 {
+		return nil, fmt.Errorf("failed to parse the port of upstream proxy URL %q", s)
+	}
+	if u.User != nil && u.Scheme == "socks5" {
+		// RFC 1929
+		password, _ := u.User.Password()
+		if u.User.Username() == "" || len(u.User.Username()) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("invalid credentials in upstream proxy URL %q", u.Redacted())
+		}
+	}
+	u.Path = ""
+	return u, nil
+}
+
+// String returns the URL of the upstream proxy, with the password redacted.
+func (d *Dialer) String() string {
+	if d == nil {
+		return ""
+	}
+	return d.url.Redacted()
+}
+
+// Bypass returns true if host should be dialed directly.
+// host is a hostname or an IP literal, without a port.
+//
+// "localhost" and loopback addresses are always dialed directly.
+func (d *Dialer) Bypass(host string) bool {
+	if d == nil {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, m := range d.noProxy {
+		if m.match(host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyURL can be used as http.Transport.Proxy.
+// ProxyURL returns nil when the request should be sent directly.
+func (d *Dialer) ProxyURL(req *http.Request) (*url.URL, error) {
+	if d.Bypass(req.URL.Hostname()) {
+		return nil, nil
+	}
+	return d.url, nil
+}
+
+// Dial dials addr ("host:port") via the upstream proxy, unless addr should be dialed directly.
+// network must be "tcp", "tcp4", or "tcp6".
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext dials addr ("host:port") via the upstream proxy, unless addr should be dialed directly.
+// network must be "tcp", "tcp4", or "tcp6".
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.Bypass(host) {
+		var direct net.Dialer
+		if d != nil {
+			direct = d.direct
+		}
+		return direct.DialContext(ctx, network, addr)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q for upstream proxy", network)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the port of %q: %w", addr, err)
+	}
+	conn, err := d.direct.DialContext(ctx, "tcp", d.url.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream proxy %s: %w", d.url.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tunnel := conn
+	switch d.url.Scheme {
+	case "http":
+		tunnel, err = d.handshakeHTTP(conn, addr)
+	case "socks5":
+		err = d.handshakeSOCKS5(conn, host, uint16(port))
+	default:
+		err = fmt.Errorf("unsupported upstream proxy scheme %q", d.url.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to dial %s via upstream proxy %s: %w", addr, d.url.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+func (d *Dialer) handshakeHTTP(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.url.User; u != nil {
+		password, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %q", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a conn with the bytes that were read ahead by bufio.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (d *Dialer) handshakeSOCKS5(conn net.Conn, host string, port uint16) error {
+	const (
+		methodNoAuth   = 0x00
+		methodPassword = 0x02
+	)
+	greeting := []byte{0x05, 0x01, methodNoAuth}
+	if d.url.User != nil {
+		greeting = []byte{0x05, 0x02, methodNoAuth, methodPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 0x05 {
+		return fmt.Errorf("unexpected SOCKS version %d", buf[0])
+	}
+	switch buf[1] {
+	case methodNoAuth:
+	case methodPassword:
+		if d.url.User == nil {
+			return errors.New("the SOCKS5 server requires username/password authentication")
+		}
+		username := d.url.User.Username()
+		password, _ := d.url.User.Password()
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return errors.New("SOCKS5 username/password authentication failed")
+		}
+	default:
+		return fmt.Errorf("no acceptable SOCKS5 authentication method (got 0x%02x)", buf[1])
+	}
+
+	req := []byte{0x05, 0x01, 0x00} // CONNECT
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("hostname %q is too long for SOCKS5", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 request failed (reply 0x%02x)", reply[1])
+	}
+	var addrLen int
+	switch reply[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		addrLen = int(buf[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type 0x%02x", reply[3])
+	}
+	// BND.ADDR and BND.PORT are discarded
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// matcher is an entry of NoProxy.
+type matcher struct {
+	all    bool       // "*"
+	ipNet  *net.IPNet // "10.0.0.0/8"
+	ip     net.IP     // "10.0.0.1"
+	domain string     // "example.com" (matches the subdomains too)
+	sub    bool       // "*.example.com" (matches only the subdomains)
+}
+
+func parseMatcher(s string) (matcher, error) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+	switch {
+	case s == "":
+		return matcher{}, errors.New("empty noProxy entry")
+	case s == "*":
+		return matcher{all: true}, nil
+	case strings.Contains(s, "/"):
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return matcher{}, fmt.Errorf("failed to parse noProxy entry %q: %w", s, err)
+		}
+		return matcher{ipNet: ipNet}, nil
+	case net.ParseIP(s) != nil:
+		return matcher{ip: net.ParseIP(s)}, nil
+	case strings.HasPrefix(s, "*."):
+		return matcher{domain: strings.TrimPrefix(s, "*."), sub: true}, nil
+	case strings.HasPrefix(s, "."):
+		return matcher{domain: strings.TrimPrefix(s, ".")}, nil
+	case strings.Contains(s, "*"):
+		return matcher{}, fmt.Errorf("noProxy entry %q: wildcards must be the leftmost label (\"*.example.com\")", s)
+	default:
+		return matcher{domain: s}, nil
+	}
+}
+
+// match matches host (lower-cased, without the trailing dot).
+// ip is the parsed host, or nil.
+// CIDRs are matched only against IP literals, as hostnames are resolved by the upstream proxy.
+func (m matcher) match(host string, ip net.IP) bool {
+	switch {
+	case m.all:
+		return true
+	case m.ipNet != nil:
+		return ip != nil && m.ipNet.Contains(ip)
+	case m.ip != nil:
+		return ip != nil && m.ip.Equal(ip)
+	case ip != nil:
+		return false
+	case m.sub:
+		return strings.HasSuffix(host, "."+m.domain)
+	default:
+		return host == m.domain || strings.HasSuffix(host, "."+m.domain)
+	}
+}
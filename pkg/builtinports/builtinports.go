@@ -17,8 +17,8 @@
 package builtinports
 
 const (
-	// DNSTCP is the default TCP port number of the built-in DNS.
+	// DNS is the default TCP and UDP port number of the built-in DNS.
 	// The port number was chosen so that it can be associated with a loopback device without the root privileges.
 	// Note that resolv.conf does not support specifying non-53 port.
-	DNSTCP = 10053
+	DNS = 10053
 )
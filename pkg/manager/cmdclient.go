@@ -24,6 +24,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 
 	"github.com/norouter/norouter/pkg/manager/manifest/parsed"
 	"github.com/norouter/norouter/pkg/stream/jsonmsg"
@@ -82,18 +83,56 @@ func NewCmdClient(ctx context.Context, hostname string, pm *parsed.ParsedManifes
 	configRequestArgs.HostnameMap = make(map[string]net.IP)
 	for k, v := range pm.Hosts {
 		configRequestArgs.HostnameMap[k] = v.VIP
-		for _, a := range v.Aliases {
-			configRequestArgs.HostnameMap[a] = v.VIP
+		names := append(append([]string{}, v.Aliases...), parsed.SuffixedNames(k, v.Aliases, pm.Domain)...)
+		for _, n := range names {
+			if strings.HasPrefix(n, "*.") {
+				if configRequestArgs.WildcardHostnameMap == nil {
+					configRequestArgs.WildcardHostnameMap = make(map[string]net.IP)
+				}
+				configRequestArgs.WildcardHostnameMap[n] = v.VIP
+				continue
+			}
+			configRequestArgs.HostnameMap[n] = v.VIP
 		}
 	}
 	configRequestArgs.HTTP.Listen = h.HTTP.Listen
+	configRequestArgs.HTTP.Auth = h.HTTP.Auth
+	configRequestArgs.HTTP.AllowedClients = h.HTTP.AllowedClients
+	configRequestArgs.HTTP.VIPPort = h.HTTP.VIPPort
 	configRequestArgs.SOCKS.Listen = h.SOCKS.Listen
+	configRequestArgs.SOCKS.Auth = h.SOCKS.Auth
+	configRequestArgs.SOCKS.AllowedClients = h.SOCKS.AllowedClients
+	configRequestArgs.SOCKS.UDP = h.SOCKS.UDP
+	configRequestArgs.SOCKS.Bind = h.SOCKS.Bind
+	configRequestArgs.SOCKS.VIPPort = h.SOCKS.VIPPort
+	configRequestArgs.AccessLog.Format = h.AccessLog.Format
+	configRequestArgs.AccessLog.Output = h.AccessLog.Output
+	configRequestArgs.UpstreamProxy.URL = h.UpstreamProxy.URL
+	configRequestArgs.UpstreamProxy.NoProxy = h.UpstreamProxy.NoProxy
+	configRequestArgs.Ingress.Listen = h.Ingress.Listen
+	configRequestArgs.Ingress.Rules = h.Ingress.Rules
+	configRequestArgs.Ingress.DefaultBackend = h.Ingress.DefaultBackend
 	configRequestArgs.Loopback.Disable = h.Loopback.Disable
 	configRequestArgs.StateDir.Path = h.StateDir.PathOnAgent
 	configRequestArgs.StateDir.Disable = h.StateDir.Disable
 	configRequestArgs.WriteEtcHosts = h.WriteEtcHosts
 	configRequestArgs.Routes = pm.Routes
 	configRequestArgs.NameServers = pm.NameServers
+	configRequestArgs.Policies = pm.Policies
+	configRequestArgs.Egress.DisableDirect = h.Egress.DisableDirect
+	configRequestArgs.Egress.Via = h.Egress.EgressVIP
+	configRequestArgs.DNSRecords = pm.DNSRecords
+	configRequestArgs.Domain = pm.Domain
+	configRequestArgs.Resolver.CacheSize = h.Resolver.CacheSize
+	configRequestArgs.Resolver.CacheTTL = h.Resolver.CacheTTL
+	configRequestArgs.Resolver.DisableCache = h.Resolver.DisableCache
+	configRequestArgs.Resolver.SkipSystemLookup = h.Resolver.SkipSystemLookup
+	configRequestArgs.DNS.Upstreams = h.DNS.Upstreams
+	configRequestArgs.DNS.FallbackUpstreams = h.DNS.FallbackUpstreams
+	configRequestArgs.DNS.DisableFallback = h.DNS.DisableFallback
+	configRequestArgs.DNS.CacheSize = h.DNS.CacheSize
+	configRequestArgs.DNS.DisableCache = h.DNS.DisableCache
+	configRequestArgs.DNS.LogQueries = h.DNS.LogQueries
 	configRequestArgsB, err := json.Marshal(configRequestArgs)
 	if err != nil {
 		return nil, err
@@ -133,6 +172,11 @@ type CmdClient struct {
 	configRequestArgs jsonmsg.ConfigureRequestArgs
 }
 
+// ConfigureRequestArgs returns the configuration to be sent to the agent.
+func (c *CmdClient) ConfigureRequestArgs() jsonmsg.ConfigureRequestArgs {
+	return c.configRequestArgs
+}
+
 func (c *CmdClient) String() string {
 	return fmt.Sprintf("<%s (%s)> %s", c.Hostname, c.VIP, c.cmd.String())
 }
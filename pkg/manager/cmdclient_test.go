@@ -0,0 +1,58 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/norouter/norouter/pkg/manager/manifest"
+	"github.com/norouter/norouter/pkg/manager/manifest/parsed"
+	"gotest.tools/v3/assert"
+)
+
+func TestNewCmdClientWildcard(t *testing.T) {
+	const s = `
+domain: mesh.internal
+hosts:
+  host1:
+    vip: "127.0.42.101"
+    aliases: ["web", "*.host1"]
+`
+	var raw manifest.Manifest
+	assert.NilError(t, yaml.Unmarshal([]byte(s), &raw))
+	pm, err := parsed.New(&raw)
+	assert.NilError(t, err)
+	cc, err := NewCmdClient(context.Background(), "host1", pm)
+	assert.NilError(t, err)
+	args := cc.ConfigureRequestArgs()
+	vip := net.ParseIP("127.0.42.101")
+	// the older agents write HostnameMap to /etc/hosts verbatim, so HostnameMap must not contain wildcards
+	assert.DeepEqual(t, map[string]net.IP{
+		"host1":               vip,
+		"web":                 vip,
+		"host1.mesh.internal": vip,
+		"web.mesh.internal":   vip,
+	}, args.HostnameMap)
+	assert.DeepEqual(t, map[string]net.IP{
+		"*.host1":               vip,
+		"*.host1.mesh.internal": vip,
+	}, args.WildcardHostnameMap)
+	assert.Equal(t, 6, len(args.Hostnames()))
+}
@@ -17,11 +17,21 @@
 package manager
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/norouter/norouter/pkg/accesslog"
+	"github.com/norouter/norouter/pkg/filepathutil"
+	"github.com/norouter/norouter/pkg/policy"
 	"github.com/norouter/norouter/pkg/router"
 	"github.com/norouter/norouter/pkg/stream"
 	"github.com/norouter/norouter/pkg/stream/jsonmsg"
@@ -37,24 +47,110 @@ func New(ccSet *CmdClientSet) (*Manager, error) {
 		vip := net.ParseIP(s)
 		vips = append(vips, vip)
 	}
-	router, err := router.New(ccSet.ParsedManifest.Routes, vips)
+	lr := ccSet.ParsedManifest.LearntRoutes
+	routerOpts := &router.Options{
+		LearntCacheSize: lr.CacheSize,
+		LearntTTL:       lr.TTL,
+	}
+	router, err := router.NewWithOptions(ccSet.ParsedManifest.Routes, vips, routerOpts)
+	if err != nil {
+		return nil, err
+	}
+	pol, err := policy.New(ccSet.ParsedManifest.Policies)
 	if err != nil {
 		return nil, err
 	}
 	mgr := &Manager{
-		ccSet:     ccSet,
-		senders:   make(map[string]*stream.Sender),
-		receivers: make(map[string]*stream.Receiver),
-		router:    router,
+		ccSet:       ccSet,
+		senders:     make(map[string]*stream.Sender),
+		receivers:   make(map[string]*stream.Receiver),
+		router:      router,
+		policy:      pol,
+		policyDrops: make([]uint64, len(ccSet.ParsedManifest.Policies)),
+	}
+	if lr.File != "" {
+		mgr.learntRoutesFile, err = filepathutil.Expand(lr.File)
+		if err != nil {
+			return nil, err
+		}
+		if err := mgr.loadLearntRoutes(); err != nil {
+			return nil, err
+		}
 	}
 	return mgr, nil
 }
 
 type Manager struct {
-	ccSet     *CmdClientSet
-	senders   map[string]*stream.Sender // key: vip (TODO: don't use string)
-	receivers map[string]*stream.Receiver
-	router    *router.Router
+	ccSet            *CmdClientSet
+	senders          map[string]*stream.Sender // key: vip (TODO: don't use string)
+	receivers        map[string]*stream.Receiver
+	router           *router.Router
+	policy           *policy.Policy
+	policyDrops      []uint64 // atomic, indexed by the policy
+	learntRoutesFile string
+	learntRoutesMu   sync.Mutex
+	learntRoutesLast time.Time // the time when the learnt routes file was written
+	learntRoutesNew  bool      // true when some routes were learnt after learntRoutesLast
+}
+
+// learntRoutesSaveInterval is the minimum interval between writes to the learnt routes file.
+const learntRoutesSaveInterval = 10 * time.Second
+
+func (r *Manager) loadLearntRoutes() error {
+	f, err := os.Open(r.learntRoutesFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			logrus.Debugf("learnt routes file %q does not exist yet", r.learntRoutesFile)
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	if err := r.router.LoadLearnt(f); err != nil {
+		return fmt.Errorf("failed to load learnt routes from %q: %w", r.learntRoutesFile, err)
+	}
+	logrus.Debugf("loaded learnt routes from %q", r.learntRoutesFile)
+	return nil
+}
+
+// saveLearntRoutes writes the learnt routes file atomically.
+// saveLearntRoutes must be called with r.learntRoutesMu held.
+func (r *Manager) saveLearntRoutes() error {
+	dir := filepath.Dir(r.learntRoutesFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(r.learntRoutesFile)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := r.router.SaveLearnt(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.learntRoutesFile); err != nil {
+		return err
+	}
+	r.learntRoutesLast = time.Now()
+	r.learntRoutesNew = false
+	return nil
+}
+
+// Close saves the learnt routes if needed.
+func (r *Manager) Close() error {
+	if r.learntRoutesFile == "" {
+		return nil
+	}
+	r.learntRoutesMu.Lock()
+	defer r.learntRoutesMu.Unlock()
+	if !r.learntRoutesNew {
+		return nil
+	}
+	return r.saveLearntRoutes()
 }
 
 func (r *Manager) Run() error {
@@ -104,6 +200,9 @@ func (r *Manager) Run() error {
 		}
 	}
 
+	if len(r.policyDrops) != 0 {
+		go r.logPolicyDropsRoutine()
+	}
 	var eg errgroup.Group
 	// Step 2: start goroutines after filling up all r.senders
 	for vipx, receiverx := range r.receivers {
@@ -203,12 +302,54 @@ func (r *Manager) validateAgentFeatures(vip string, data jsonmsg.ConfigureResult
 				vip, version.FeatureHTTP, cc.configRequestArgs.HTTP.Listen)
 		}
 	}
+	if cc.configRequestArgs.AccessLog.Output != "" {
+		if _, ok := fm[version.FeatureAccessLog]; !ok {
+			// not a critical error
+			logrus.Warnf("%s lacks feature %q, access logs will not be recorded",
+				vip, version.FeatureAccessLog)
+		}
+	}
+	if cc.configRequestArgs.UpstreamProxy.URL != "" {
+		if _, ok := fm[version.FeatureUpstreamProxy]; !ok {
+			// not a critical error
+			logrus.Warnf("%s lacks feature %q, non-mesh destinations will be dialed directly",
+				vip, version.FeatureUpstreamProxy)
+		}
+	}
+	if cc.configRequestArgs.HTTP.VIPPort != 0 || cc.configRequestArgs.SOCKS.VIPPort != 0 {
+		if _, ok := fm[version.FeatureProxyVIPPort]; !ok {
+			// not a critical error
+			logrus.Warnf("%s lacks feature %q, the other hosts cannot connect to the HTTP and SOCKS proxies of the host",
+				vip, version.FeatureProxyVIPPort)
+		}
+	}
+	if cc.configRequestArgs.Ingress.Listen != "" {
+		if _, ok := fm[version.FeatureIngress]; !ok {
+			// not a critical error
+			logrus.Warnf("%s lacks feature %q, ingress listen (%q) is ignored",
+				vip, version.FeatureIngress, cc.configRequestArgs.Ingress.Listen)
+		}
+	}
 	if cc.configRequestArgs.SOCKS.Listen != "" {
 		if _, ok := fm[version.FeatureSOCKS]; !ok {
 			// not a critical error
 			logrus.Warnf("%s lacks feature %q, SOCKS listen (%q) is ignored",
 				vip, version.FeatureSOCKS, cc.configRequestArgs.SOCKS.Listen)
 		}
+		if cc.configRequestArgs.SOCKS.UDP {
+			if _, ok := fm[version.FeatureSOCKSUDP]; !ok {
+				// not a critical error
+				logrus.Warnf("%s lacks feature %q, SOCKS5 UDP ASSOCIATE will be refused",
+					vip, version.FeatureSOCKSUDP)
+			}
+		}
+		if cc.configRequestArgs.SOCKS.Bind {
+			if _, ok := fm[version.FeatureSOCKSBind]; !ok {
+				// not a critical error
+				logrus.Warnf("%s lacks feature %q, SOCKS5 BIND will be refused",
+					vip, version.FeatureSOCKSBind)
+			}
+		}
 	}
 	if cc.configRequestArgs.Loopback.Disable {
 		if _, ok := fm[version.FeatureLoopbackDisable]; !ok {
@@ -230,11 +371,66 @@ func (r *Manager) validateAgentFeatures(vip string, data jsonmsg.ConfigureResult
 				vip, version.FeatureRoutes)
 		}
 	}
+	for _, route := range cc.configRequestArgs.Routes {
+		if len(route.Ports) == 0 {
+			continue
+		}
+		if _, ok := fm[version.FeatureRoutesPorts]; !ok {
+			// the agent would apply the route to every port, and change where the traffic goes
+			return fmt.Errorf("manifest has routes with ports, but %s lacks feature %q; remove \"ports\" from routes, or upgrade the agent",
+				vip, version.FeatureRoutesPorts)
+		}
+		break
+	}
+	if len(cc.configRequestArgs.WildcardHostnameMap) != 0 {
+		if _, ok := fm[version.FeatureHostnamesWildcard]; !ok {
+			// not a critical error, as the wildcard hostnames are not sent in the hostname map
+			logrus.Warnf("%s lacks feature %q, wildcard hostnames will not be resolved",
+				vip, version.FeatureHostnamesWildcard)
+		}
+	}
+	httpArgs, socksArgs := cc.configRequestArgs.HTTP, cc.configRequestArgs.SOCKS
+	if httpArgs.Auth != nil || len(httpArgs.AllowedClients) != 0 || socksArgs.Auth != nil || len(socksArgs.AllowedClients) != 0 {
+		if _, ok := fm[version.FeatureProxyAuth]; !ok {
+			return fmt.Errorf("manifest has proxy auth or allowed clients, but %s lacks feature %q, aborting for security purpose",
+				vip, version.FeatureProxyAuth)
+		}
+	}
+	if cc.configRequestArgs.Egress.DisableDirect {
+		if _, ok := fm[version.FeatureEgress]; !ok {
+			return fmt.Errorf("manifest has Egress, but %s lacks feature %q, aborting for security purpose",
+				vip, version.FeatureEgress)
+		}
+	}
+	if len(cc.configRequestArgs.Policies) != 0 {
+		if _, ok := fm[version.FeaturePolicies]; !ok {
+			// not a critical error, as the manager enforces the policies too
+			logrus.Warnf("%s lacks feature %q, the HTTP and SOCKS proxies on the host will not refuse connections that violate the policies",
+				vip, version.FeaturePolicies)
+		}
+	}
+	for _, ns := range cc.configRequestArgs.NameServers {
+		if ns.Proto != "udp" {
+			continue
+		}
+		if _, ok := fm[version.FeatureDNSUDP]; !ok {
+			return fmt.Errorf("manifest has DNS over UDP (%s:%d/udp), but %s lacks feature %q; remove \"udp\" from dns.protocols, or upgrade the agent",
+				ns.IP, ns.Port, vip, version.FeatureDNSUDP)
+		}
+		break
+	}
 	if _, ok := fm[version.FeatureDNS]; !ok {
 		// not a critical error
 		logrus.Warnf("%s lacks feature %q, built-in DNS will be disabled",
 			vip, version.FeatureDNS)
 	}
+	if cc.configRequestArgs.DNS.LogQueries {
+		if _, ok := fm[version.FeatureDNSLog]; !ok {
+			// not a critical error
+			logrus.Warnf("%s lacks feature %q, DNS queries will not be logged",
+				vip, version.FeatureDNSLog)
+		}
+	}
 	return nil
 }
 
@@ -247,6 +443,33 @@ func (r *Manager) onRecvEvent(vip string, ev *jsonmsg.Event) error {
 		}
 		r.onRecvRouteSuggestionEvent(&data)
 		return nil
+	case jsonmsg.EventTypeDNSQuery:
+		var data jsonmsg.DNSQueryEventData
+		if err := json.Unmarshal(ev.Data, &data); err != nil {
+			return err
+		}
+		onRecvDNSQueryEvent(vip, &data)
+		return nil
+	case jsonmsg.EventTypeAccessLog:
+		var data jsonmsg.AccessLogEventData
+		if err := json.Unmarshal(ev.Data, &data); err != nil {
+			return err
+		}
+		return onRecvAccessLogEvent(vip, &data)
+	case jsonmsg.EventTypeDNSStats:
+		var data jsonmsg.DNSStatsEventData
+		if err := json.Unmarshal(ev.Data, &data); err != nil {
+			return err
+		}
+		onRecvDNSStatsEvent(vip, &data)
+		return nil
+	case jsonmsg.EventTypeResolverStats:
+		var data jsonmsg.ResolverStatsEventData
+		if err := json.Unmarshal(ev.Data, &data); err != nil {
+			return err
+		}
+		onRecvResolverStatsEvent(vip, &data)
+		return nil
 	default:
 		return fmt.Errorf("unexpected JSON event: %q", ev.Type)
 	}
@@ -254,7 +477,70 @@ func (r *Manager) onRecvEvent(vip string, ev *jsonmsg.Event) error {
 
 func (r *Manager) onRecvRouteSuggestionEvent(dat *jsonmsg.RouteSuggestionEventData) {
 	mayForget := true
-	r.router.Learn(dat.IP, dat.Route, mayForget)
+	r.router.LearnWithPorts(dat.IP, dat.Route, dat.Ports, mayForget)
+	if r.learntRoutesFile != "" {
+		r.learntRoutesMu.Lock()
+		r.learntRoutesNew = true
+		// The remaining new routes are saved on Close
+		if time.Since(r.learntRoutesLast) >= learntRoutesSaveInterval {
+			if err := r.saveLearntRoutes(); err != nil {
+				logrus.WithError(err).Warnf("failed to save learnt routes to %q", r.learntRoutesFile)
+			}
+		}
+		r.learntRoutesMu.Unlock()
+	}
+}
+
+func onRecvDNSQueryEvent(vip string, dat *jsonmsg.DNSQueryEventData) {
+	logrus.WithFields(logrus.Fields{
+		"client":   dat.Client,
+		"answer":   dat.Answer,
+		"upstream": dat.Upstream,
+		"latency":  dat.Latency,
+	}).Infof("dns[%s]: %s %s: %s", vip, dat.Name, dat.Type, dat.Rcode)
+}
+
+func onRecvAccessLogEvent(vip string, dat *jsonmsg.AccessLogEventData) error {
+	b, err := accesslog.Format(&dat.Entry, dat.Format)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("access[%s]: %s", vip, strings.TrimSuffix(string(b), "\n"))
+	return nil
+}
+
+// onRecvDNSStatsEvent logs the statistics in the debug level, or in the warning level
+// when the DNS failed to answer some queries.
+func onRecvDNSStatsEvent(vip string, dat *jsonmsg.DNSStatsEventData) {
+	l := logrus.WithFields(logrus.Fields{
+		"queries": dat.Queries,
+		"rcodes":  dat.Rcodes,
+	})
+	if n := dat.Rcodes["SERVFAIL"]; n != 0 {
+		l.Warnf("dns[%s]: failed to answer %d of %d queries in the last %v", vip, n, dat.Queries, dat.Interval)
+		return
+	}
+	l.Debugf("dns[%s]: answered %d queries in the last %v", vip, dat.Queries, dat.Interval)
+}
+
+// onRecvResolverStatsEvent logs the statistics in the debug level.
+func onRecvResolverStatsEvent(vip string, dat *jsonmsg.ResolverStatsEventData) {
+	logrus.WithFields(logrus.Fields{
+		"lookupCache":   dat.LookupCache,
+		"decisionCache": dat.DecisionCache,
+	}).Debugf("resolver[%s]: stats in the last %v", vip, dat.Interval)
+}
+
+// ExplainRoute explains how the manager routes a packet to the IP and the TCP port.
+// The zero port means an unknown port.
+func (r *Manager) ExplainRoute(to net.IP, port uint16) router.Explanation {
+	return r.router.Explain(to, port)
+}
+
+// ExplainRouteWithHostname explains how the hostname glob routes apply to the hostname and the TCP port.
+// The zero port means an unknown port.
+func (r *Manager) ExplainRouteWithHostname(hostname string, port uint16) router.Explanation {
+	return r.router.ExplainWithHostname(hostname, port)
 }
 
 func (r *Manager) onRecvL3(vip string, pkt *stream.Packet) error {
@@ -262,9 +548,22 @@ func (r *Manager) onRecvL3(vip string, pkt *stream.Packet) error {
 	if dstIP == nil || dstIP.To4() == nil {
 		return fmt.Errorf("packet does not contain valid dst")
 	}
-	routedIP := r.router.Route(dstIP)
+	if r.refuseByPolicy(vip, pkt) {
+		return nil
+	}
+	var dstPort uint16
+	if tcpHdr := tcpHeader(pkt.Payload); tcpHdr != nil {
+		dstPort = binary.BigEndian.Uint16(tcpHdr[2:4])
+	}
+	routedIP := r.router.RouteWithPort(dstIP, dstPort)
 	routedIPStr := routedIP.To4().String()
 	sender, ok := r.senders[routedIPStr]
+	if !ok {
+		if cc, ccOk := r.ccSet.ByVIP[vip]; ccOk && cc.configRequestArgs.Egress.Via != nil {
+			routedIPStr = cc.configRequestArgs.Egress.Via.String()
+			sender, ok = r.senders[routedIPStr]
+		}
+	}
 	if !ok {
 		return fmt.Errorf("unexpected dstIP %s (routedIP %s) in a packet from %s", dstIP.String(), routedIPStr, vip)
 	}
@@ -274,6 +573,90 @@ func (r *Manager) onRecvL3(vip string, pkt *stream.Packet) error {
 	return nil
 }
 
+// refuseByPolicy returns true when pkt is a TCP SYN packet that violates the policies.
+// The packet is dropped, and a TCP RST packet is sent back to vip, so that the client fails
+// immediately with "connection refused" rather than timing out.
+// Only SYN packets are checked, as other packets cannot establish a connection.
+func (r *Manager) refuseByPolicy(vip string, pkt *stream.Packet) bool {
+	if r.policy == nil {
+		return false
+	}
+	tcpHdr := tcpHeader(pkt.Payload)
+	if tcpHdr == nil {
+		return false
+	}
+	tcpFlags := tcpHdr[13]
+	if tcpFlags&tcpFlagSYN == 0 || tcpFlags&tcpFlagACK != 0 {
+		return false
+	}
+	dstIP := net.IP(pkt.Payload[16:20])
+	dstPort := binary.BigEndian.Uint16(tcpHdr[2:4])
+	// Do not trust the source address in the packet, as the agents may spoof the address
+	srcIP := net.ParseIP(vip)
+	allowed, rule := r.policy.Check(srcIP, dstIP, dstPort)
+	if allowed {
+		return false
+	}
+	atomic.AddUint64(&r.policyDrops[rule], 1)
+	logrus.Debugf("refused a TCP connection from %s to %s:%d, denied by policy #%d", vip, dstIP, dstPort, rule)
+	if sender, ok := r.senders[vip]; ok {
+		rstPkt := &stream.Packet{
+			Type:    stream.TypeL3,
+			Payload: tcpRST(pkt.Payload),
+		}
+		if err := sender.Send(rstPkt); err != nil {
+			logrus.WithError(err).Warnf("failed to send TCP RST to %s", vip)
+		}
+	}
+	return true
+}
+
+// PolicyDrops returns the number of the TCP SYN packets dropped by each policy.
+func (r *Manager) PolicyDrops() []uint64 {
+	res := make([]uint64, len(r.policyDrops))
+	for i := range r.policyDrops {
+		res[i] = atomic.LoadUint64(&r.policyDrops[i])
+	}
+	return res
+}
+
+// policyDropsInterval is the interval for logging the number of the TCP SYN packets dropped by the policies.
+const policyDropsInterval = time.Minute
+
+// logPolicyDropsRoutine logs the number of the TCP SYN packets dropped by the policies in the warning level,
+// when some packets were dropped since the last log.
+func (r *Manager) logPolicyDropsRoutine() {
+	last := r.PolicyDrops()
+	for range time.Tick(policyDropsInterval) {
+		drops := r.PolicyDrops()
+		var total uint64
+		fields := make(logrus.Fields)
+		for i, n := range drops {
+			if delta := n - last[i]; delta != 0 {
+				total += delta
+				fields[fmt.Sprintf("policy#%d", i)] = delta
+			}
+		}
+		last = drops
+		if total != 0 {
+			logrus.WithFields(fields).Warnf("policy: refused %d TCP connections in the last %v", total, policyDropsInterval)
+		}
+	}
+}
+
+// tcpHeader returns the TCP header of an IPv4 packet b.
+// tcpHeader returns nil if b is not a TCP packet.
+func tcpHeader(b []byte) []byte {
+	if len(b) < 20 || b[0]>>4 != 4 || b[9] != 6 /* TCP */ {
+		return nil
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if len(b) < ihl+20 {
+		return nil
+	}
+	return b[ihl:]
+}
+
 type stderrWriter struct {
 	hostname string
 	vip      string
@@ -0,0 +1,60 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package manager
+
+import (
+	"net"
+	"testing"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"github.com/norouter/norouter/pkg/version"
+	"gotest.tools/v3/assert"
+)
+
+func TestValidateAgentFeaturesRoutesPorts(t *testing.T) {
+	const vip = "127.0.42.101"
+	newManager := func(routes []jsonmsg.Route) *Manager {
+		return &Manager{
+			ccSet: &CmdClientSet{
+				ByVIP: map[string]*CmdClient{
+					vip: {
+						configRequestArgs: jsonmsg.ConfigureRequestArgs{
+							Routes: routes,
+						},
+					},
+				},
+			},
+		}
+	}
+	oldFeatures := jsonmsg.ConfigureResultData{
+		Features: []string{version.FeatureTCP, version.FeatureRoutes, version.FeatureDNS},
+	}
+	newFeatures := jsonmsg.ConfigureResultData{
+		Features: version.Features,
+	}
+	via := net.ParseIP("127.0.42.102")
+	withPorts := []jsonmsg.Route{
+		{ToCIDR: []string{"0.0.0.0/0"}, Via: via, Ports: []jsonmsg.PortRange{{Start: 443, End: 443}}},
+	}
+	withoutPorts := []jsonmsg.Route{
+		{ToCIDR: []string{"0.0.0.0/0"}, Via: via},
+	}
+
+	assert.ErrorContains(t, newManager(withPorts).validateAgentFeatures(vip, oldFeatures), version.FeatureRoutesPorts)
+	assert.NilError(t, newManager(withPorts).validateAgentFeatures(vip, newFeatures))
+	assert.NilError(t, newManager(withoutPorts).validateAgentFeatures(vip, oldFeatures))
+}
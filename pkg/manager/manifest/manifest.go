@@ -39,6 +39,77 @@ type Manifest struct {
 	// Routes is optional.
 	// Routes can be specified since NoRouter v0.4.0
 	Routes []Route `yaml:"routes",omitempty`
+
+	// LearntRoutes configures the routes learnt from the DNS responses via bastions.
+	// LearntRoutes is optional.
+	// LearntRoutes can be specified since NoRouter v0.7.0
+	LearntRoutes *LearntRoutes `yaml:"learntRoutes,omitempty"`
+
+	// Policies allow or deny TCP connections between hosts.
+	// Policies are evaluated in order, and the first matching policy wins.
+	// Connections that do not match any policy are allowed.
+	//
+	// e.g. to allow only host1 to connect to db:5432:
+	//   policies:
+	//     - action: allow
+	//       from: [host1]
+	//       to: [db]
+	//       ports: ["5432"]
+	//     - action: deny
+	//       to: [db]
+	//       ports: ["5432"]
+	//
+	// Policies are optional.
+	// Policies can be specified since NoRouter v0.7.0
+	Policies []Policy `yaml:"policies,omitempty"`
+
+	// Domain is a virtual DNS zone suffix, e.g. "mesh.internal".
+	// When Domain is specified, every host is also reachable as "<name>.<domain>",
+	// e.g. "host1.mesh.internal".
+	// Aliases without dot symbols are also suffixed.
+	//
+	// The built-in DNS is authoritative for the zone.
+	//
+	// Domain is optional.
+	// Domain can be specified since NoRouter v0.7.0
+	Domain string `yaml:"domain,omitempty"`
+
+	// DNS configures the built-in DNS of all the hosts.
+	// DNS is optional.
+	// DNS can be specified since NoRouter v0.7.0
+	DNS *GlobalDNS `yaml:"dns,omitempty"`
+}
+
+// GlobalDNS can be specified since NoRouter v0.7.0.
+//
+// The per-host configuration of the built-in DNS is specified in Host.DNS.
+type GlobalDNS struct {
+	// Records specify custom records that are not virtual hosts.
+	//
+	// e.g.
+	//   records:
+	//     - name: api.internal
+	//       type: CNAME
+	//       value: host1
+	//     - name: legacy-db
+	//       type: A
+	//       value: 192.168.95.100
+	Records []DNSRecord `yaml:"records,omitempty"`
+}
+
+// DNSRecord can be specified since NoRouter v0.7.0.
+type DNSRecord struct {
+	// Name is the name of the record, e.g. "api.internal".
+	// Name must not conflict with the virtual hostnames.
+	Name string `yaml:"name"`
+
+	// Type is "A", "CNAME", or "TXT".
+	Type string `yaml:"type"`
+
+	// Value is an IPv4 address for "A", a hostname for "CNAME", or a string for "TXT".
+	//
+	// The IP addresses of "A" records should be virtual IPs or routed via virtual hosts.
+	Value string `yaml:"value"`
 }
 
 type Host struct {
@@ -91,6 +162,9 @@ type Host struct {
 	// e.g. ["nginx.example.com", "nginx"]
 	// Aliases may contain dot symbols, but aliases with dot symbols are not added to HOSTALIASES file.
 	//
+	// Since NoRouter v0.7.0, aliases may be wildcards such as "*.host1", which matches "foo.host1" and "foo.bar.host1".
+	// Wildcards are resolved by the built-in DNS and the HTTP and SOCKS proxies, but not added to /etc/hosts.
+	//
 	// Aliases can be specified since NoRouter v0.4.0
 	Aliases []string `yaml:"aliases",omitempty`
 
@@ -99,6 +173,28 @@ type Host struct {
 	//
 	// WriteEtcHosts can be specified since NoRouter v0.4.0
 	WriteEtcHosts *bool `yaml:"writeEtcHosts",omitempty`
+
+	// Egress can be specified since NoRouter v0.7.0
+	Egress *Egress `yaml:"egress,omitempty"`
+
+	// DNS can be specified since NoRouter v0.7.0
+	DNS *DNS `yaml:"dns,omitempty"`
+
+	// Resolver can be specified since NoRouter v0.7.0
+	Resolver *Resolver `yaml:"resolver,omitempty"`
+
+	// Ingress can be specified since NoRouter v0.7.0
+	Ingress *Ingress `yaml:"ingress,omitempty"`
+
+	// AccessLog enables the access logs of the HTTP and SOCKS proxies.
+	//
+	// AccessLog can be specified since NoRouter v0.7.0
+	AccessLog *AccessLog `yaml:"accessLog,omitempty"`
+
+	// UpstreamProxy specifies the proxy for the non-mesh destinations of the HTTP and SOCKS proxies.
+	//
+	// UpstreamProxy can be specified since NoRouter v0.7.0
+	UpstreamProxy *UpstreamProxy `yaml:"upstreamProxy,omitempty"`
 }
 
 // HTTP can be specified since NoRouter v0.4.0
@@ -107,6 +203,27 @@ type HTTP struct {
 	// The address is typically a local address, e.g. "127.0.0.1:18080".
 	// When the address is not specified, HTTP proxy is disabled.
 	Listen string `yaml:"listen,omitempty"`
+
+	// Auth specifies the credentials for HTTP Basic authentication ("Proxy-Authorization" header).
+	// When Auth is not specified, the authentication is disabled.
+	//
+	// Auth can be specified since NoRouter v0.7.0
+	Auth *ProxyAuth `yaml:"auth,omitempty"`
+
+	// AllowedClients specify the CIDRs of the clients that are allowed to connect to the proxy,
+	// e.g. ["127.0.0.1/32", "192.168.95.0/24"].
+	// When AllowedClients is not specified, all the clients that can reach the address are allowed.
+	//
+	// AllowedClients can be specified since NoRouter v0.7.0
+	AllowedClients []string `yaml:"allowedClients,omitempty"`
+
+	// VIPPort specifies a port of the VIP of the host to be listened in addition to Listen, e.g. 18080.
+	// The port is published to the other hosts like Ports, so that they can use the proxy as "<VIP>:<VIPPort>".
+	// Auth and AllowedClients are applied to the port too.
+	// VIPPort requires Listen.
+	//
+	// VIPPort can be specified since NoRouter v0.7.0
+	VIPPort uint16 `yaml:"vipPort,omitempty"`
 }
 
 // SOCKS can be specified since NoRouter v0.4.0
@@ -117,6 +234,209 @@ type SOCKS struct {
 	//
 	// Supported protocol versions: SOCKS4, SOCKS4a, and SOCKS5
 	Listen string `yaml:"listen,omitempty"`
+
+	// Auth specifies the credentials for SOCKS5 username/password authentication (RFC 1929).
+	// When Auth is specified, SOCKS4 and SOCKS4a clients are rejected, as they cannot send passwords.
+	// When Auth is not specified, the authentication is disabled.
+	//
+	// Auth can be specified since NoRouter v0.7.0
+	Auth *ProxyAuth `yaml:"auth,omitempty"`
+
+	// AllowedClients specify the CIDRs of the clients that are allowed to connect to the proxy,
+	// e.g. ["127.0.0.1/32", "192.168.95.0/24"].
+	// When AllowedClients is not specified, all the clients that can reach the address are allowed.
+	//
+	// AllowedClients can be specified since NoRouter v0.7.0
+	AllowedClients []string `yaml:"allowedClients,omitempty"`
+
+	// UDP enables SOCKS5 UDP ASSOCIATE (RFC 1928).
+	// The datagrams to the virtual hosts are relayed over the mesh, but only reach the UDP listeners of the remote agents,
+	// such as the built-in DNS. The ports forwarded by the remote hosts are TCP only.
+	// UDP cannot be enabled with Auth.
+	//
+	// UDP can be specified since NoRouter v0.7.0
+	UDP bool `yaml:"udp,omitempty"`
+
+	// Bind enables SOCKS5 BIND (RFC 1928).
+	// For each BIND request, a temporary listener is opened on the VIP of the host, so that the other hosts can connect to it.
+	// When Auth is set, the BIND requests are authenticated as well as the other requests.
+	//
+	// Bind can be specified since NoRouter v0.7.0
+	Bind bool `yaml:"bind,omitempty"`
+
+	// VIPPort specifies a port of the VIP of the host to be listened in addition to Listen, e.g. 18081.
+	// The port is published to the other hosts like Ports, so that they can use the proxy as "<VIP>:<VIPPort>".
+	// Auth, AllowedClients, and Bind are applied to the port too, but UDP is not.
+	// VIPPort requires Listen.
+	//
+	// VIPPort can be specified since NoRouter v0.7.0
+	VIPPort uint16 `yaml:"vipPort,omitempty"`
+}
+
+// Ingress can be specified since NoRouter v0.7.0
+//
+// Ingress is a reverse proxy that routes plain HTTP connections by the Host header,
+// and routes TLS connections by the SNI, to the virtual hosts.
+// TLS is not terminated. The clients do not need any proxy configuration.
+type Ingress struct {
+	// Listen specifies an address to be listened by NoRouter agent processes, e.g. "127.0.0.1:8443".
+	// When the address is not specified, the ingress is disabled.
+	Listen string `yaml:"listen,omitempty"`
+
+	// Rules map hostnames to backends.
+	Rules []IngressRule `yaml:"rules,omitempty"`
+
+	// DefaultBackend is the backend for the connections that do not match any rule, e.g. "host1:80".
+	// When DefaultBackend is not specified, such connections are closed.
+	DefaultBackend string `yaml:"defaultBackend,omitempty"`
+}
+
+// IngressRule can be specified since NoRouter v0.7.0
+type IngressRule struct {
+	// Host is a hostname, e.g. "app.example.com", or a wildcard, e.g. "*.example.com".
+	// Exact hostnames take precedence over wildcards.
+	Host string `yaml:"host"`
+
+	// Backend is "host:port" of the destination, e.g. "host1:443".
+	// The host can be a virtual hostname, an alias, a virtual IP, or a name routed via the routes.
+	Backend string `yaml:"backend"`
+}
+
+// AccessLog can be specified since NoRouter v0.7.0
+type AccessLog struct {
+	// Format is either "clf" (Common Log Format, with extra fields) or "json".
+	// When Format is not specified, the format is set to "clf".
+	Format string `yaml:"format,omitempty"`
+
+	// Output is either "file" or "manager".
+	// "file" writes the logs to "access.log" in the state dir of the agent.
+	// "manager" sends the logs to the manager, and the manager prints them.
+	// When Output is not specified, the output is set to "file".
+	Output string `yaml:"output,omitempty"`
+
+	// Disable disables the access logs.
+	Disable bool `yaml:"disable,omitempty"`
+}
+
+// UpstreamProxy can be specified since NoRouter v0.7.0
+//
+// UpstreamProxy is used for the destinations that are neither virtual hosts nor routed via virtual hosts.
+// The virtual hosts are still dialed over the mesh.
+type UpstreamProxy struct {
+	// URL is "http://[user:pass@]host:port" (HTTP CONNECT) or "socks5://[user:pass@]host:port".
+	// When the port is not specified, the port is set to 80 for "http", and 1080 for "socks5".
+	// When URL is not specified, the upstream proxy is disabled.
+	URL string `yaml:"url,omitempty"`
+
+	// NoProxy specifies the destinations that are dialed directly, without the upstream proxy.
+	// The entries are "*" (all), hostnames ("example.com", which matches the subdomains too),
+	// wildcards ("*.example.com", which matches only the subdomains), IPs, and CIDRs.
+	// CIDRs are matched only against IP literals, as hostnames are resolved by the upstream proxy.
+	// "localhost" and loopback addresses are always dialed directly.
+	NoProxy []string `yaml:"noProxy,omitempty"`
+}
+
+// ProxyAuth can be specified since NoRouter v0.7.0
+type ProxyAuth struct {
+	// Username must not be empty.
+	Username string `yaml:"username"`
+	// Password is sent to the agent processes as a plain text, over the stdio of Cmd.
+	Password string `yaml:"password"`
+}
+
+// Egress can be specified since NoRouter v0.7.0.
+//
+// Egress specifies how the HTTP and SOCKS proxies handle the destinations
+// that are neither virtual hosts nor routed via virtual hosts.
+// By default, such destinations are dialed directly from the host.
+type Egress struct {
+	// DisableDirect refuses dialing such destinations directly.
+	DisableDirect bool `yaml:"disableDirect,omitempty"`
+
+	// Via specifies the virtual hostname or the virtual IP of the exit host for such destinations.
+	// Hostnames are resolved by the built-in DNS of the exit host.
+	// Specifying Via implies DisableDirect.
+	Via string `yaml:"via,omitempty"`
+}
+
+// DNS can be specified since NoRouter v0.7.0.
+//
+// DNS configures the built-in DNS served on the VIP.
+type DNS struct {
+	// Port specifies the port number of the built-in DNS.
+	// When Port is not set, the port is set to 10053.
+	Port int `yaml:"port,omitempty"`
+
+	// Protocols specify the protocols of the built-in DNS: "tcp" and/or "udp".
+	// When Protocols is not set, only "tcp" is enabled.
+	//
+	// "udp" requires all the agents to be NoRouter v0.7.0 or later,
+	// as the older agents refuse to be configured with the UDP ports of the other hosts.
+	Protocols []string `yaml:"protocols,omitempty"`
+
+	// Disable disables the built-in DNS.
+	//
+	// Hostname routes via a host that disables the built-in DNS cannot be resolved.
+	Disable bool `yaml:"disable,omitempty"`
+
+	// Upstreams specify the upstream DNS servers for the names that are not virtual,
+	// e.g. ["10.0.0.53", "10.0.0.54:5353"].
+	// When Upstreams is not set, the system DNS (/etc/resolv.conf) is used.
+	Upstreams []string `yaml:"upstreams,omitempty"`
+
+	// FallbackUpstreams specify the upstream DNS servers used when the system DNS cannot be detected.
+	// When FallbackUpstreams is not set, the fallback is set to ["8.8.8.8", "1.1.1.1"].
+	FallbackUpstreams []string `yaml:"fallbackUpstreams,omitempty"`
+
+	// DisableFallback disables FallbackUpstreams.
+	// DisableFallback is expected to be used in air-gapped sites.
+	DisableFallback bool `yaml:"disableFallback,omitempty"`
+
+	// Cache configures the cache of the upstream responses.
+	Cache *DNSCache `yaml:"cache,omitempty"`
+
+	// LogQueries enables logging the queries (client, name, type, answer, upstream, and latency).
+	// The logs are printed by the manager.
+	LogQueries bool `yaml:"logQueries,omitempty"`
+}
+
+// DNSCache can be specified since NoRouter v0.7.0.
+type DNSCache struct {
+	// Size is the number of the responses to be cached.
+	// When Size is not set, the size is set to 1024.
+	Size int `yaml:"size,omitempty"`
+
+	// Disable disables the cache.
+	Disable bool `yaml:"disable,omitempty"`
+}
+
+// Resolver can be specified since NoRouter v0.7.0.
+//
+// Resolver configures how the HTTP and SOCKS proxies resolve hostnames.
+type Resolver struct {
+	// Cache configures the cache of the resolved addresses and the decisions whether to proxy the hostnames.
+	Cache *ResolverCache `yaml:"cache,omitempty"`
+
+	// SkipSystemLookup skips looking up non-virtual hostnames with the system resolver
+	// for deciding whether to proxy the hostnames.
+	// When SkipSystemLookup is set, CIDR routes are not applied to hostnames, but
+	// hostname glob routes are still applied.
+	SkipSystemLookup bool `yaml:"skipSystemLookup,omitempty"`
+}
+
+// ResolverCache can be specified since NoRouter v0.7.0.
+type ResolverCache struct {
+	// Size is the number of the entries to be cached.
+	// When Size is not set, the size is set to 1024.
+	Size int `yaml:"size,omitempty"`
+
+	// TTL is the TTL of the cache entries, e.g. "30s".
+	// The addresses resolved with the DNS of other hosts are cached for the TTL of the DNS records, up to this TTL.
+	// When TTL is not set, the TTL is set to 30 seconds.
+	TTL string `yaml:"ttl,omitempty"`
+
+	// Disable disables the cache.
+	Disable bool `yaml:"disable,omitempty"`
 }
 
 // Loopback can be specified since NoRouter v0.4.0
@@ -154,4 +474,54 @@ type Route struct {
 	// Via is a bastion.
 	// Via is a virtual hostname or a virtual IP.
 	Via string `yaml:"via"`
+
+	// Ports optionally restricts the route to TCP port numbers or port ranges,
+	// e.g. ["443"], ["22", "8000-8999"].
+	// When Ports is empty, the route applies to all the ports.
+	//
+	// Ports can be specified since NoRouter v0.7.0
+	Ports []string `yaml:"ports,omitempty"`
+}
+
+// LearntRoutes can be specified since NoRouter v0.7.0.
+//
+// When an agent resolves a hostname that matches a hostname glob route, the manager learns
+// the route for the resolved IPs, so that the packets to the IPs are sent to the bastion.
+type LearntRoutes struct {
+	// CacheSize specifies the maximum number of the learnt routes.
+	// The least recently used route is forgotten when the cache is full.
+	// Defaults to 512.
+	CacheSize int `yaml:"cacheSize,omitempty"`
+
+	// TTL specifies the lifetime of a learnt route, e.g. "1h".
+	// When TTL is not specified, learnt routes do not expire.
+	TTL string `yaml:"ttl,omitempty"`
+
+	// File specifies the file path on the manager for saving the learnt routes,
+	// so that the routes are restored on restarting the manager.
+	// The path string can contain "~" and "${ENVVAR}".
+	// When File is not specified, the learnt routes are not saved.
+	File string `yaml:"file,omitempty"`
+}
+
+// Policy can be specified since NoRouter v0.7.0.
+//
+// Policies are enforced by the manager, and also by the HTTP and SOCKS proxies of the agents.
+// Only TCP is supported.
+type Policy struct {
+	// Action is either "allow" or "deny".
+	Action string `yaml:"action"`
+
+	// From specifies virtual hostnames or virtual IPs of the source hosts.
+	// When From is empty, the policy applies to all the hosts.
+	From []string `yaml:"from,omitempty"`
+
+	// To specifies virtual hostnames, virtual IPs, or IPv4 CIDRs of the destinations.
+	// Use CIDRs for the destinations that are reachable via routes, e.g. "192.168.95.0/24".
+	// When To is empty, the policy applies to all the destinations.
+	To []string `yaml:"to,omitempty"`
+
+	// Ports specifies TCP port numbers or port ranges, e.g. ["5432", "8000-8999"].
+	// When Ports is empty, the policy applies to all the ports.
+	Ports []string `yaml:"ports,omitempty"`
 }
@@ -22,8 +22,11 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/shlex"
+	"github.com/miekg/dns"
+	"github.com/norouter/norouter/pkg/agent/upstreamproxy"
 	"github.com/norouter/norouter/pkg/builtinports"
 	"github.com/norouter/norouter/pkg/manager/manifest"
 	"github.com/norouter/norouter/pkg/stream/jsonmsg"
@@ -35,6 +38,16 @@ type ParsedManifest struct {
 	PublicHostPorts []*jsonmsg.IPPortProto
 	Routes          []jsonmsg.Route
 	NameServers     []jsonmsg.NameServer
+	LearntRoutes    LearntRoutes
+	Policies        []jsonmsg.Policy
+	DNSRecords      []jsonmsg.DNSRecord
+	Domain          string // e.g. "mesh.internal", without the trailing dot
+}
+
+type LearntRoutes struct {
+	CacheSize int
+	TTL       time.Duration
+	File      string
 }
 
 type Host struct {
@@ -42,25 +55,76 @@ type Host struct {
 	VIP           net.IP
 	Ports         []*jsonmsg.Forward
 	HTTP          HTTP
+	Ingress       Ingress
+	AccessLog     AccessLog
 	SOCKS         SOCKS
 	Loopback      Loopback
 	StateDir      StateDir
 	Aliases       []string
 	WriteEtcHosts bool
+	Egress        Egress
+	DNS           DNS
+	Resolver      Resolver
+	UpstreamProxy jsonmsg.UpstreamProxy
+}
+
+type Resolver struct {
+	CacheSize        int
+	CacheTTL         time.Duration
+	DisableCache     bool
+	SkipSystemLookup bool
+}
+
+type DNS struct {
+	Port              uint16
+	Protocols         []string // "tcp" and/or "udp"
+	Disable           bool
+	Upstreams         []string // "IP:port"
+	FallbackUpstreams []string // "IP:port"
+	DisableFallback   bool
+	CacheSize         int
+	DisableCache      bool
+	LogQueries        bool
+}
+
+type Egress struct {
+	DisableDirect bool
+	Via           string // parsed into EgressVIP after parsing all the hosts
+	EgressVIP     net.IP
+}
+
+type Ingress struct {
+	Listen         string
+	Rules          []jsonmsg.IngressRule
+	DefaultBackend string // "host:port"
 }
 
 type HTTP struct {
-	Listen string
+	Listen         string
+	Auth           *jsonmsg.ProxyAuth
+	AllowedClients []string // CIDRs
+	VIPPort        uint16   // 0 means disabled
 }
 
 type SOCKS struct {
-	Listen string
+	Listen         string
+	Auth           *jsonmsg.ProxyAuth
+	AllowedClients []string // CIDRs
+	UDP            bool
+	Bind           bool
+	VIPPort        uint16 // 0 means disabled
 }
 
 type Loopback struct {
 	Disable bool
 }
 
+// AccessLog is disabled when Output is empty.
+type AccessLog struct {
+	Format string // "clf" or "json"
+	Output string // "file" or "manager"
+}
+
 type StateDir struct {
 	PathOnAgent string
 	Disable     bool
@@ -128,10 +192,34 @@ func New(raw *manifest.Manifest) (*ParsedManifest, error) {
 		}
 		if raw.HostTemplate != nil {
 			if raw.HostTemplate.HTTP != nil {
-				h.HTTP.Listen = raw.HostTemplate.HTTP.Listen
+				h.HTTP, err = parseHTTP(*raw.HostTemplate.HTTP)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the http of the host template: %w", err)
+				}
 			}
 			if raw.HostTemplate.SOCKS != nil {
-				h.SOCKS.Listen = raw.HostTemplate.SOCKS.Listen
+				h.SOCKS, err = parseSOCKS(*raw.HostTemplate.SOCKS)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the socks of the host template: %w", err)
+				}
+			}
+			if raw.HostTemplate.AccessLog != nil {
+				h.AccessLog, err = parseAccessLog(*raw.HostTemplate.AccessLog)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the accessLog of the host template: %w", err)
+				}
+			}
+			if raw.HostTemplate.Ingress != nil {
+				h.Ingress, err = parseIngress(*raw.HostTemplate.Ingress)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the ingress of the host template: %w", err)
+				}
+			}
+			if raw.HostTemplate.UpstreamProxy != nil {
+				h.UpstreamProxy, err = parseUpstreamProxy(*raw.HostTemplate.UpstreamProxy)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the upstreamProxy of the host template: %w", err)
+				}
 			}
 			if raw.HostTemplate.Loopback != nil {
 				h.Loopback.Disable = raw.HostTemplate.Loopback.Disable
@@ -143,12 +231,52 @@ func New(raw *manifest.Manifest) (*ParsedManifest, error) {
 			if raw.HostTemplate.WriteEtcHosts != nil {
 				h.WriteEtcHosts = *raw.HostTemplate.WriteEtcHosts
 			}
+			if raw.HostTemplate.Egress != nil {
+				h.Egress.DisableDirect = raw.HostTemplate.Egress.DisableDirect
+				h.Egress.Via = raw.HostTemplate.Egress.Via
+			}
+			if raw.HostTemplate.Resolver != nil {
+				h.Resolver, err = parseResolver(*raw.HostTemplate.Resolver)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the resolver of the host template: %w", err)
+				}
+			}
+			if raw.HostTemplate.DNS != nil {
+				h.DNS, err = parseDNS(*raw.HostTemplate.DNS)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the dns of the host template: %w", err)
+				}
+			}
 		}
 		if rh.HTTP != nil {
-			h.HTTP.Listen = rh.HTTP.Listen
+			h.HTTP, err = parseHTTP(*rh.HTTP)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the http of %q: %w", name, err)
+			}
 		}
 		if rh.SOCKS != nil {
-			h.SOCKS.Listen = rh.SOCKS.Listen
+			h.SOCKS, err = parseSOCKS(*rh.SOCKS)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the socks of %q: %w", name, err)
+			}
+		}
+		if rh.AccessLog != nil {
+			h.AccessLog, err = parseAccessLog(*rh.AccessLog)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the accessLog of %q: %w", name, err)
+			}
+		}
+		if rh.Ingress != nil {
+			h.Ingress, err = parseIngress(*rh.Ingress)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the ingress of %q: %w", name, err)
+			}
+		}
+		if rh.UpstreamProxy != nil {
+			h.UpstreamProxy, err = parseUpstreamProxy(*rh.UpstreamProxy)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the upstreamProxy of %q: %w", name, err)
+			}
 		}
 		if rh.Loopback != nil {
 			h.Loopback.Disable = rh.Loopback.Disable
@@ -160,7 +288,62 @@ func New(raw *manifest.Manifest) (*ParsedManifest, error) {
 		if rh.WriteEtcHosts != nil {
 			h.WriteEtcHosts = *rh.WriteEtcHosts
 		}
+		if rh.Egress != nil {
+			h.Egress.DisableDirect = rh.Egress.DisableDirect
+			h.Egress.Via = rh.Egress.Via
+		}
+		if rh.Resolver != nil {
+			h.Resolver, err = parseResolver(*rh.Resolver)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the resolver of %q: %w", name, err)
+			}
+		}
+		if rh.DNS != nil {
+			h.DNS, err = parseDNS(*rh.DNS)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the dns of %q: %w", name, err)
+			}
+		}
+		if h.AccessLog.Output == jsonmsg.AccessLogOutputFile && h.StateDir.Disable {
+			return nil, fmt.Errorf("accessLog of %q requires the state dir, or set the output to %q", name, jsonmsg.AccessLogOutputManager)
+		}
+		if h.UpstreamProxy.URL != "" && (h.Egress.DisableDirect || h.Egress.Via != "") {
+			return nil, fmt.Errorf("upstreamProxy of %q cannot be used with egress.disableDirect or egress.via", name)
+		}
+		if h.DNS.Port == 0 {
+			h.DNS.Port = builtinports.DNS
+		}
+		if len(h.DNS.Protocols) == 0 {
+			// "udp" is opt-in, as the agents prior to v0.7.0 reject the UDP name servers
+			h.DNS.Protocols = []string{"tcp"}
+		}
+		if !h.DNS.Disable {
+			for _, f := range h.Ports {
+				for _, proto := range h.DNS.Protocols {
+					if f.ListenPort == h.DNS.Port && f.Proto == proto {
+						return nil, fmt.Errorf("port %d/%s of %q conflicts with the built-in DNS", f.ListenPort, f.Proto, name)
+					}
+				}
+			}
+		}
+		vipPorts, err := proxyVIPPorts(h)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the vipPort of %q: %w", name, err)
+		}
+		for _, port := range vipPorts {
+			pm.PublicHostPorts = append(pm.PublicHostPorts,
+				&jsonmsg.IPPortProto{
+					IP:    vip,
+					Port:  port,
+					Proto: "tcp",
+				})
+		}
 		for _, a := range rh.Aliases {
+			if strings.Contains(a, "*") {
+				if err := validateWildcard(a); err != nil {
+					return nil, err
+				}
+			}
 			if _, ok := uniqueNames[a]; ok {
 				return nil, fmt.Errorf("name conflict: %q", a)
 			}
@@ -174,6 +357,20 @@ func New(raw *manifest.Manifest) (*ParsedManifest, error) {
 	if len(uniqueVIPs) != len(raw.Hosts) {
 		return nil, fmt.Errorf("expected to have %d unique virtual IPs (VIPs), got %d", len(raw.Hosts), len(uniqueVIPs))
 	}
+	for name, h := range pm.Hosts {
+		if h.Egress.Via == "" {
+			continue
+		}
+		via, err := parseVIP(h.Egress.Via, pm.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse egress.via of %q: %w", name, err)
+		}
+		if via.Equal(h.VIP) {
+			return nil, fmt.Errorf("egress.via of %q must not be the host itself", name)
+		}
+		h.Egress.EgressVIP = via
+		h.Egress.DisableDirect = true
+	}
 	for _, rawRoute := range raw.Routes {
 		route, err := parseRoute(rawRoute, pm.Hosts)
 		if err != nil {
@@ -181,21 +378,461 @@ func New(raw *manifest.Manifest) (*ParsedManifest, error) {
 		}
 		pm.Routes = append(pm.Routes, *route)
 	}
+	if lr := raw.LearntRoutes; lr != nil {
+		if lr.CacheSize < 0 {
+			return nil, fmt.Errorf("invalid learntRoutes.cacheSize %d", lr.CacheSize)
+		}
+		pm.LearntRoutes.CacheSize = lr.CacheSize
+		if lr.TTL != "" {
+			ttl, err := time.ParseDuration(lr.TTL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse learntRoutes.ttl %q: %w", lr.TTL, err)
+			}
+			if ttl <= 0 {
+				return nil, fmt.Errorf("invalid learntRoutes.ttl %q", lr.TTL)
+			}
+			pm.LearntRoutes.TTL = ttl
+		}
+		pm.LearntRoutes.File = lr.File
+	}
+	for i, rawPolicy := range raw.Policies {
+		policy, err := parsePolicy(rawPolicy, pm.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse policy #%d: %w", i, err)
+		}
+		pm.Policies = append(pm.Policies, *policy)
+	}
+
+	if raw.Domain != "" {
+		domain, err := parseDomain(raw.Domain, pm.Hosts, uniqueNames)
+		if err != nil {
+			return nil, err
+		}
+		pm.Domain = domain
+		for name, h := range pm.Hosts {
+			for _, n := range SuffixedNames(name, h.Aliases, domain) {
+				uniqueNames[n] = struct{}{}
+			}
+		}
+	}
+
+	if raw.DNS != nil {
+		records, err := parseDNSRecords(raw.DNS.Records, uniqueNames)
+		if err != nil {
+			return nil, err
+		}
+		pm.DNSRecords = records
+	}
 
-	// TODO: support specifying custom DNS ports via YAML
 	for _, h := range pm.Hosts {
-		ns := jsonmsg.NameServer{
-			IPPortProto: jsonmsg.IPPortProto{
-				IP:    h.VIP,
-				Port:  builtinports.DNSTCP,
-				Proto: "tcp",
-			},
+		if h.DNS.Disable {
+			continue
+		}
+		for _, proto := range h.DNS.Protocols {
+			ns := jsonmsg.NameServer{
+				IPPortProto: jsonmsg.IPPortProto{
+					IP:    h.VIP,
+					Port:  h.DNS.Port,
+					Proto: proto,
+				},
+			}
+			pm.NameServers = append(pm.NameServers, ns)
 		}
-		pm.NameServers = append(pm.NameServers, ns)
 	}
 	return pm, nil
 }
 
+func parseResolver(raw manifest.Resolver) (Resolver, error) {
+	r := Resolver{
+		SkipSystemLookup: raw.SkipSystemLookup,
+	}
+	if raw.Cache != nil {
+		if raw.Cache.Size < 0 {
+			return r, fmt.Errorf("invalid cache size %d", raw.Cache.Size)
+		}
+		r.CacheSize = raw.Cache.Size
+		if raw.Cache.TTL != "" {
+			ttl, err := time.ParseDuration(raw.Cache.TTL)
+			if err != nil {
+				return r, fmt.Errorf("failed to parse cache TTL %q: %w", raw.Cache.TTL, err)
+			}
+			if ttl <= 0 {
+				return r, fmt.Errorf("invalid cache TTL %q", raw.Cache.TTL)
+			}
+			r.CacheTTL = ttl
+		}
+		r.DisableCache = raw.Cache.Disable
+	}
+	return r, nil
+}
+
+func parseHTTP(raw manifest.HTTP) (HTTP, error) {
+	h := HTTP{
+		Listen:  raw.Listen,
+		VIPPort: raw.VIPPort,
+	}
+	if h.VIPPort != 0 && h.Listen == "" {
+		return h, errors.New("http.vipPort requires http.listen")
+	}
+	var err error
+	if h.Auth, err = parseProxyAuth(raw.Auth); err != nil {
+		return h, err
+	}
+	if h.AllowedClients, err = parseAllowedClients(raw.AllowedClients); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// proxyVIPPorts returns the VIP ports of the HTTP and SOCKS proxies of h.
+// The ports must not conflict with the other ports of h.
+func proxyVIPPorts(h *Host) ([]uint16, error) {
+	var res []uint16
+	for _, port := range []uint16{h.HTTP.VIPPort, h.SOCKS.VIPPort} {
+		if port == 0 {
+			continue
+		}
+		for _, f := range h.Ports {
+			if f.ListenPort == port && f.Proto == "tcp" {
+				return nil, fmt.Errorf("port %d/tcp conflicts with the ports", port)
+			}
+		}
+		if !h.DNS.Disable && port == h.DNS.Port {
+			return nil, fmt.Errorf("port %d/tcp conflicts with the built-in DNS", port)
+		}
+		for _, p := range res {
+			if p == port {
+				return nil, fmt.Errorf("port %d/tcp is specified for both the HTTP and SOCKS proxies", port)
+			}
+		}
+		res = append(res, port)
+	}
+	return res, nil
+}
+
+func parseSOCKS(raw manifest.SOCKS) (SOCKS, error) {
+	s := SOCKS{
+		Listen:  raw.Listen,
+		UDP:     raw.UDP,
+		Bind:    raw.Bind,
+		VIPPort: raw.VIPPort,
+	}
+	if s.VIPPort != 0 && s.Listen == "" {
+		return s, errors.New("socks.vipPort requires socks.listen")
+	}
+	var err error
+	if s.Auth, err = parseProxyAuth(raw.Auth); err != nil {
+		return s, err
+	}
+	if s.UDP && s.Auth != nil {
+		return s, errors.New("socks.udp cannot be specified with socks.auth")
+	}
+	if s.AllowedClients, err = parseAllowedClients(raw.AllowedClients); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func parseAccessLog(raw manifest.AccessLog) (AccessLog, error) {
+	if raw.Disable {
+		return AccessLog{}, nil
+	}
+	l := AccessLog{
+		Format: strings.ToLower(raw.Format),
+		Output: strings.ToLower(raw.Output),
+	}
+	switch l.Format {
+	case "":
+		l.Format = jsonmsg.AccessLogFormatCLF
+	case jsonmsg.AccessLogFormatCLF, jsonmsg.AccessLogFormatJSON:
+	default:
+		return l, fmt.Errorf("expected format be %q or %q, got %q", jsonmsg.AccessLogFormatCLF, jsonmsg.AccessLogFormatJSON, raw.Format)
+	}
+	switch l.Output {
+	case "":
+		l.Output = jsonmsg.AccessLogOutputFile
+	case jsonmsg.AccessLogOutputFile, jsonmsg.AccessLogOutputManager:
+	default:
+		return l, fmt.Errorf("expected output be %q or %q, got %q", jsonmsg.AccessLogOutputFile, jsonmsg.AccessLogOutputManager, raw.Output)
+	}
+	return l, nil
+}
+
+func parseUpstreamProxy(raw manifest.UpstreamProxy) (jsonmsg.UpstreamProxy, error) {
+	var up jsonmsg.UpstreamProxy
+	if raw.URL == "" {
+		if len(raw.NoProxy) != 0 {
+			return up, errors.New("upstreamProxy requires url")
+		}
+		return up, nil
+	}
+	up.URL = raw.URL
+	up.NoProxy = raw.NoProxy
+	// Validate early, although the agent parses up again
+	if _, err := upstreamproxy.New(up); err != nil {
+		return up, err
+	}
+	return up, nil
+}
+
+func parseIngress(raw manifest.Ingress) (Ingress, error) {
+	in := Ingress{
+		Listen:         raw.Listen,
+		DefaultBackend: raw.DefaultBackend,
+	}
+	if in.Listen == "" && (len(raw.Rules) != 0 || raw.DefaultBackend != "") {
+		return in, errors.New("ingress requires listen")
+	}
+	seen := make(map[string]struct{})
+	for i, r := range raw.Rules {
+		host := strings.TrimSuffix(strings.ToLower(r.Host), ".")
+		if host == "" {
+			return in, fmt.Errorf("ingress rule #%d lacks host", i)
+		}
+		if strings.Contains(host, "*") {
+			if err := validateWildcard(host); err != nil {
+				return in, fmt.Errorf("ingress rule #%d: %w", i, err)
+			}
+		}
+		if _, ok := seen[host]; ok {
+			return in, fmt.Errorf("ingress rule #%d: duplicated host %q", i, r.Host)
+		}
+		seen[host] = struct{}{}
+		if err := validateBackend(r.Backend); err != nil {
+			return in, fmt.Errorf("ingress rule #%d: %w", i, err)
+		}
+		in.Rules = append(in.Rules, jsonmsg.IngressRule{
+			Host:    host,
+			Backend: r.Backend,
+		})
+	}
+	if in.DefaultBackend != "" {
+		if err := validateBackend(in.DefaultBackend); err != nil {
+			return in, fmt.Errorf("ingress default backend: %w", err)
+		}
+	}
+	return in, nil
+}
+
+// validateBackend validates "host:port".
+func validateBackend(s string) error {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return fmt.Errorf("failed to parse backend %q: %w", s, err)
+	}
+	if host == "" {
+		return fmt.Errorf("backend %q lacks host", s)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("failed to parse the port of backend %q", s)
+	}
+	return nil
+}
+
+func parseProxyAuth(raw *manifest.ProxyAuth) (*jsonmsg.ProxyAuth, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	if raw.Username == "" {
+		return nil, errors.New("auth requires username")
+	}
+	// RFC 1929 limits the length of the username and the password to 255 bytes
+	if len(raw.Username) > 255 || len(raw.Password) > 255 {
+		return nil, errors.New("auth username and password must not be longer than 255 bytes")
+	}
+	if strings.Contains(raw.Username, ":") {
+		return nil, fmt.Errorf("auth username %q must not contain ':'", raw.Username)
+	}
+	return &jsonmsg.ProxyAuth{
+		Username: raw.Username,
+		Password: raw.Password,
+	}, nil
+}
+
+// parseAllowedClients parses CIDRs or IPs into CIDRs.
+func parseAllowedClients(raws []string) ([]string, error) {
+	var res []string
+	for _, raw := range raws {
+		if ip := net.ParseIP(raw); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			res = append(res, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String())
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse allowed client %q: %w", raw, err)
+		}
+		res = append(res, ipNet.String())
+	}
+	return res, nil
+}
+
+func parseDNS(raw manifest.DNS) (DNS, error) {
+	d := DNS{
+		Disable: raw.Disable,
+	}
+	if raw.Port < 0 || raw.Port > 65535 {
+		return d, fmt.Errorf("invalid port %d", raw.Port)
+	}
+	d.Port = uint16(raw.Port)
+	seen := make(map[string]struct{})
+	for _, proto := range raw.Protocols {
+		proto = strings.ToLower(proto)
+		if proto != "tcp" && proto != "udp" {
+			return d, fmt.Errorf("expected protocol be \"tcp\" or \"udp\", got %q", proto)
+		}
+		if _, ok := seen[proto]; ok {
+			continue
+		}
+		seen[proto] = struct{}{}
+		d.Protocols = append(d.Protocols, proto)
+	}
+	var err error
+	if d.Upstreams, err = parseUpstreams(raw.Upstreams); err != nil {
+		return d, err
+	}
+	if d.FallbackUpstreams, err = parseUpstreams(raw.FallbackUpstreams); err != nil {
+		return d, err
+	}
+	d.DisableFallback = raw.DisableFallback
+	d.LogQueries = raw.LogQueries
+	if raw.Cache != nil {
+		if raw.Cache.Size < 0 {
+			return d, fmt.Errorf("invalid cache size %d", raw.Cache.Size)
+		}
+		d.CacheSize = raw.Cache.Size
+		d.DisableCache = raw.Cache.Disable
+	}
+	return d, nil
+}
+
+// parseUpstreams parses "IP" or "IP:port" strings into "IP:port" strings.
+func parseUpstreams(raws []string) ([]string, error) {
+	var res []string
+	for _, raw := range raws {
+		host, port := raw, "53"
+		if ip := net.ParseIP(raw); ip == nil {
+			var err error
+			host, port, err = net.SplitHostPort(raw)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse upstream %q: %w", raw, err)
+			}
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return nil, fmt.Errorf("failed to parse the port of upstream %q: %w", raw, err)
+			}
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("expected upstream %q to be an IP address", raw)
+		}
+		res = append(res, net.JoinHostPort(host, port))
+	}
+	return res, nil
+}
+
+// validateWildcard validates a wildcard alias such as "*.host1".
+func validateWildcard(a string) error {
+	if !strings.HasPrefix(a, "*.") || strings.Contains(a[2:], "*") {
+		return fmt.Errorf("invalid wildcard alias %q: only a leading \"*.\" is supported", a)
+	}
+	if _, ok := dns.IsDomainName(a[2:]); !ok {
+		return fmt.Errorf("invalid wildcard alias %q", a)
+	}
+	return nil
+}
+
+func parseDomain(raw string, hosts map[string]*Host, uniqueNames map[string]struct{}) (string, error) {
+	domain := strings.TrimSuffix(strings.ToLower(raw), ".")
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+		return "", fmt.Errorf("invalid domain %q", raw)
+	}
+	if _, ok := uniqueNames[domain]; ok {
+		return "", fmt.Errorf("domain %q conflicts with a virtual hostname", raw)
+	}
+	for name, h := range hosts {
+		for _, n := range SuffixedNames(name, h.Aliases, domain) {
+			if _, ok := uniqueNames[n]; ok {
+				return "", fmt.Errorf("name conflict: %q", n)
+			}
+		}
+	}
+	return domain, nil
+}
+
+// SuffixedNames returns the names suffixed with the domain, for the host name and the aliases without dot symbols.
+// Wildcard aliases are suffixed too, when the names after "*." have no dot symbols, e.g. "*.host1" -> "*.host1.<domain>".
+// SuffixedNames returns nil if domain is empty.
+func SuffixedNames(name string, aliases []string, domain string) []string {
+	if domain == "" {
+		return nil
+	}
+	var res []string
+	for _, n := range append([]string{name}, aliases...) {
+		if !strings.Contains(strings.TrimPrefix(n, "*."), ".") {
+			res = append(res, n+"."+domain)
+		}
+	}
+	return res
+}
+
+func parseDNSRecords(raws []manifest.DNSRecord, hostnames map[string]struct{}) ([]jsonmsg.DNSRecord, error) {
+	canonHostnames := make(map[string]struct{})
+	for h := range hostnames {
+		canonHostnames[dns.CanonicalName(h)] = struct{}{}
+	}
+	types := make(map[string]map[string]struct{}) // key: canonical name, value: set of types
+	var res []jsonmsg.DNSRecord
+	for i, raw := range raws {
+		canon := dns.CanonicalName(raw.Name)
+		if _, ok := dns.IsDomainName(canon); !ok || canon == "." {
+			return nil, fmt.Errorf("invalid name %q in DNS record #%d", raw.Name, i)
+		}
+		if _, ok := canonHostnames[canon]; ok {
+			return nil, fmt.Errorf("name %q in DNS record #%d conflicts with a virtual hostname", raw.Name, i)
+		}
+		r := jsonmsg.DNSRecord{
+			Name:  raw.Name,
+			Type:  strings.ToUpper(raw.Type),
+			Value: raw.Value,
+		}
+		switch r.Type {
+		case jsonmsg.DNSRecordTypeA:
+			ip := net.ParseIP(r.Value)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("expected an IPv4 address for DNS record #%d, got %q", i, r.Value)
+			}
+		case jsonmsg.DNSRecordTypeCNAME:
+			if _, ok := dns.IsDomainName(r.Value); !ok || r.Value == "" {
+				return nil, fmt.Errorf("expected a hostname for DNS record #%d, got %q", i, r.Value)
+			}
+			if dns.CanonicalName(r.Value) == canon {
+				return nil, fmt.Errorf("DNS record #%d points to itself", i)
+			}
+		case jsonmsg.DNSRecordTypeTXT:
+		default:
+			return nil, fmt.Errorf("expected type be \"A\", \"CNAME\", or \"TXT\" for DNS record #%d, got %q", i, raw.Type)
+		}
+		if types[canon] == nil {
+			types[canon] = make(map[string]struct{})
+		}
+		types[canon][r.Type] = struct{}{}
+		if _, ok := types[canon][jsonmsg.DNSRecordTypeCNAME]; ok && len(types[canon]) > 1 {
+			return nil, fmt.Errorf("name %q in DNS record #%d cannot have other records along with CNAME", raw.Name, i)
+		}
+		if r.Type == jsonmsg.DNSRecordTypeCNAME {
+			for _, prev := range res {
+				if prev.Type == jsonmsg.DNSRecordTypeCNAME && dns.CanonicalName(prev.Name) == canon {
+					return nil, fmt.Errorf("name %q in DNS record #%d has multiple CNAME records", raw.Name, i)
+				}
+			}
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
 func parseRoute(raw manifest.Route, hosts map[string]*Host) (*jsonmsg.Route, error) {
 	r := &jsonmsg.Route{}
 	if h, ok := hosts[raw.Via]; ok {
@@ -222,9 +859,96 @@ func parseRoute(raw manifest.Route, hosts map[string]*Host) (*jsonmsg.Route, err
 			r.ToHostnameGlob = append(r.ToHostnameGlob, rawTo)
 		}
 	}
+	for _, rawPorts := range raw.Ports {
+		pr, err := ParsePortRange(rawPorts)
+		if err != nil {
+			return nil, err
+		}
+		r.Ports = append(r.Ports, *pr)
+	}
 	return r, nil
 }
 
+// parseVIP parses a virtual hostname or an IPv4 address
+func parseVIP(s string, hosts map[string]*Host) (net.IP, error) {
+	if h, ok := hosts[s]; ok {
+		return h.VIP, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("expected a virtual hostname or an IP, got %q", s)
+	}
+	ip = ip.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("expected a virtual hostname or an IPv4, got %q", s)
+	}
+	return ip, nil
+}
+
+func parsePolicy(raw manifest.Policy, hosts map[string]*Host) (*jsonmsg.Policy, error) {
+	p := &jsonmsg.Policy{}
+	switch action := jsonmsg.PolicyAction(raw.Action); action {
+	case jsonmsg.PolicyActionAllow, jsonmsg.PolicyActionDeny:
+		p.Action = action
+	default:
+		return nil, fmt.Errorf("expected \"action\" to be either %q or %q, got %q",
+			jsonmsg.PolicyActionAllow, jsonmsg.PolicyActionDeny, raw.Action)
+	}
+	for _, rawFrom := range raw.From {
+		ip, err := parseVIP(rawFrom, hosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse \"from\": %w", err)
+		}
+		p.FromIP = append(p.FromIP, ip)
+	}
+	for _, rawTo := range raw.To {
+		if _, ipnet, err := net.ParseCIDR(rawTo); err == nil {
+			if ipnet.IP.To4() == nil {
+				return nil, fmt.Errorf("expected \"to\" to be IPv4 CIDR, got %q", rawTo)
+			}
+			p.ToCIDR = append(p.ToCIDR, ipnet.String())
+			continue
+		}
+		ip, err := parseVIP(rawTo, hosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse \"to\": %w", err)
+		}
+		p.ToCIDR = append(p.ToCIDR, ip.String()+"/32")
+	}
+	for _, rawPorts := range raw.Ports {
+		pr, err := ParsePortRange(rawPorts)
+		if err != nil {
+			return nil, err
+		}
+		p.Ports = append(p.Ports, *pr)
+	}
+	return p, nil
+}
+
+// ParsePortRange parses "80" and "8000-8999"
+func ParsePortRange(s string) (*jsonmsg.PortRange, error) {
+	startStr, endStr := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		startStr, endStr = s[:i], s[i+1:]
+	}
+	start, err := strconv.ParseUint(startStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse port range %q: %w", s, err)
+	}
+	end, err := strconv.ParseUint(endStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse port range %q: %w", s, err)
+	}
+	if start == 0 || start > end {
+		return nil, fmt.Errorf("invalid port range %q", s)
+	}
+	pr := &jsonmsg.PortRange{
+		Start: uint16(start),
+		End:   uint16(end),
+	}
+	return pr, nil
+}
+
 func ParseCmd(cmdX interface{}) ([]string, error) {
 	switch cmd := cmdX.(type) {
 	case []string:
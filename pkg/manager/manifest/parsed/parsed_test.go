@@ -18,6 +18,7 @@ package parsed
 
 import (
 	"testing"
+	"time"
 
 	"github.com/goccy/go-yaml"
 	"github.com/norouter/norouter/pkg/manager/manifest"
@@ -142,6 +143,611 @@ hosts:
 				assert.Equal(t, false, p.Hosts["baz"].WriteEtcHosts)
 			},
 		},
+		{
+			s: `# valid manifest with learntRoutes
+hosts:
+  foo:
+    vip: "127.0.42.100"
+learntRoutes:
+  cacheSize: 4096
+  ttl: 1h30m
+  file: "~/.norouter/learnt-routes.json"
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, 4096, p.LearntRoutes.CacheSize)
+				assert.Equal(t, 90*time.Minute, p.LearntRoutes.TTL)
+				assert.Equal(t, "~/.norouter/learnt-routes.json", p.LearntRoutes.File)
+			},
+		},
+		{
+			s: `# invalid manifest with learntRoutes
+hosts:
+  foo:
+    vip: "127.0.42.100"
+learntRoutes:
+  ttl: 42
+`,
+			expectedError: "failed to parse learntRoutes.ttl",
+		},
+		{
+			s: `# valid manifest with policies
+hosts:
+  host1:
+    vip: "127.0.42.101"
+  db:
+    vip: "127.0.42.102"
+policies:
+  - action: allow
+    from: [host1]
+    to: [db]
+    ports: ["5432"]
+  - action: deny
+    to: ["db", "192.168.95.0/24"]
+    ports: ["5432", "8000-8999"]
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, 2, len(p.Policies))
+				assert.Equal(t, "127.0.42.101", p.Policies[0].FromIP[0].String())
+				assert.DeepEqual(t, []string{"127.0.42.102/32"}, p.Policies[0].ToCIDR)
+				assert.DeepEqual(t, []string{"127.0.42.102/32", "192.168.95.0/24"}, p.Policies[1].ToCIDR)
+				assert.DeepEqual(t, []jsonmsg.PortRange{{Start: 5432, End: 5432}, {Start: 8000, End: 8999}}, p.Policies[1].Ports)
+			},
+		},
+		{
+			s: `# invalid manifest with policies
+hosts:
+  host1:
+    vip: "127.0.42.101"
+policies:
+  - action: drop
+    to: [host1]
+`,
+			expectedError: "expected \"action\" to be either",
+		},
+		{
+			s: `# invalid manifest with policies (unknown host)
+hosts:
+  host1:
+    vip: "127.0.42.101"
+policies:
+  - action: deny
+    from: [host2]
+`,
+			expectedError: "expected a virtual hostname or an IP",
+		},
+		{
+			s: `# valid manifest with port-aware routes
+hosts:
+  egress:
+    vip: "127.0.42.101"
+  bastion2:
+    vip: "127.0.42.102"
+routes:
+  - via: egress
+    to: ["0.0.0.0/0"]
+    ports: ["443"]
+  - via: bastion2
+    to: ["192.168.95.0/24", "*.lab.example.com"]
+    ports: ["22", "8000-8999"]
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, 2, len(p.Routes))
+				assert.DeepEqual(t, []jsonmsg.PortRange{{Start: 443, End: 443}}, p.Routes[0].Ports)
+				assert.DeepEqual(t, []jsonmsg.PortRange{{Start: 22, End: 22}, {Start: 8000, End: 8999}}, p.Routes[1].Ports)
+			},
+		},
+		{
+			s: `# valid manifest with egress
+hostTemplate:
+  egress:
+    disableDirect: true
+hosts:
+  local:
+    vip: "127.0.42.100"
+    egress:
+      via: exit
+  exit:
+    vip: "127.0.42.101"
+    egress:
+      disableDirect: false
+  other:
+    vip: "127.0.42.102"
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, true, p.Hosts["local"].Egress.DisableDirect)
+				assert.Equal(t, "127.0.42.101", p.Hosts["local"].Egress.EgressVIP.String())
+				assert.Equal(t, false, p.Hosts["exit"].Egress.DisableDirect)
+				assert.Assert(t, p.Hosts["exit"].Egress.EgressVIP == nil)
+				assert.Equal(t, true, p.Hosts["other"].Egress.DisableDirect)
+			},
+		},
+		{
+			s: `# valid manifest with dns
+hostTemplate:
+  dns:
+    port: 20053
+hosts:
+  local:
+    vip: "127.0.42.100"
+  tcpudp:
+    vip: "127.0.42.101"
+    dns:
+      protocols: ["tcp", "udp"]
+  nodns:
+    vip: "127.0.42.102"
+    dns:
+      disable: true
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, uint16(20053), p.Hosts["local"].DNS.Port)
+				assert.DeepEqual(t, []string{"tcp"}, p.Hosts["local"].DNS.Protocols)
+				assert.Equal(t, uint16(10053), p.Hosts["tcpudp"].DNS.Port)
+				assert.DeepEqual(t, []string{"tcp", "udp"}, p.Hosts["tcpudp"].DNS.Protocols)
+				assert.Equal(t, true, p.Hosts["nodns"].DNS.Disable)
+				nsCount := make(map[string]int)
+				for _, ns := range p.NameServers {
+					nsCount[ns.IP.String()]++
+				}
+				assert.Equal(t, 1, nsCount["127.0.42.100"])
+				assert.Equal(t, 2, nsCount["127.0.42.101"])
+				assert.Equal(t, 0, nsCount["127.0.42.102"])
+			},
+		},
+		{
+			s: `# valid manifest with dns upstreams
+hostTemplate:
+  dns:
+    upstreams: ["10.0.0.53", "10.0.0.54:5353"]
+    disableFallback: true
+    cache:
+      size: 42
+    logQueries: true
+hosts:
+  local:
+    vip: "127.0.42.100"
+`,
+			validate: func(p *ParsedManifest) {
+				d := p.Hosts["local"].DNS
+				assert.DeepEqual(t, []string{"10.0.0.53:53", "10.0.0.54:5353"}, d.Upstreams)
+				assert.Equal(t, true, d.DisableFallback)
+				assert.Equal(t, 42, d.CacheSize)
+				assert.Equal(t, true, d.LogQueries)
+			},
+		},
+		{
+			s: `# valid manifest with proxy auth
+hostTemplate:
+  http:
+    listen: "127.0.0.1:18080"
+    auth:
+      username: foo
+      password: bar
+    allowedClients: ["127.0.0.1", "192.168.95.0/24"]
+  socks:
+    listen: "127.0.0.1:18081"
+    auth:
+      username: foo
+      password: baz
+hosts:
+  local:
+    vip: "127.0.42.100"
+`,
+			validate: func(p *ParsedManifest) {
+				h := p.Hosts["local"]
+				assert.DeepEqual(t, &jsonmsg.ProxyAuth{Username: "foo", Password: "bar"}, h.HTTP.Auth)
+				assert.DeepEqual(t, []string{"127.0.0.1/32", "192.168.95.0/24"}, h.HTTP.AllowedClients)
+				assert.DeepEqual(t, &jsonmsg.ProxyAuth{Username: "foo", Password: "baz"}, h.SOCKS.Auth)
+				assert.Equal(t, 0, len(h.SOCKS.AllowedClients))
+			},
+		},
+		{
+			s: `# invalid manifest with proxy auth (no username)
+hosts:
+  local:
+    vip: "127.0.42.100"
+    socks:
+      listen: "127.0.0.1:18081"
+      auth:
+        password: bar
+`,
+			expectedError: "auth requires username",
+		},
+		{
+			s: `# invalid manifest with allowed clients
+hosts:
+  local:
+    vip: "127.0.42.100"
+    http:
+      listen: "127.0.0.1:18080"
+      allowedClients: ["localhost"]
+`,
+			expectedError: "failed to parse allowed client",
+		},
+		{
+			s: `# valid manifest with SOCKS5 UDP ASSOCIATE
+hosts:
+  local:
+    vip: "127.0.42.100"
+    socks:
+      listen: "127.0.0.1:18081"
+      udp: true
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, true, p.Hosts["local"].SOCKS.UDP)
+			},
+		},
+		{
+			s: `# invalid manifest with SOCKS5 UDP ASSOCIATE (auth)
+hosts:
+  local:
+    vip: "127.0.42.100"
+    socks:
+      listen: "127.0.0.1:18081"
+      udp: true
+      auth:
+        username: foo
+        password: bar
+`,
+			expectedError: "socks.udp cannot be specified with socks.auth",
+		},
+		{
+			s: `# valid manifest with SOCKS5 BIND
+hosts:
+  local:
+    vip: "127.0.42.100"
+    socks:
+      listen: "127.0.0.1:18081"
+      udp: true
+      bind: true
+`,
+			validate: func(p *ParsedManifest) {
+				s := p.Hosts["local"].SOCKS
+				assert.Equal(t, true, s.UDP)
+				assert.Equal(t, true, s.Bind)
+			},
+		},
+		{
+			s: `# valid manifest with proxy VIP ports
+hostTemplate:
+  http:
+    listen: "127.0.0.1:18080"
+  socks:
+    listen: "127.0.0.1:18081"
+hosts:
+  local:
+    vip: "127.0.42.100"
+  exit:
+    vip: "127.0.42.101"
+    ports: ["8080:127.0.0.1:80"]
+    http:
+      listen: "127.0.0.1:18080"
+      vipPort: 18080
+    socks:
+      listen: "127.0.0.1:18081"
+      vipPort: 18081
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, uint16(0), p.Hosts["local"].HTTP.VIPPort)
+				assert.Equal(t, uint16(18080), p.Hosts["exit"].HTTP.VIPPort)
+				assert.Equal(t, uint16(18081), p.Hosts["exit"].SOCKS.VIPPort)
+				var ports []uint16
+				for _, pub := range p.PublicHostPorts {
+					assert.Equal(t, "127.0.42.101", pub.IP.String())
+					ports = append(ports, pub.Port)
+				}
+				assert.DeepEqual(t, []uint16{8080, 18080, 18081}, ports)
+			},
+		},
+		{
+			s: `# invalid manifest with proxy VIP ports (conflict)
+hosts:
+  exit:
+    vip: "127.0.42.101"
+    ports: ["8080:127.0.0.1:80"]
+    http:
+      listen: "127.0.0.1:18080"
+      vipPort: 8080
+`,
+			expectedError: "port 8080/tcp conflicts with the ports",
+		},
+		{
+			s: `# invalid manifest with proxy VIP ports (no listen)
+hosts:
+  exit:
+    vip: "127.0.42.101"
+    socks:
+      vipPort: 18081
+`,
+			expectedError: "socks.vipPort requires socks.listen",
+		},
+		{
+			s: `# valid manifest with ingress
+hosts:
+  local:
+    vip: "127.0.42.100"
+    ingress:
+      listen: "127.0.0.1:8443"
+      rules:
+        - host: "App.Example.Com"
+          backend: "host1:443"
+        - host: "*.api.example.com"
+          backend: "host1:8443"
+      defaultBackend: "host1:80"
+  host1:
+    vip: "127.0.42.101"
+`,
+			validate: func(p *ParsedManifest) {
+				in := p.Hosts["local"].Ingress
+				assert.Equal(t, "127.0.0.1:8443", in.Listen)
+				assert.DeepEqual(t, []jsonmsg.IngressRule{
+					{Host: "app.example.com", Backend: "host1:443"},
+					{Host: "*.api.example.com", Backend: "host1:8443"},
+				}, in.Rules)
+				assert.Equal(t, "host1:80", in.DefaultBackend)
+			},
+		},
+		{
+			s: `# invalid manifest with ingress (no port)
+hosts:
+  local:
+    vip: "127.0.42.100"
+    ingress:
+      listen: "127.0.0.1:8443"
+      defaultBackend: "host1"
+`,
+			expectedError: "failed to parse backend",
+		},
+		{
+			s: `# invalid manifest with ingress (no listen)
+hosts:
+  local:
+    vip: "127.0.42.100"
+    ingress:
+      defaultBackend: "host1:80"
+`,
+			expectedError: "ingress requires listen",
+		},
+		{
+			s: `# valid manifest with access log
+hostTemplate:
+  accessLog:
+    format: json
+hosts:
+  local:
+    vip: "127.0.42.100"
+  remote:
+    vip: "127.0.42.101"
+    stateDir:
+      disable: true
+    accessLog:
+      output: manager
+  quiet:
+    vip: "127.0.42.102"
+    accessLog:
+      disable: true
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, AccessLog{Format: "json", Output: "file"}, p.Hosts["local"].AccessLog)
+				assert.Equal(t, AccessLog{Format: "clf", Output: "manager"}, p.Hosts["remote"].AccessLog)
+				assert.Equal(t, AccessLog{}, p.Hosts["quiet"].AccessLog)
+			},
+		},
+		{
+			s: `# invalid manifest with access log (no state dir)
+hosts:
+  local:
+    vip: "127.0.42.100"
+    stateDir:
+      disable: true
+    accessLog:
+      format: clf
+`,
+			expectedError: "requires the state dir",
+		},
+		{
+			s: `# valid manifest with upstream proxy
+hostTemplate:
+  upstreamProxy:
+    url: "http://proxy.example.com:3128"
+    noProxy: ["*.corp.example.com", "10.0.0.0/8"]
+hosts:
+  local:
+    vip: "127.0.42.100"
+  remote:
+    vip: "127.0.42.101"
+    upstreamProxy:
+      url: "socks5://proxy.example.com"
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, "http://proxy.example.com:3128", p.Hosts["local"].UpstreamProxy.URL)
+				assert.DeepEqual(t, []string{"*.corp.example.com", "10.0.0.0/8"}, p.Hosts["local"].UpstreamProxy.NoProxy)
+				assert.Equal(t, "socks5://proxy.example.com", p.Hosts["remote"].UpstreamProxy.URL)
+				assert.Equal(t, 0, len(p.Hosts["remote"].UpstreamProxy.NoProxy))
+			},
+		},
+		{
+			s: `# invalid manifest with upstream proxy (scheme)
+hosts:
+  local:
+    vip: "127.0.42.100"
+    upstreamProxy:
+      url: "ftp://proxy.example.com"
+`,
+			expectedError: "scheme",
+		},
+		{
+			s: `# invalid manifest with upstream proxy (egress)
+hosts:
+  local:
+    vip: "127.0.42.100"
+    egress:
+      disableDirect: true
+    upstreamProxy:
+      url: "http://proxy.example.com:3128"
+`,
+			expectedError: "cannot be used with egress",
+		},
+		{
+			s: `# valid manifest with resolver
+hostTemplate:
+  resolver:
+    cache:
+      size: 42
+      ttl: 1m
+hosts:
+  local:
+    vip: "127.0.42.100"
+  other:
+    vip: "127.0.42.101"
+    resolver:
+      skipSystemLookup: true
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, 42, p.Hosts["local"].Resolver.CacheSize)
+				assert.Equal(t, time.Minute, p.Hosts["local"].Resolver.CacheTTL)
+				assert.Equal(t, 0, p.Hosts["other"].Resolver.CacheSize)
+				assert.Equal(t, true, p.Hosts["other"].Resolver.SkipSystemLookup)
+			},
+		},
+		{
+			s: `# invalid manifest with dns upstreams
+hosts:
+  local:
+    vip: "127.0.42.100"
+    dns:
+      upstreams: ["dns.example.com"]
+`,
+			expectedError: "failed to parse upstream",
+		},
+		{
+			s: `# invalid manifest with dns
+hosts:
+  local:
+    vip: "127.0.42.100"
+    dns:
+      protocols: ["sctp"]
+`,
+			expectedError: "expected protocol be",
+		},
+		{
+			s: `# invalid manifest with dns port conflicting with a forward
+hosts:
+  local:
+    vip: "127.0.42.100"
+    ports: ["10053:127.0.0.1:53"]
+`,
+			expectedError: "conflicts with the built-in DNS",
+		},
+		{
+			s: `# valid manifest with dns records
+hosts:
+  host1:
+    vip: "127.0.42.101"
+dns:
+  records:
+    - name: api.internal
+      type: cname
+      value: host1
+    - name: legacy-db
+      type: A
+      value: 192.168.95.100
+    - name: legacy-db
+      type: TXT
+      value: "foo=bar"
+`,
+			validate: func(p *ParsedManifest) {
+				assert.DeepEqual(t, []jsonmsg.DNSRecord{
+					{Name: "api.internal", Type: "CNAME", Value: "host1"},
+					{Name: "legacy-db", Type: "A", Value: "192.168.95.100"},
+					{Name: "legacy-db", Type: "TXT", Value: "foo=bar"},
+				}, p.DNSRecords)
+			},
+		},
+		{
+			s: `# invalid manifest with a dns record conflicting with a host
+hosts:
+  host1:
+    vip: "127.0.42.101"
+dns:
+  records:
+    - name: HOST1
+      type: A
+      value: 192.168.95.100
+`,
+			expectedError: "conflicts with a virtual hostname",
+		},
+		{
+			s: `# invalid manifest with a dns record having CNAME and A
+hosts:
+  host1:
+    vip: "127.0.42.101"
+dns:
+  records:
+    - name: foo
+      type: CNAME
+      value: host1
+    - name: foo
+      type: A
+      value: 192.168.95.100
+`,
+			expectedError: "cannot have other records along with CNAME",
+		},
+		{
+			s: `# valid manifest with domain
+domain: Mesh.Internal.
+hosts:
+  host1:
+    vip: "127.0.42.101"
+    aliases: ["web", "nginx.example.com", "*.host1", "*.example.com"]
+`,
+			validate: func(p *ParsedManifest) {
+				assert.Equal(t, "mesh.internal", p.Domain)
+				assert.DeepEqual(t, []string{"host1.mesh.internal", "web.mesh.internal", "*.host1.mesh.internal"},
+					SuffixedNames("host1", p.Hosts["host1"].Aliases, p.Domain))
+			},
+		},
+		{
+			s: `# invalid manifest with domain conflicting with an alias
+domain: mesh.internal
+hosts:
+  host1:
+    vip: "127.0.42.101"
+  host2:
+    vip: "127.0.42.102"
+    aliases: ["host1.mesh.internal"]
+`,
+			expectedError: "name conflict",
+		},
+		{
+			s: `# valid manifest with wildcard aliases
+hosts:
+  host1:
+    vip: "127.0.42.101"
+    aliases: ["*.host1", "*.app.host1"]
+`,
+			validate: func(p *ParsedManifest) {
+				assert.DeepEqual(t, []string{"*.host1", "*.app.host1"}, p.Hosts["host1"].Aliases)
+			},
+		},
+		{
+			s: `# invalid manifest with wildcard aliases
+hosts:
+  host1:
+    vip: "127.0.42.101"
+    aliases: ["foo.*.host1"]
+`,
+			expectedError: "invalid wildcard alias",
+		},
+		{
+			s: `# invalid manifest with egress
+hosts:
+  local:
+    vip: "127.0.42.100"
+    egress:
+      via: local
+`,
+			expectedError: "must not be the host itself",
+		},
 	}
 
 	for i, c := range testCases {
@@ -276,3 +882,48 @@ func TestParseForward(t *testing.T) {
 		assert.DeepEqual(t, c.expected, *f)
 	}
 }
+
+func TestParsePortRange(t *testing.T) {
+	type testCase struct {
+		s             string
+		expectedError string
+		expected      jsonmsg.PortRange
+	}
+
+	testCases := []testCase{
+		{
+			s:        "80",
+			expected: jsonmsg.PortRange{Start: 80, End: 80},
+		},
+		{
+			s:        "8000-8999",
+			expected: jsonmsg.PortRange{Start: 8000, End: 8999},
+		},
+		{
+			s:             "8999-8000",
+			expectedError: "invalid port range",
+		},
+		{
+			s:             "0",
+			expectedError: "invalid port range",
+		},
+		{
+			s:             "65536",
+			expectedError: "cannot parse port range",
+		},
+		{
+			s:             "http",
+			expectedError: "cannot parse port range",
+		},
+	}
+
+	for _, c := range testCases {
+		pr, err := ParsePortRange(c.s)
+		if c.expectedError != "" {
+			assert.ErrorContains(t, err, c.expectedError)
+			continue
+		}
+		assert.NilError(t, err)
+		assert.DeepEqual(t, c.expected, *pr)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/binary"
+)
+
+const (
+	tcpFlagRST = 0x04
+	tcpFlagSYN = 0x02
+	tcpFlagACK = 0x10
+)
+
+// tcpRST returns a TCP RST packet that refuses the TCP SYN packet syn (IPv4).
+// The RST packet is sent from the destination of syn to the source of syn,
+// so that the client fails immediately with "connection refused" rather than timing out.
+//
+// tcpRST returns nil if syn is not a TCP packet.
+func tcpRST(syn []byte) []byte {
+	tcpHdr := tcpHeader(syn)
+	if tcpHdr == nil {
+		return nil
+	}
+	const (
+		ipHdrLen  = 20
+		tcpHdrLen = 20
+	)
+	b := make([]byte, ipHdrLen+tcpHdrLen)
+	ip := b[:ipHdrLen]
+	ip[0] = 0x45 // version 4, IHL 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint16(ip[6:8], 0x4000) // DF
+	ip[8] = 64                                  // TTL
+	ip[9] = 6                                   // TCP
+	copy(ip[12:16], syn[16:20])
+	copy(ip[16:20], syn[12:16])
+	binary.BigEndian.PutUint16(ip[10:12], checksum(0, ip))
+
+	tcp := b[ipHdrLen:]
+	copy(tcp[0:2], tcpHdr[2:4])
+	copy(tcp[2:4], tcpHdr[0:2])
+	// SEQ is zero, as the SYN packet has no ACK. ACK acknowledges the SYN.
+	binary.BigEndian.PutUint32(tcp[8:12], binary.BigEndian.Uint32(tcpHdr[4:8])+1)
+	tcp[12] = (tcpHdrLen / 4) << 4
+	tcp[13] = tcpFlagRST | tcpFlagACK
+	var pseudo [12]byte
+	copy(pseudo[0:8], ip[12:20])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:12], tcpHdrLen)
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(checksumSum(0, pseudo[:]), tcp))
+	return b
+}
+
+// checksum returns the Internet checksum (RFC 1071) of b, with the initial sum.
+func checksum(sum uint32, b []byte) uint16 {
+	sum = checksumSum(sum, b)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func checksumSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
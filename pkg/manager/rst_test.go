@@ -0,0 +1,58 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestTCPRST(t *testing.T) {
+	syn := make([]byte, 40)
+	syn[0] = 0x45
+	binary.BigEndian.PutUint16(syn[2:4], 40)
+	syn[8] = 64
+	syn[9] = 6
+	copy(syn[12:16], net.IPv4(127, 0, 42, 100).To4())
+	copy(syn[16:20], net.IPv4(127, 0, 42, 101).To4())
+	binary.BigEndian.PutUint16(syn[20:22], 43210)
+	binary.BigEndian.PutUint16(syn[22:24], 22)
+	binary.BigEndian.PutUint32(syn[24:28], 0xfffffffe)
+	syn[32] = 5 << 4
+	syn[33] = tcpFlagSYN
+
+	rst := tcpRST(syn)
+	assert.Equal(t, 40, len(rst))
+	assert.Equal(t, "127.0.42.101", net.IP(rst[12:16]).String())
+	assert.Equal(t, "127.0.42.100", net.IP(rst[16:20]).String())
+	// The checksum of the header including the checksum field is zero
+	assert.Equal(t, uint16(0), checksum(0, rst[:20]))
+
+	tcp := tcpHeader(rst)
+	assert.Equal(t, uint16(22), binary.BigEndian.Uint16(tcp[0:2]))
+	assert.Equal(t, uint16(43210), binary.BigEndian.Uint16(tcp[2:4]))
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(tcp[4:8]))
+	assert.Equal(t, uint32(0xffffffff), binary.BigEndian.Uint32(tcp[8:12]))
+	assert.Equal(t, byte(tcpFlagRST|tcpFlagACK), tcp[13])
+	pseudo := append(append([]byte{}, rst[12:20]...), 0, 6, 0, 20)
+	assert.Equal(t, uint16(0), checksum(checksumSum(0, pseudo), tcp))
+
+	assert.Assert(t, tcpRST([]byte{0x45}) == nil)
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package policy evaluates allow/deny rules for TCP connections between hosts.
+package policy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+)
+
+func New(policies []jsonmsg.Policy) (*Policy, error) {
+	p := &Policy{}
+	for i, msg := range policies {
+		switch msg.Action {
+		case jsonmsg.PolicyActionAllow, jsonmsg.PolicyActionDeny:
+		default:
+			return nil, fmt.Errorf("policy #%d: unexpected action %q", i, msg.Action)
+		}
+		e := entry{
+			allow: msg.Action == jsonmsg.PolicyActionAllow,
+			ports: msg.Ports,
+		}
+		for _, from := range msg.FromIP {
+			from4 := from.To4()
+			if from4 == nil {
+				return nil, fmt.Errorf("policy #%d: unexpected IP %s", i, from)
+			}
+			e.from = append(e.from, from4)
+		}
+		for _, to := range msg.ToCIDR {
+			_, ipnet, err := net.ParseCIDR(to)
+			if err != nil {
+				return nil, fmt.Errorf("policy #%d: %w", i, err)
+			}
+			e.to = append(e.to, ipnet)
+		}
+		p.entries = append(p.entries, e)
+	}
+	return p, nil
+}
+
+// Policy is immutable.
+// The zero value and nil allow everything.
+type Policy struct {
+	entries []entry
+}
+
+type entry struct {
+	allow bool
+	from  []net.IP
+	to    []*net.IPNet
+	ports []jsonmsg.PortRange
+}
+
+func (e *entry) matches(src, dst net.IP, dstPort uint16) bool {
+	if len(e.from) != 0 {
+		found := false
+		for _, f := range e.from {
+			if f.Equal(src) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(e.to) != 0 {
+		found := false
+		for _, t := range e.to {
+			if t.Contains(dst) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(e.ports) != 0 {
+		found := false
+		for _, pr := range e.ports {
+			if pr.Contains(dstPort) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns whether a TCP connection from src to dst:dstPort is allowed.
+// The first matching policy wins. When no policy matches, the connection is allowed.
+//
+// rule is the index of the matched policy, or -1 when no policy matched.
+func (p *Policy) Check(src, dst net.IP, dstPort uint16) (allowed bool, rule int) {
+	if p == nil {
+		return true, -1
+	}
+	for i := range p.entries {
+		e := &p.entries[i]
+		if e.matches(src, dst, dstPort) {
+			return e.allow, i
+		}
+	}
+	return true, -1
+}
+
+// CheckDial is similar to Check but returns an error when the connection is denied.
+func (p *Policy) CheckDial(src, dst net.IP, dstPort uint16) error {
+	if allowed, rule := p.Check(src, dst, dstPort); !allowed {
+		return fmt.Errorf("connection from %s to %s:%d is denied by policy #%d", src, dst, dstPort, rule)
+	}
+	return nil
+}
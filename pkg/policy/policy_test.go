@@ -0,0 +1,74 @@
+/*
+   Copyright (C) NoRouter authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package policy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
+	"gotest.tools/v3/assert"
+)
+
+func TestPolicy(t *testing.T) {
+	policies := []jsonmsg.Policy{
+		{
+			Action: jsonmsg.PolicyActionAllow,
+			FromIP: []net.IP{net.ParseIP("127.0.42.101")},
+			ToCIDR: []string{"127.0.42.103/32"},
+			Ports:  []jsonmsg.PortRange{{Start: 5432, End: 5432}},
+		},
+		{
+			Action: jsonmsg.PolicyActionDeny,
+			ToCIDR: []string{"127.0.42.103/32"},
+		},
+		{
+			Action: jsonmsg.PolicyActionDeny,
+			FromIP: []net.IP{net.ParseIP("127.0.42.102")},
+			Ports:  []jsonmsg.PortRange{{Start: 8000, End: 8999}},
+		},
+	}
+	type testCase struct {
+		src, dst string
+		port     uint16
+		allowed  bool
+		rule     int
+	}
+	testCases := []testCase{
+		{"127.0.42.101", "127.0.42.103", 5432, true, 0},
+		{"127.0.42.101", "127.0.42.103", 22, false, 1},
+		{"127.0.42.102", "127.0.42.103", 5432, false, 1},
+		{"127.0.42.102", "127.0.42.101", 8080, false, 2},
+		{"127.0.42.102", "127.0.42.101", 9000, true, -1},
+		{"127.0.42.101", "192.168.95.1", 8080, true, -1},
+	}
+	p, err := New(policies)
+	assert.NilError(t, err)
+	for _, c := range testCases {
+		allowed, rule := p.Check(net.ParseIP(c.src), net.ParseIP(c.dst), c.port)
+		assert.Equal(t, c.allowed, allowed, "%+v", c)
+		assert.Equal(t, c.rule, rule, "%+v", c)
+	}
+	assert.ErrorContains(t, p.CheckDial(net.ParseIP("127.0.42.102"), net.ParseIP("127.0.42.103"), 5432), "denied by policy #1")
+}
+
+func TestPolicyNil(t *testing.T) {
+	var p *Policy
+	allowed, rule := p.Check(net.ParseIP("127.0.42.101"), net.ParseIP("127.0.42.102"), 80)
+	assert.Equal(t, true, allowed)
+	assert.Equal(t, -1, rule)
+}
@@ -18,9 +18,13 @@
 package router
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/golang/groupcache/lru"
 	"github.com/miekg/dns"
@@ -29,7 +33,38 @@ import (
 	"github.com/ryanuber/go-glob"
 )
 
+// DefaultLearntCacheSize is the default number of the learnt routes that may be forgotten.
+const DefaultLearntCacheSize = 512
+
+// Options for NewWithOptions.
+type Options struct {
+	// LearntCacheSize is the maximum number of the learnt routes that may be forgotten.
+	// Defaults to DefaultLearntCacheSize.
+	LearntCacheSize int
+	// LearntTTL is the lifetime of the learnt routes that may be forgotten.
+	// Zero means no expiration.
+	LearntTTL time.Duration
+}
+
 func New(routes []jsonmsg.Route, reserved []net.IP) (*Router, error) {
+	return NewWithOptions(routes, reserved, nil)
+}
+
+// NewWithOptions creates a Router. opts may be nil.
+func NewWithOptions(routes []jsonmsg.Route, reserved []net.IP, opts *Options) (*Router, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.LearntCacheSize < 0 {
+		return nil, fmt.Errorf("unexpected learnt cache size %d", opts.LearntCacheSize)
+	}
+	if opts.LearntTTL < 0 {
+		return nil, fmt.Errorf("unexpected learnt TTL %v", opts.LearntTTL)
+	}
+	cacheSize := opts.LearntCacheSize
+	if cacheSize == 0 {
+		cacheSize = DefaultLearntCacheSize
+	}
 	learntNeverForget := make(map[string]string)
 	for _, ip := range reserved {
 		ip = ip.To4()
@@ -39,10 +74,17 @@ func New(routes []jsonmsg.Route, reserved []net.IP) (*Router, error) {
 		s := ip.String()
 		learntNeverForget[s] = s
 	}
-	learntMayForget := lru.New(512)
+	learntMayForget := lru.New(cacheSize)
 	r := &Router{
-		learntNeverForget: learntNeverForget,
-		learntMayForget:   learntMayForget,
+		learntNeverForget:     learntNeverForget,
+		learntMayForget:       learntMayForget,
+		learntMayForgetMirror: make(map[string]*learntEntry),
+		learntTTL:             opts.LearntTTL,
+		now:                   time.Now,
+	}
+	// learntMayForgetMirror exists because lru.Cache cannot be iterated
+	learntMayForget.OnEvicted = func(k lru.Key, _ interface{}) {
+		delete(r.learntMayForgetMirror, k.(string))
 	}
 	for _, msg := range routes {
 		for _, to := range msg.ToCIDR {
@@ -50,11 +92,11 @@ func New(routes []jsonmsg.Route, reserved []net.IP) (*Router, error) {
 			if err != nil {
 				return nil, err
 			}
-			e := ipEntry{IPNet: *ipnet, Via: msg.Via}
+			e := ipEntry{IPNet: *ipnet, Ports: msg.Ports, Via: msg.Via}
 			r.ipEntries = append(r.ipEntries, e)
 		}
 		for _, to := range msg.ToHostnameGlob {
-			e := globEntry{Glob: to, Via: msg.Via}
+			e := globEntry{Glob: to, Ports: msg.Ports, Via: msg.Via}
 			r.globEntries = append(r.globEntries, e)
 		}
 
@@ -63,24 +105,62 @@ func New(routes []jsonmsg.Route, reserved []net.IP) (*Router, error) {
 }
 
 type Router struct {
-	mu                sync.RWMutex
-	learntNeverForget map[string]string
-	learntMayForget   *lru.Cache
-	ipEntries         []ipEntry
-	globEntries       []globEntry
+	// mu is not a RWMutex, because learntMayForget.Get mutates the LRU list
+	mu                    sync.Mutex
+	learntNeverForget     map[string]string
+	learntMayForget       *lru.Cache // key: string, value: *learntEntry
+	learntMayForgetMirror map[string]*learntEntry
+	learntTTL             time.Duration
+	ipEntries             []ipEntry
+	globEntries           []globEntry
+	now                   func() time.Time // for testing
+}
+
+type learntEntry struct {
+	Via     string
+	Ports   []jsonmsg.PortRange // empty means all ports
+	Learnt  time.Time
+	Expires time.Time // zero means no expiration
+}
+
+func (e *learntEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
 }
 
 type ipEntry struct {
 	IPNet net.IPNet
+	Ports []jsonmsg.PortRange
 	Via   net.IP
 }
 
 type globEntry struct {
-	Glob string
-	Via  net.IP
+	Glob  string
+	Ports []jsonmsg.PortRange
+	Via   net.IP
+}
+
+// portsMatch returns true if ports is empty or contains port.
+// The zero port means an unknown port, and only matches the empty ports.
+func portsMatch(ports []jsonmsg.PortRange, port uint16) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	for _, pr := range ports {
+		if pr.Contains(port) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *Router) Learn(to []net.IP, suggestedRoute net.IP, mayForget bool) {
+	r.LearnWithPorts(to, suggestedRoute, nil, mayForget)
+}
+
+// LearnWithPorts is similar to Learn but restricts the learnt routes to ports.
+// ports should be the ports of the route that suggestedRoute was derived from.
+// The ports are ignored for the routes that are never forgotten.
+func (r *Router) LearnWithPorts(to []net.IP, suggestedRoute net.IP, ports []jsonmsg.PortRange, mayForget bool) {
 	suggestedRoute = suggestedRoute.To4()
 	if suggestedRoute == nil {
 		return
@@ -88,6 +168,7 @@ func (r *Router) Learn(to []net.IP, suggestedRoute net.IP, mayForget bool) {
 	mapV := suggestedRoute.String()
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	now := r.now()
 	for _, f := range to {
 		ip := f.To4()
 		if ip == nil {
@@ -95,50 +176,243 @@ func (r *Router) Learn(to []net.IP, suggestedRoute net.IP, mayForget bool) {
 		}
 		mapK := ip.String()
 		if mayForget {
-			r.learntMayForget.Add(mapK, mapV)
+			e := &learntEntry{
+				Via:    mapV,
+				Ports:  ports,
+				Learnt: now,
+			}
+			if r.learntTTL > 0 {
+				e.Expires = now.Add(r.learntTTL)
+			}
+			r.addLearntMayForget(mapK, e)
 		} else {
 			r.learntNeverForget[mapK] = mapV
 		}
 	}
 }
 
+// addLearntMayForget must be called with r.mu held.
+func (r *Router) addLearntMayForget(k string, e *learntEntry) {
+	r.learntMayForget.Add(k, e)
+	r.learntMayForgetMirror[k] = e
+}
+
+// lookupLearntMayForget must be called with r.mu held.
+func (r *Router) lookupLearntMayForget(k string) (*learntEntry, bool) {
+	v, ok := r.learntMayForget.Get(k)
+	if !ok {
+		return nil, false
+	}
+	e := v.(*learntEntry)
+	if e.expired(r.now()) {
+		r.learntMayForget.Remove(k)
+		return nil, false
+	}
+	return e, true
+}
+
+// LookupLearnt returns the unexpired learnt route for to, that may be forgotten.
+func (r *Router) LookupLearnt(to net.IP) (LearntRoute, bool) {
+	ip4 := to.To4()
+	if ip4 == nil {
+		return LearntRoute{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.lookupLearntMayForget(ip4.String())
+	if !ok {
+		return LearntRoute{}, false
+	}
+	return LearntRoute{
+		IP:      ip4,
+		Via:     net.ParseIP(e.Via),
+		Ports:   e.Ports,
+		Learnt:  e.Learnt,
+		Expires: e.Expires,
+	}, true
+}
+
 // Route won't return nil (unless to is nil)
+//
+// Route ignores the routes with ports.
 func (r *Router) Route(to net.IP) net.IP {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	return r.RouteWithPort(to, 0)
+}
+
+// RouteWithPort is similar to Route but takes the TCP port into account.
+// The zero port means an unknown port.
+func (r *Router) RouteWithPort(to net.IP, port uint16) net.IP {
+	return r.Explain(to, port).Via
+}
+
+// RouteWithHostname may return nil
+//
+// RouteWithHostname ignores the routes with ports.
+func (r *Router) RouteWithHostname(hostname string) net.IP {
+	return r.RouteWithHostnameAndPort(hostname, 0)
+}
+
+// RouteWithHostnameAndPort is similar to RouteWithHostname but takes the TCP port into account.
+// The zero port means an unknown port.
+func (r *Router) RouteWithHostnameAndPort(hostname string, port uint16) net.IP {
+	return r.ExplainWithHostname(hostname, port).Via
+}
+
+// ExplanationKind is the kind of Explanation.
+type ExplanationKind string
+
+const (
+	// ExplanationKindReserved: the destination is a reserved IP such as a VIP
+	ExplanationKindReserved ExplanationKind = "reserved"
+	// ExplanationKindLearnt: the destination matched a learnt route
+	ExplanationKindLearnt ExplanationKind = "learnt"
+	// ExplanationKindLearntNeverForget: the destination matched a learnt route that is never forgotten
+	ExplanationKindLearntNeverForget ExplanationKind = "learntNeverForget"
+	// ExplanationKindCIDR: the destination matched a CIDR route
+	ExplanationKindCIDR ExplanationKind = "cidr"
+	// ExplanationKindHostnameGlob: the destination matched a hostname glob route
+	ExplanationKindHostnameGlob ExplanationKind = "hostnameGlob"
+	// ExplanationKindNone: no route matched
+	ExplanationKindNone ExplanationKind = "none"
+)
+
+// Explanation explains the decision of Route and RouteWithHostname.
+type Explanation struct {
+	Kind ExplanationKind `json:"kind"`
+	// Via is same as the return value of Route or RouteWithHostname.
+	Via net.IP `json:"via,omitempty"`
+	// Match is the matched CIDR or hostname glob.
+	Match string `json:"match,omitempty"`
+	// Ports is the ports of the matched route.
+	Ports []jsonmsg.PortRange `json:"ports,omitempty"`
+	// Learnt and Expires are set for ExplanationKindLearnt.
+	// Expires is zero when the route does not expire.
+	Learnt  time.Time `json:"learnt,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Explain explains the decision of RouteWithPort.
+func (r *Router) Explain(to net.IP, port uint16) Explanation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
 	if ip4 := to.To4(); ip4 != nil {
 		k := ip4.String()
 		if v, ok := r.learntNeverForget[k]; ok {
-			return net.ParseIP(v)
+			kind := ExplanationKindLearntNeverForget
+			if v == k {
+				kind = ExplanationKindReserved
+			}
+			return Explanation{Kind: kind, Via: net.ParseIP(v)}
 		}
-		if lruV, ok := r.learntMayForget.Get(k); ok {
-			return net.ParseIP(lruV.(string))
+		// The learnt route restricted with ports does not hide the CIDR routes for the other ports
+		if e, ok := r.lookupLearntMayForget(k); ok && portsMatch(e.Ports, port) {
+			return Explanation{
+				Kind:    ExplanationKindLearnt,
+				Via:     net.ParseIP(e.Via),
+				Ports:   e.Ports,
+				Learnt:  e.Learnt,
+				Expires: e.Expires,
+			}
 		}
 	}
 
 	// reverse order
 	for i := len(r.ipEntries) - 1; i >= 0; i-- {
 		e := r.ipEntries[i]
-		if e.IPNet.Contains(to) {
-			return e.Via
+		if e.IPNet.Contains(to) && portsMatch(e.Ports, port) {
+			return Explanation{Kind: ExplanationKindCIDR, Via: e.Via, Match: e.IPNet.String(), Ports: e.Ports}
 		}
 	}
-	return to
+	return Explanation{Kind: ExplanationKindNone, Via: to}
 }
 
-// RouteWithHostname may return nil
-func (r *Router) RouteWithHostname(hostname string) net.IP {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// ExplainWithHostname explains the decision of RouteWithHostnameAndPort.
+func (r *Router) ExplainWithHostname(hostname string, port uint16) Explanation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
 	canon := dns.CanonicalName(hostname)
 	// reverse order
 	for i := len(r.globEntries) - 1; i >= 0; i-- {
 		e := r.globEntries[i]
-		if glob.Glob(dns.CanonicalName(e.Glob), canon) {
-			return e.Via
+		if glob.Glob(dns.CanonicalName(e.Glob), canon) && portsMatch(e.Ports, port) {
+			return Explanation{Kind: ExplanationKindHostnameGlob, Via: e.Via, Match: e.Glob, Ports: e.Ports}
+		}
+	}
+	return Explanation{Kind: ExplanationKindNone}
+}
+
+// LearntRoute is the serialized form of a learnt route that may be forgotten.
+type LearntRoute struct {
+	IP      net.IP              `json:"ip"`
+	Via     net.IP              `json:"via"`
+	Ports   []jsonmsg.PortRange `json:"ports,omitempty"` // empty means all ports
+	Learnt  time.Time           `json:"learnt"`
+	Expires time.Time           `json:"expires,omitempty"` // zero means no expiration
+}
+
+// SaveLearnt writes the unexpired learnt routes that may be forgotten, as a JSON array.
+// The routes are sorted from the oldest to the newest.
+func (r *Router) SaveLearnt(w io.Writer) error {
+	r.mu.Lock()
+	now := r.now()
+	res := make([]LearntRoute, 0, len(r.learntMayForgetMirror))
+	for k, e := range r.learntMayForgetMirror {
+		if e.expired(now) {
+			continue
+		}
+		res = append(res, LearntRoute{
+			IP:      net.ParseIP(k),
+			Via:     net.ParseIP(e.Via),
+			Ports:   e.Ports,
+			Learnt:  e.Learnt,
+			Expires: e.Expires,
+		})
+	}
+	r.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Learnt.Before(res[j].Learnt)
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
+
+// LoadLearnt loads the routes written by SaveLearnt.
+// Expired routes are ignored.
+// When the current TTL is shorter than the TTL of a loaded route, the current TTL is applied.
+func (r *Router) LoadLearnt(rd io.Reader) error {
+	var routes []LearntRoute
+	if err := json.NewDecoder(rd).Decode(&routes); err != nil {
+		return err
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Learnt.Before(routes[j].Learnt)
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for _, lr := range routes {
+		ip, via := lr.IP.To4(), lr.Via.To4()
+		if ip == nil || via == nil {
+			return fmt.Errorf("unexpected learnt route %+v", lr)
+		}
+		e := &learntEntry{
+			Via:     via.String(),
+			Ports:   lr.Ports,
+			Learnt:  lr.Learnt,
+			Expires: lr.Expires,
+		}
+		if r.learntTTL > 0 {
+			if exp := lr.Learnt.Add(r.learntTTL); e.Expires.IsZero() || exp.Before(e.Expires) {
+				e.Expires = exp
+			}
+		}
+		if e.expired(now) {
+			continue
 		}
+		r.addLearntMayForget(ip.String(), e)
 	}
 	return nil
 }
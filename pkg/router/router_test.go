@@ -17,8 +17,10 @@
 package router
 
 import (
+	"bytes"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/norouter/norouter/pkg/stream/jsonmsg"
 	"gotest.tools/v3/assert"
@@ -142,3 +144,178 @@ func TestRouterHostname(t *testing.T) {
 		assert.Equal(t, expected, r.RouteWithHostname(to).String())
 	}
 }
+
+func TestRouterLearntCacheSize(t *testing.T) {
+	r, err := NewWithOptions(nil, nil, &Options{LearntCacheSize: 2})
+	assert.NilError(t, err)
+	via := net.ParseIP("127.0.42.101")
+	r.Learn([]net.IP{net.ParseIP("192.168.95.1")}, via, true)
+	r.Learn([]net.IP{net.ParseIP("192.168.95.2")}, via, true)
+	r.Learn([]net.IP{net.ParseIP("192.168.95.3")}, via, true)
+	assert.Equal(t, "192.168.95.1", r.Route(net.ParseIP("192.168.95.1")).String())
+	assert.Equal(t, "127.0.42.101", r.Route(net.ParseIP("192.168.95.2")).String())
+	assert.Equal(t, "127.0.42.101", r.Route(net.ParseIP("192.168.95.3")).String())
+	assert.Equal(t, 2, len(r.learntMayForgetMirror))
+}
+
+func TestRouterLearntTTL(t *testing.T) {
+	r, err := NewWithOptions(nil, nil, &Options{LearntTTL: time.Minute})
+	assert.NilError(t, err)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	r.Learn([]net.IP{net.ParseIP("192.168.95.1")}, net.ParseIP("127.0.42.101"), true)
+	now = now.Add(59 * time.Second)
+	assert.Equal(t, "127.0.42.101", r.Route(net.ParseIP("192.168.95.1")).String())
+	now = now.Add(time.Second)
+	assert.Equal(t, "192.168.95.1", r.Route(net.ParseIP("192.168.95.1")).String())
+	assert.Equal(t, 0, len(r.learntMayForgetMirror))
+}
+
+func TestRouterLearntSaveLoad(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	r, err := NewWithOptions(nil, nil, &Options{LearntTTL: time.Hour})
+	assert.NilError(t, err)
+	r.now = func() time.Time { return now }
+	r.Learn([]net.IP{net.ParseIP("192.168.95.1")}, net.ParseIP("127.0.42.101"), true)
+	now = now.Add(30 * time.Minute)
+	r.Learn([]net.IP{net.ParseIP("192.168.95.2")}, net.ParseIP("127.0.42.102"), true)
+	r.Learn([]net.IP{net.ParseIP("192.168.95.3")}, net.ParseIP("127.0.42.103"), false)
+	var buf bytes.Buffer
+	assert.NilError(t, r.SaveLearnt(&buf))
+
+	now = now.Add(45 * time.Minute)
+	r2, err := NewWithOptions(nil, nil, &Options{LearntTTL: time.Hour})
+	assert.NilError(t, err)
+	r2.now = func() time.Time { return now }
+	assert.NilError(t, r2.LoadLearnt(&buf))
+	testCases := map[string]string{
+		"192.168.95.1": "192.168.95.1", // expired
+		"192.168.95.2": "127.0.42.102",
+		"192.168.95.3": "192.168.95.3", // never-forget routes are not saved
+	}
+	for to, expected := range testCases {
+		assert.Equal(t, expected, r2.Route(net.ParseIP(to)).String())
+	}
+}
+
+func TestRouterExplain(t *testing.T) {
+	routes := []jsonmsg.Route{
+		{
+			ToCIDR:         []string{"192.168.95.0/24"},
+			ToHostnameGlob: []string{"*.cloud1.example.com"},
+			Via:            net.ParseIP("127.0.42.101"),
+		},
+	}
+	r, err := New(routes, []net.IP{net.ParseIP("127.0.42.101")})
+	assert.NilError(t, err)
+	r.Learn([]net.IP{net.ParseIP("192.168.96.1")}, net.ParseIP("127.0.42.102"), true)
+
+	x := r.Explain(net.ParseIP("127.0.42.101"), 0)
+	assert.Equal(t, ExplanationKindReserved, x.Kind)
+	assert.Equal(t, "127.0.42.101", x.Via.String())
+
+	x = r.Explain(net.ParseIP("192.168.95.1"), 0)
+	assert.Equal(t, ExplanationKindCIDR, x.Kind)
+	assert.Equal(t, "192.168.95.0/24", x.Match)
+	assert.Equal(t, "127.0.42.101", x.Via.String())
+
+	x = r.Explain(net.ParseIP("192.168.96.1"), 0)
+	assert.Equal(t, ExplanationKindLearnt, x.Kind)
+	assert.Equal(t, "127.0.42.102", x.Via.String())
+
+	x = r.Explain(net.ParseIP("192.168.97.1"), 0)
+	assert.Equal(t, ExplanationKindNone, x.Kind)
+	assert.Equal(t, "192.168.97.1", x.Via.String())
+
+	x = r.ExplainWithHostname("foo.cloud1.example.com", 0)
+	assert.Equal(t, ExplanationKindHostnameGlob, x.Kind)
+	assert.Equal(t, "*.cloud1.example.com", x.Match)
+	assert.Equal(t, "127.0.42.101", x.Via.String())
+
+	x = r.ExplainWithHostname("foo.cloud2.example.com", 0)
+	assert.Equal(t, ExplanationKindNone, x.Kind)
+	assert.Assert(t, x.Via == nil)
+}
+
+func TestRouterPorts(t *testing.T) {
+	routes := []jsonmsg.Route{
+		{
+			ToCIDR: []string{"0.0.0.0/0"},
+			Ports:  []jsonmsg.PortRange{{Start: 443, End: 443}},
+			Via:    net.ParseIP("127.0.42.101"),
+		},
+		{
+			ToCIDR:         []string{"192.168.95.0/24"},
+			ToHostnameGlob: []string{"*.lab.example.com"},
+			Ports:          []jsonmsg.PortRange{{Start: 22, End: 22}, {Start: 8000, End: 8999}},
+			Via:            net.ParseIP("127.0.42.102"),
+		},
+	}
+	type testCase struct {
+		to       string
+		port     uint16
+		expected string
+	}
+	testCases := []testCase{
+		{"192.168.94.1", 443, "127.0.42.101"},
+		{"192.168.94.1", 80, "192.168.94.1"},
+		{"192.168.94.1", 0, "192.168.94.1"},
+		{"192.168.95.1", 22, "127.0.42.102"},
+		{"192.168.95.1", 8080, "127.0.42.102"},
+		{"192.168.95.1", 443, "127.0.42.101"},
+		{"192.168.95.1", 80, "192.168.95.1"},
+	}
+	r, err := New(routes, nil)
+	assert.NilError(t, err)
+	for _, c := range testCases {
+		assert.Equal(t, c.expected, r.RouteWithPort(net.ParseIP(c.to), c.port).String(), "%+v", c)
+	}
+	assert.Equal(t, "192.168.95.1", r.Route(net.ParseIP("192.168.95.1")).String())
+
+	hostnameTestCases := []testCase{
+		{"host1.lab.example.com", 22, "127.0.42.102"},
+		{"host1.lab.example.com", 80, "<nil>"},
+		{"host1.lab.example.com", 0, "<nil>"},
+	}
+	for _, c := range hostnameTestCases {
+		assert.Equal(t, c.expected, r.RouteWithHostnameAndPort(c.to, c.port).String(), "%+v", c)
+	}
+}
+
+func TestRouterLearntPorts(t *testing.T) {
+	routes := []jsonmsg.Route{
+		{
+			ToCIDR: []string{"0.0.0.0/0"},
+			Via:    net.ParseIP("127.0.42.101"),
+		},
+		{
+			ToHostnameGlob: []string{"*.internal.example.com"},
+			Ports:          []jsonmsg.PortRange{{Start: 22, End: 22}},
+			Via:            net.ParseIP("127.0.42.102"),
+		},
+	}
+	r, err := New(routes, nil)
+	assert.NilError(t, err)
+	x := r.ExplainWithHostname("db.internal.example.com", 22)
+	assert.Equal(t, "127.0.42.102", x.Via.String())
+	r.LearnWithPorts([]net.IP{net.ParseIP("10.0.0.1")}, x.Via, x.Ports, true)
+
+	x = r.Explain(net.ParseIP("10.0.0.1"), 22)
+	assert.Equal(t, ExplanationKindLearnt, x.Kind)
+	assert.Equal(t, "127.0.42.102", x.Via.String())
+	assert.DeepEqual(t, []jsonmsg.PortRange{{Start: 22, End: 22}}, x.Ports)
+
+	// The learnt route must not be used for the other ports
+	x = r.Explain(net.ParseIP("10.0.0.1"), 5432)
+	assert.Equal(t, ExplanationKindCIDR, x.Kind)
+	assert.Equal(t, "127.0.42.101", x.Via.String())
+	assert.Equal(t, "127.0.42.101", r.Route(net.ParseIP("10.0.0.1")).String())
+
+	var buf bytes.Buffer
+	assert.NilError(t, r.SaveLearnt(&buf))
+	r2, err := New(routes, nil)
+	assert.NilError(t, err)
+	assert.NilError(t, r2.LoadLearnt(&buf))
+	assert.Equal(t, "127.0.42.102", r2.RouteWithPort(net.ParseIP("10.0.0.1"), 22).String())
+	assert.Equal(t, "127.0.42.101", r2.RouteWithPort(net.ParseIP("10.0.0.1"), 5432).String())
+}
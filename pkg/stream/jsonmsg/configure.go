@@ -17,7 +17,10 @@
 package jsonmsg
 
 import (
+	"fmt"
 	"net"
+	"strconv"
+	"time"
 
 	"github.com/norouter/norouter/pkg/version"
 )
@@ -41,6 +44,31 @@ type ConfigureRequestArgs struct {
 	// Fields added in v0.5.0
 	Routes      []Route      `json:"routes,omitempty"`
 	NameServers []NameServer `json:"nameServers,omitempty"`
+	// Fields added in v0.7.0
+	Policies      []Policy      `json:"policies,omitempty"`
+	Egress        Egress        `json:"egress,omitempty"`
+	DNSRecords    []DNSRecord   `json:"dnsRecords,omitempty"`
+	DNS           DNS           `json:"dns,omitempty"`
+	Domain        string        `json:"domain,omitempty"` // e.g. "mesh.internal"
+	Resolver      Resolver      `json:"resolver,omitempty"`
+	Ingress       Ingress       `json:"ingress,omitempty"`
+	AccessLog     AccessLog     `json:"accessLog,omitempty"`
+	UpstreamProxy UpstreamProxy `json:"upstreamProxy,omitempty"`
+	// WildcardHostnameMap maps the wildcard hostnames such as "*.host1" to the IPs.
+	// WildcardHostnameMap is separated from HostnameMap, as the older agents write HostnameMap to /etc/hosts verbatim.
+	WildcardHostnameMap map[string]net.IP `json:"wildcardHostnameMap,omitempty"`
+}
+
+// Hostnames returns the union of HostnameMap and WildcardHostnameMap.
+func (args *ConfigureRequestArgs) Hostnames() map[string]net.IP {
+	res := make(map[string]net.IP, len(args.HostnameMap)+len(args.WildcardHostnameMap))
+	for k, v := range args.HostnameMap {
+		res[k] = v
+	}
+	for k, v := range args.WildcardHostnameMap {
+		res[k] = v
+	}
+	return res
 }
 
 type ConfigureResultData struct {
@@ -68,10 +96,60 @@ type IPPortProto struct {
 
 type HTTP struct {
 	Listen string `json:"listen,omitempty"`
+	// Fields added in v0.7.0
+	Auth           *ProxyAuth `json:"auth,omitempty"`
+	AllowedClients []string   `json:"allowedClients,omitempty"` // CIDRs
+	VIPPort        uint16     `json:"vipPort,omitempty"`        // Port of "me" in the netstack
 }
 
 type SOCKS struct {
 	Listen string `json:"listen,omitempty"`
+	// Fields added in v0.7.0
+	Auth           *ProxyAuth `json:"auth,omitempty"`
+	AllowedClients []string   `json:"allowedClients,omitempty"` // CIDRs
+	UDP            bool       `json:"udp,omitempty"`            // SOCKS5 UDP ASSOCIATE
+	Bind           bool       `json:"bind,omitempty"`           // SOCKS5 BIND
+	VIPPort        uint16     `json:"vipPort,omitempty"`        // Port of "me" in the netstack
+}
+
+// Ingress is the configuration of the reverse proxy that routes connections by the Host header or the SNI.
+type Ingress struct {
+	Listen         string        `json:"listen,omitempty"`
+	Rules          []IngressRule `json:"rules,omitempty"`
+	DefaultBackend string        `json:"defaultBackend,omitempty"` // "host:port"
+}
+
+type IngressRule struct {
+	Host    string `json:"host"`    // e.g. "app.example.com", "*.example.com"
+	Backend string `json:"backend"` // "host:port", e.g. "host1:443"
+}
+
+const (
+	AccessLogFormatCLF  = "clf"  // Common Log Format, with extra fields
+	AccessLogFormatJSON = "json" // AccessLogEntry
+
+	AccessLogOutputFile    = "file"    // "access.log" in the state dir
+	AccessLogOutputManager = "manager" // EventTypeAccessLog
+)
+
+// AccessLog is the configuration of the access logs of the HTTP and SOCKS proxies.
+// The zero value disables the access logs.
+type AccessLog struct {
+	Format string `json:"format,omitempty"` // AccessLogFormatCLF or AccessLogFormatJSON
+	Output string `json:"output,omitempty"` // AccessLogOutputFile or AccessLogOutputManager
+}
+
+// UpstreamProxy is the proxy for the non-mesh destinations of the HTTP and SOCKS proxies.
+// The zero value disables the upstream proxy.
+type UpstreamProxy struct {
+	URL     string   `json:"url,omitempty"`     // "http://[user:pass@]host:port" or "socks5://[user:pass@]host:port"
+	NoProxy []string `json:"noProxy,omitempty"` // "*", hostnames, "*.example.com", IPs, and CIDRs
+}
+
+// ProxyAuth is the credentials of the HTTP and SOCKS proxies.
+type ProxyAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 type Loopback struct {
@@ -83,13 +161,89 @@ type StateDir struct {
 	Disable bool   `json:"disable,omitempty"`
 }
 
+// Egress specifies how the HTTP and SOCKS proxies handle the destinations
+// that are neither virtual hosts nor routed via virtual hosts.
+type Egress struct {
+	// DisableDirect disables dialing such destinations directly.
+	DisableDirect bool `json:"disableDirect,omitempty"`
+	// Via is the VIP of the exit host for such destinations.
+	// When Via is nil and DisableDirect is true, such destinations are refused.
+	Via net.IP `json:"via,omitempty"`
+}
+
 type Route struct {
 	ToCIDR         []string `json:"toCIDR"`         // e.g. "192.168.95.0/24"
 	ToHostnameGlob []string `json:"toHostnameGlob"` // e.g. "*.cloud1.example.com"
 	Via            net.IP   `json:"via"`
+	// Fields added in v0.7.0
+	Ports []PortRange `json:"ports,omitempty"` // Empty means any port
 }
 
 // NameServer represents a built-in virtual DNS
 type NameServer struct {
 	IPPortProto
 }
+
+// DNS is the configuration of the built-in DNS of "me".
+type DNS struct {
+	Upstreams         []string `json:"upstreams,omitempty"`         // "IP:port"
+	FallbackUpstreams []string `json:"fallbackUpstreams,omitempty"` // "IP:port". Empty means the default.
+	DisableFallback   bool     `json:"disableFallback,omitempty"`
+	CacheSize         int      `json:"cacheSize,omitempty"` // Zero means the default.
+	DisableCache      bool     `json:"disableCache,omitempty"`
+	LogQueries        bool     `json:"logQueries,omitempty"`
+}
+
+// Resolver is the configuration of the resolver of the HTTP and SOCKS proxies.
+type Resolver struct {
+	CacheSize        int           `json:"cacheSize,omitempty"` // Zero means the default
+	CacheTTL         time.Duration `json:"cacheTTL,omitempty"`  // Zero means the default
+	DisableCache     bool          `json:"disableCache,omitempty"`
+	SkipSystemLookup bool          `json:"skipSystemLookup,omitempty"`
+}
+
+const (
+	DNSRecordTypeA     = "A"
+	DNSRecordTypeCNAME = "CNAME"
+	DNSRecordTypeTXT   = "TXT"
+)
+
+// DNSRecord is a custom DNS record served by the built-in DNS.
+type DNSRecord struct {
+	Name  string `json:"name"`  // e.g. "api.internal"
+	Type  string `json:"type"`  // "A", "CNAME", or "TXT"
+	Value string `json:"value"` // e.g. "192.168.95.100", "host1", "foo=bar"
+}
+
+// PortRange represents an inclusive range of port numbers.
+type PortRange struct {
+	Start uint16 `json:"start"`
+	End   uint16 `json:"end"`
+}
+
+func (pr PortRange) Contains(port uint16) bool {
+	return pr.Start <= port && port <= pr.End
+}
+
+// String returns "80" or "8000-8999"
+func (pr PortRange) String() string {
+	if pr.Start == pr.End {
+		return strconv.Itoa(int(pr.Start))
+	}
+	return fmt.Sprintf("%d-%d", pr.Start, pr.End)
+}
+
+type PolicyAction string
+
+const (
+	PolicyActionAllow PolicyAction = "allow"
+	PolicyActionDeny  PolicyAction = "deny"
+)
+
+// Policy allows or denies TCP connections between hosts.
+type Policy struct {
+	Action PolicyAction `json:"action"`
+	FromIP []net.IP     `json:"fromIP,omitempty"` // Empty means any host
+	ToCIDR []string     `json:"toCIDR,omitempty"` // Empty means any destination
+	Ports  []PortRange  `json:"ports,omitempty"`  // Empty means any port
+}
@@ -18,13 +18,81 @@ package jsonmsg
 
 import (
 	"net"
+	"time"
 )
 
 const (
 	EventTypeRouteSuggestion EventType = "routeSuggestion"
+	// Event types added in v0.7.0:
+	EventTypeDNSQuery  EventType = "dnsQuery"
+	EventTypeDNSStats  EventType = "dnsStats"
+	EventTypeAccessLog EventType = "accessLog"
+	// EventTypeResolverStats is sent since NoRouter v0.7.0
+	EventTypeResolverStats EventType = "resolverStats"
 )
 
 type RouteSuggestionEventData struct {
 	IP    []net.IP `json:"ip,omitempty"`
 	Route net.IP   `json:"route,omitempty"`
+	// Ports restricts the suggested route to the ports. Empty means all ports.
+	// Ports can be specified since NoRouter v0.7.0.
+	Ports []PortRange `json:"ports,omitempty"`
+}
+
+// DNSQueryEventData is sent for every query to the built-in DNS, when DNS.LogQueries is set.
+type DNSQueryEventData struct {
+	Client   string        `json:"client,omitempty"`
+	Name     string        `json:"name,omitempty"`
+	Type     string        `json:"type,omitempty"`  // e.g. "A"
+	Rcode    string        `json:"rcode,omitempty"` // e.g. "NOERROR"
+	Answer   []string      `json:"answer,omitempty"`
+	Upstream string        `json:"upstream,omitempty"` // "IP:port", "local", "cache", or "forwarded"
+	Latency  time.Duration `json:"latency,omitempty"`
+}
+
+// AccessLogEventData is sent for every request to the HTTP and SOCKS proxies, when AccessLog.Output is "manager".
+type AccessLogEventData struct {
+	Format string         `json:"format,omitempty"` // AccessLogFormatCLF or AccessLogFormatJSON
+	Entry  AccessLogEntry `json:"entry"`
+}
+
+// AccessLogEntry is an entry of the access logs of the HTTP and SOCKS proxies.
+type AccessLogEntry struct {
+	Time        time.Time     `json:"time"`
+	Proxy       string        `json:"proxy"`            // "http" or "socks"
+	Client      string        `json:"client,omitempty"` // "IP:port"
+	Method      string        `json:"method,omitempty"` // e.g. "GET", "CONNECT"
+	URL         string        `json:"url,omitempty"`    // HTTP only, e.g. "http://host1:8080/"
+	Proto       string        `json:"proto,omitempty"`  // e.g. "HTTP/1.1", "SOCKS"
+	Destination string        `json:"destination"`      // "host:port"
+	VIP         net.IP        `json:"vip,omitempty"`    // the virtual IP dialed over the mesh
+	Mesh        bool          `json:"mesh"`             // false when dialed directly
+	Status      int           `json:"status,omitempty"` // HTTP status
+	Bytes       int64         `json:"bytes"`            // bytes sent to the client
+	Duration    time.Duration `json:"duration"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// DNSStatsEventData is sent periodically, when the built-in DNS received queries since the last event.
+// The counters are not cumulative.
+type DNSStatsEventData struct {
+	Interval time.Duration     `json:"interval,omitempty"`
+	Queries  uint64            `json:"queries,omitempty"`
+	Rcodes   map[string]uint64 `json:"rcodes,omitempty"` // e.g. {"NOERROR": 42, "SERVFAIL": 1}
+}
+
+// ResolverStatsEventData is sent periodically, when the caches of the resolver of the agent were used since the last event.
+// The counters except Entries are not cumulative.
+type ResolverStatsEventData struct {
+	Interval      time.Duration `json:"interval,omitempty"`
+	LookupCache   CacheStats    `json:"lookupCache"`
+	DecisionCache CacheStats    `json:"decisionCache"`
+}
+
+// CacheStats is the statistics of a cache.
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits,omitempty"`
+	Misses    uint64 `json:"misses,omitempty"`
+	Evictions uint64 `json:"evictions,omitempty"` // including expirations and invalidations
 }
@@ -19,8 +19,11 @@ package stream
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"io"
 	"sync"
+
+	"github.com/norouter/norouter/pkg/stream/jsonmsg"
 )
 
 // Sender
@@ -50,3 +53,32 @@ func (sender *Sender) Send(p *Packet) error {
 	sender.Unlock()
 	return err
 }
+
+// SendEvent sends an event with the data dat, as a JSON packet.
+func (sender *Sender) SendEvent(typ jsonmsg.EventType, dat interface{}) error {
+	datJSON, err := json.Marshal(dat)
+	if err != nil {
+		return err
+	}
+	ev := jsonmsg.Event{
+		Type: typ,
+		Data: datJSON,
+	}
+	evJSON, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	msg := jsonmsg.Message{
+		Type: jsonmsg.TypeEvent,
+		Body: evJSON,
+	}
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	pkt := &Packet{
+		Type:    TypeJSON,
+		Payload: msgJSON,
+	}
+	return sender.Send(pkt)
+}
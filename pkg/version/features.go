@@ -34,8 +34,22 @@ const (
 	FeatureDNS    = "dns"    // Built-in DNS (10053/tcp)
 	// Features introduced in v0.6.3:
 	FeatureHostAliasesNipIO = "hostaliases.\"nip.io\"" // hostaliases using nip.io
+	// Features introduced in v0.7.0:
+	FeaturePolicies          = "policies"           // Refusing proxy connections that violate the policies
+	FeatureEgress            = "egress"             // Refusing or rerouting non-mesh proxy connections
+	FeatureDNSUDP            = "dns.udp"            // Built-in DNS over UDP
+	FeatureDNSLog            = "dns.log"            // Sending the query logs and the statistics of the built-in DNS as events
+	FeatureProxyAuth         = "proxy.auth"         // Authenticating the clients of the HTTP and SOCKS proxies
+	FeatureIngress           = "ingress"            // Reverse proxy routing by the Host header and the SNI
+	FeatureAccessLog         = "proxy.accessLog"    // Access logs of the HTTP and SOCKS proxies
+	FeatureUpstreamProxy     = "proxy.upstream"     // Dialing non-mesh destinations via an upstream HTTP or SOCKS5 proxy
+	FeatureSOCKSUDP          = "socks.udp"          // SOCKS5 UDP ASSOCIATE
+	FeatureSOCKSBind         = "socks.bind"         // SOCKS5 BIND
+	FeatureProxyVIPPort      = "proxy.vipPort"      // Listening the HTTP and SOCKS proxies on the VIP in the netstack
+	FeatureRoutesPorts       = "routes.ports"       // Routes limited to specific destination ports
+	FeatureHostnamesWildcard = "hostnames.wildcard" // Wildcard hostnames such as "*.host1"
 	// Features introduced in vX.Y.Z:
 	// ...
 )
 
-var Features = []Feature{FeatureLoopback, FeatureTCP, FeatureHTTP, FeatureLoopbackDisable, FeatureSOCKS, FeatureHostAliases, FeatureEtcHosts, FeatureRoutes, FeatureDNS}
+var Features = []Feature{FeatureLoopback, FeatureTCP, FeatureHTTP, FeatureLoopbackDisable, FeatureSOCKS, FeatureHostAliases, FeatureEtcHosts, FeatureRoutes, FeatureDNS, FeaturePolicies, FeatureEgress, FeatureDNSUDP, FeatureDNSLog, FeatureProxyAuth, FeatureIngress, FeatureAccessLog, FeatureUpstreamProxy, FeatureSOCKSUDP, FeatureSOCKSBind, FeatureProxyVIPPort, FeatureRoutesPorts, FeatureHostnamesWildcard}